@@ -6,6 +6,9 @@ import (
 	"kittygifs/other"
 	"kittygifs/routes"
 	. "kittygifs/util"
+	"kittygifs/util/mail"
+	"kittygifs/util/notifications"
+	"kittygifs/util/webhooks"
 	"log"
 	"os"
 	"time"
@@ -25,13 +28,62 @@ func main() {
 		if config.AccessControlAllowOrigin == nil {
 			config.AccessControlAllowOrigin = &[]string{"*"} // default to allow all origins
 		}
-		if config.ApiUrl == "" && config.Logto != nil {
-			log.Fatalln("apiUrl must be set in config.json when logto is enabled")
+		if len(config.Secret) < 32 {
+			log.Fatalln("secret must be set in config.json and be at least 32 characters long")
+		}
+		if config.SessionIdleDays == 0 {
+			config.SessionIdleDays = 30
+		}
+		if config.SessionMaxAgeDays == 0 {
+			config.SessionMaxAgeDays = 365
+		}
+		if config.GdprDeletionDelayDays == 0 {
+			config.GdprDeletionDelayDays = 14
+		}
+		if config.GdprExportRetentionDays == 0 {
+			config.GdprExportRetentionDays = 7
+		}
+		if config.SyncHistorySize == 0 {
+			config.SyncHistorySize = 10
+		}
+		if config.ApiUrl == "" && (config.Logto != nil || len(config.Oidc) != 0) {
+			log.Fatalln("apiUrl must be set in config.json when logto or oidc is enabled")
+		}
+		if err := config.ValidateOidc(); err != nil {
+			log.Fatalln(err)
+		}
+		if err := config.ValidateSyncNamespaces(); err != nil {
+			log.Fatalln(err)
+		}
+		if config.Metrics != nil && len(config.Metrics.Token) < 16 {
+			log.Fatalln("metrics.token must be at least 16 characters long")
 		}
 	}
+	// the health routes are served while starting up, so /readyz can report MongoDB isn't reachable yet
+	initialized := make(chan struct{})
+	go func() {
+		log.Fatal(routes.RunGin(&config, initialized))
+	}()
 	InitializeMongoDB(&config)
+	{
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+		err := RunMigrations(ctx, &config)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		cancel()
+	}
+	{
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		err := other.BackfillGroups(ctx)
+		if err != nil {
+			log.Println("failed to backfill groups:", err)
+		}
+		cancel()
+	}
 	// tag count updater
 	{
+		RegisterJob("tagCount", 1*time.Hour)
 		timer := time.NewTimer(1 * time.Hour)
 		go func() {
 			for {
@@ -43,13 +95,71 @@ func main() {
 				if err != nil {
 					log.Println(err)
 				}
+				RecordJobRun("tagCount", err)
 				log.Println("Done updating tag counts")
 				cancel()
 			}
 		}()
 	}
-	err := routes.RunGin(&config)
-	if err != nil {
-		log.Fatal(err)
+	// GDPR request processor
+	{
+		RegisterJob("gdprRequests", 1*time.Minute)
+		ticker := time.NewTicker(1 * time.Minute)
+		go func() {
+			for range ticker.C {
+				ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+				err := other.ProcessGdprRequests(ctx, &config)
+				if err != nil {
+					log.Println("failed to process GDPR requests:", err)
+				}
+				RecordJobRun("gdprRequests", err)
+				cancel()
+			}
+		}()
+	}
+	// notification event delivery for streams
+	{
+		backend, err := notifications.NewBackend(config.NotificationBackend)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		go notifications.DefaultHub.Run(context.Background(), backend)
+	}
+	// tag subscription notifications
+	{
+		RegisterJob("tagSubscriptions", 15*time.Second)
+		ticker := time.NewTicker(15 * time.Second)
+		go func() {
+			for range ticker.C {
+				ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+				err := other.ProcessSubscriptionBatches(ctx)
+				if err != nil {
+					log.Println("failed to process tag subscription batches:", err)
+				}
+				RecordJobRun("tagSubscriptions", err)
+				cancel()
+			}
+		}()
+	}
+	// webhook deliveries
+	RegisterJob(webhooks.DeliveriesJob, 5*time.Second)
+	go webhooks.DefaultDeliverer.Run(context.Background(), 5*time.Second)
+	// notification email digests
+	if mailer := mail.New(&config); mailer != nil {
+		RegisterJob("notificationDigests", 1*time.Hour)
+		ticker := time.NewTicker(1 * time.Hour)
+		go func() {
+			for range ticker.C {
+				ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+				err := notifications.SendEmailDigests(ctx, mailer, config.FrontendUrl)
+				if err != nil {
+					log.Println("failed to send notification digests:", err)
+				}
+				RecordJobRun("notificationDigests", err)
+				cancel()
+			}
+		}()
 	}
+	close(initialized)
+	select {}
 }
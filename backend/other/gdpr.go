@@ -0,0 +1,288 @@
+package other
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/gridfs"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	. "kittygifs/util"
+	"kittygifs/util/notifications"
+	"log"
+	"time"
+)
+
+// gdprProcessingTimeout is how long an issue can be processing before it's assumed the server stopped while processing it
+const gdprProcessingTimeout = 30 * time.Minute
+
+// ProcessGdprRequests creates exports for pending data requests, carries out deletions that are due
+// and removes expired exports
+func ProcessGdprRequests(ctx context.Context, config *Configuration) error {
+	now := time.Now()
+	claimable := bson.A{
+		bson.M{"status": IssueStatusPending},
+		bson.M{"status": IssueStatusProcessing, "updatedAt": bson.M{"$lt": now.Add(-gdprProcessingTimeout)}},
+	}
+	for {
+		issue, err := claimIssue(ctx, bson.M{"type": IssueTypeRequest, "$or": claimable})
+		if err != nil {
+			return err
+		}
+		if issue == nil {
+			break
+		}
+		err = CreateExport(ctx, issue.Id, issue.Username)
+		if err != nil {
+			log.Println("failed to create GDPR export:", err)
+		}
+		expiresAt := time.Now().Add(time.Duration(config.GdprExportRetentionDays) * 24 * time.Hour)
+		err = finishIssue(ctx, issue, err, bson.M{"exportExpiresAt": expiresAt})
+		if err != nil {
+			return err
+		}
+	}
+	for {
+		issue, err := claimIssue(ctx, bson.M{"type": IssueTypeDeletion, "executeAfter": bson.M{"$lte": now}, "$or": claimable})
+		if err != nil {
+			return err
+		}
+		if issue == nil {
+			break
+		}
+		err = DeleteAccount(ctx, issue.Username, issue.KeepPosts)
+		if err != nil {
+			log.Println("failed to delete account:", err)
+		}
+		err = finishIssue(ctx, issue, err, bson.M{})
+		if err != nil {
+			return err
+		}
+	}
+	cur, err := IssuesCol.Find(ctx, bson.M{"exportExpiresAt": bson.M{"$lt": now}})
+	if err != nil {
+		return err
+	}
+	var expired []Issue
+	err = cur.All(ctx, &expired)
+	if err != nil {
+		return err
+	}
+	for _, issue := range expired {
+		err = ExportsBucket.DeleteContext(ctx, issue.Id)
+		if err != nil && !errors.Is(err, gridfs.ErrFileNotFound) {
+			return err
+		}
+		_, err = IssuesCol.UpdateOne(ctx, bson.M{"_id": issue.Id}, bson.M{"$unset": bson.M{"exportExpiresAt": ""}})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// claimIssue atomically marks an issue matching the filter as processing and returns it, or nil if there is none
+func claimIssue(ctx context.Context, filter bson.M) (*Issue, error) {
+	var issue Issue
+	after := options.After
+	err := IssuesCol.FindOneAndUpdate(ctx, filter,
+		bson.M{"$set": bson.M{"status": IssueStatusProcessing, "updatedAt": time.Now()}},
+		&options.FindOneAndUpdateOptions{ReturnDocument: &after}).Decode(&issue)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, nil
+	}
+	return &issue, err
+}
+
+// finishIssue sets the issue's status depending on whether processing failed and notifies the requester
+func finishIssue(ctx context.Context, issue *Issue, processingErr error, set bson.M) error {
+	set["updatedAt"] = time.Now()
+	update := bson.M{"$set": set}
+	if processingErr != nil {
+		set["status"] = IssueStatusFailed
+		set["error"] = processingErr.Error()
+		delete(set, "exportExpiresAt")
+	} else {
+		set["status"] = IssueStatusCompleted
+		update["$unset"] = bson.M{"error": ""}
+	}
+	_, err := IssuesCol.UpdateOne(ctx, bson.M{"_id": issue.Id}, update)
+	if err != nil {
+		return err
+	}
+	notifications.MustDeleteNotificationsByEventId(issue.Id)
+	// deleted users can't receive notifications
+	if issue.Type == IssueTypeRequest || processingErr != nil {
+		notifications.MustNotifyUser(issue.Username, issue.Id, notifications.GdprRequestUpdate, map[string]interface{}{
+			"issueId":     issue.Id,
+			"requestType": issue.Type,
+			"status":      set["status"],
+		})
+	}
+	return nil
+}
+
+// CreateExport creates a zip archive of the user's data and stores it in ExportsBucket with the ID
+func CreateExport(ctx context.Context, id, username string) error {
+	var user User
+	err := UsersCol.FindOne(ctx, bson.M{"_id": username}).Decode(&user)
+	if err != nil {
+		return err
+	}
+	buf := new(bytes.Buffer)
+	archive := zip.NewWriter(buf)
+	err = writeJson(archive, "user.json", bson.M{
+		"username":                user.Username,
+		"groups":                  user.Groups,
+		"identities":              user.Identities,
+		"email":                   user.Email,
+		"emailVerified":           user.EmailVerified,
+		"totpEnabled":             user.TotpEnabled(),
+		"notificationPreferences": user.NotificationPreferences,
+	})
+	if err != nil {
+		return err
+	}
+	exports := []struct {
+		name   string
+		col    *mongo.Collection
+		filter bson.M
+		result interface{}
+	}{
+		{"gifs.json", GifsCol, bson.M{"uploader": username}, &[]Gif{}},
+		// includes the user's gif and tag edits
+		{"audit_log.json", AuditCol, bson.M{"actor": username}, &[]bson.M{}},
+		{"notifications.json", NotificationsCol, bson.M{"username": username}, &[]bson.M{}},
+		{"sessions.json", SessionsCol, bson.M{"username": username}, &[]UserSession{}},
+		{"api_tokens.json", ApiTokensCol, bson.M{"username": username}, &[]ApiToken{}},
+		{"sync_settings.json", SyncSettingsCol, bson.M{"username": username}, &[]bson.M{}},
+		{"sync_history.json", SyncHistoryCol, bson.M{"username": username}, &[]bson.M{}},
+		{"tag_subscriptions.json", TagSubscriptionsCol, bson.M{"username": username}, &[]TagSubscription{}},
+		{"saved_searches.json", SavedSearchesCol, bson.M{"username": username}, &[]SavedSearch{}},
+		{"owned_groups.json", GroupsCol, bson.M{"owners": username}, &[]Group{}},
+		{"gdpr_requests.json", IssuesCol, bson.M{"username": username}, &[]Issue{}},
+	}
+	for _, export := range exports {
+		cur, err := export.col.Find(ctx, export.filter)
+		if err != nil {
+			return err
+		}
+		err = cur.All(ctx, export.result)
+		if err != nil {
+			return err
+		}
+		err = writeJson(archive, export.name, export.result)
+		if err != nil {
+			return err
+		}
+	}
+	err = archive.Close()
+	if err != nil {
+		return err
+	}
+	// a failed earlier attempt may have left a file behind
+	err = ExportsBucket.DeleteContext(ctx, id)
+	if err != nil && !errors.Is(err, gridfs.ErrFileNotFound) {
+		return err
+	}
+	return ExportsBucket.UploadFromStreamWithID(id, "kittygifs-"+username+".zip", buf)
+}
+
+func writeJson(archive *zip.Writer, name string, value interface{}) error {
+	writer, err := archive.Create(name)
+	if err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(writer)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(value)
+}
+
+// ErrTombstoneIsAccount is returned when posts are kept but the DeletedUsername user is an account someone signs in to
+var ErrTombstoneIsAccount = errors.New("the " + DeletedUsername + " user is an account, not the tombstone user, " +
+	"it must be renamed or deleted before posts of deleted accounts can be kept")
+
+// DeleteAccount deletes the user and their data, if keepPosts is true their public gifs are reassigned
+// to the DeletedUsername tombstone user instead of being deleted
+func DeleteAccount(ctx context.Context, username string, keepPosts bool) error {
+	if username == DeletedUsername {
+		return errors.New("cannot delete the tombstone user")
+	}
+	if keepPosts {
+		TRUE := true
+		// an account with the name that isn't the tombstone makes inserting the tombstone fail
+		_, err := UsersCol.UpdateOne(ctx, bson.M{"_id": DeletedUsername, "tombstone": true},
+			bson.M{"$setOnInsert": bson.M{"passwordHash": ""}}, &options.UpdateOptions{Upsert: &TRUE})
+		if mongo.IsDuplicateKeyError(err) {
+			return ErrTombstoneIsAccount
+		} else if err != nil {
+			return err
+		}
+		// private gifs would be unreachable
+		_, err = GifsCol.DeleteMany(ctx, bson.M{"uploader": username, "group": "@" + username})
+		if err != nil {
+			return err
+		}
+		_, err = GifsCol.UpdateMany(ctx, bson.M{"uploader": username}, bson.M{"$set": bson.M{"uploader": DeletedUsername}})
+		if err != nil {
+			return err
+		}
+	} else {
+		_, err := GifsCol.DeleteMany(ctx, bson.M{"uploader": username})
+		if err != nil {
+			return err
+		}
+	}
+	deletions := []struct {
+		col    *mongo.Collection
+		filter bson.M
+	}{
+		{SessionsCol, bson.M{"username": username}},
+		{ApiTokensCol, bson.M{"username": username}},
+		{NotificationsCol, bson.M{"username": username}},
+		{NotificationEventsCol, bson.M{"username": username}},
+		{NotificationDigestCol, bson.M{"username": username}},
+		{TagSubscriptionsCol, bson.M{"username": username}},
+		{SubscriptionBatchesCol, bson.M{"_id": username}},
+		{SavedSearchesCol, bson.M{"username": username}},
+		{SyncSettingsCol, bson.M{"username": username}},
+		{SyncHistoryCol, bson.M{"username": username}},
+		{LoginChallengesCol, bson.M{"username": username}},
+		{VerificationTokensCol, bson.M{"username": username}},
+		{GroupInvitesCol, bson.M{"$or": bson.A{bson.M{"createdBy": username}, bson.M{"username": username}}}},
+	}
+	for _, deletion := range deletions {
+		_, err := deletion.col.DeleteMany(ctx, deletion.filter)
+		if err != nil {
+			return err
+		}
+	}
+	_, err := GroupsCol.UpdateMany(ctx, bson.M{"owners": username}, bson.M{"$pull": bson.M{"owners": username}})
+	if err != nil {
+		return err
+	}
+	cur, err := IssuesCol.Find(ctx, bson.M{"username": username, "exportExpiresAt": bson.M{"$exists": true}})
+	if err != nil {
+		return err
+	}
+	var issues []Issue
+	err = cur.All(ctx, &issues)
+	if err != nil {
+		return err
+	}
+	for _, issue := range issues {
+		err = ExportsBucket.DeleteContext(ctx, issue.Id)
+		if err != nil && !errors.Is(err, gridfs.ErrFileNotFound) {
+			return err
+		}
+	}
+	_, err = IssuesCol.UpdateMany(ctx, bson.M{"username": username}, bson.M{"$unset": bson.M{"exportExpiresAt": ""}})
+	if err != nil {
+		return err
+	}
+	_, err = UsersCol.DeleteOne(ctx, bson.M{"_id": username})
+	return err
+}
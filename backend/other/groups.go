@@ -0,0 +1,40 @@
+package other
+
+import (
+	"context"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	. "kittygifs/util"
+	"strings"
+)
+
+// BackfillGroups creates group entities for groups that are used by users or gifs but don't exist yet
+func BackfillGroups(ctx context.Context) error {
+	userGroups, err := UsersCol.Distinct(ctx, "groups", bson.M{})
+	if err != nil {
+		return err
+	}
+	gifGroups, err := GifsCol.Distinct(ctx, "group", bson.M{})
+	if err != nil {
+		return err
+	}
+	TRUE := true
+	updateOptions := &options.UpdateOptions{
+		Upsert: &TRUE,
+	}
+	for _, name := range append(userGroups, gifGroups...) {
+		name, ok := name.(string)
+		if !ok || strings.HasPrefix(name, "@") {
+			continue
+		}
+		_, err = GroupsCol.UpdateOne(ctx, bson.M{"_id": name}, bson.M{"$setOnInsert": Group{
+			Name:         name,
+			Owners:       []string{},
+			IsPermission: IsPermissionGroupName(name),
+		}}, updateOptions)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,156 @@
+package other
+
+import (
+	"context"
+	"errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	. "kittygifs/util"
+	"kittygifs/util/notifications"
+	"log"
+	"strings"
+	"time"
+)
+
+// subscriptionBatchWindow is how long gifs matching a user's subscriptions are collected before the user is notified,
+// so uploading many gifs at once results in one notification
+const subscriptionBatchWindow = time.Minute
+
+// subscriptionBatchMaxGifs is the most gif IDs included in a notification, its count includes all of them
+const subscriptionBatchMaxGifs = 50
+
+// subscriptionBatchLease is how long a batch being notified of is hidden from other instances
+const subscriptionBatchLease = time.Minute
+
+type subscriptionBatch struct {
+	Username        string    `bson:"_id"`
+	GifIds          []string  `bson:"gifIds"`
+	SubscriptionIds []string  `bson:"subscriptionIds"`
+	NotifyAt        time.Time `bson:"notifyAt"`
+	// ProcessingAt is when the batch was leased to be notified of
+	ProcessingAt *time.Time `bson:"processingAt,omitempty"`
+}
+
+func MustMatchSubscriptions(gif Gif) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	err := MatchSubscriptions(ctx, gif)
+	if err != nil {
+		log.Println("failed to match tag subscriptions:", err)
+	}
+}
+
+// MatchSubscriptions adds a new gif to the batches of users subscribed to one of its tags or a query matching it,
+// if they can see the gif
+func MatchSubscriptions(ctx context.Context, gif Gif) error {
+	// only the uploader can see private gifs
+	if gif.Group != nil && strings.HasPrefix(*gif.Group, "@") {
+		return nil
+	}
+	cur, err := TagSubscriptionsCol.Find(ctx, bson.M{
+		"username": bson.M{"$ne": gif.Uploader},
+		"$or": bson.A{
+			bson.M{"tag": bson.M{"$in": gif.Tags}},
+			bson.M{"query": bson.M{"$exists": true}},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	var subscriptions []TagSubscription
+	err = cur.All(ctx, &subscriptions)
+	if err != nil {
+		return err
+	}
+	matched := make(map[string][]string)
+	for _, subscription := range subscriptions {
+		if subscription.Query != "" {
+			query, err := ParseQuery(subscription.Query, &subscription.Username)
+			if err != nil || !query.Matches(&gif) {
+				continue
+			}
+		}
+		matched[subscription.Username] = append(matched[subscription.Username], subscription.Id)
+	}
+	TRUE := true
+	for username, subscriptionIds := range matched {
+		if gif.Group != nil {
+			var user User
+			err = UsersCol.FindOne(ctx, bson.M{"_id": username}).Decode(&user)
+			if errors.Is(err, mongo.ErrNoDocuments) {
+				continue
+			} else if err != nil {
+				return err
+			}
+			err = user.SuspendTotpGroups(ctx)
+			if err != nil {
+				return err
+			}
+			if !user.HasGroup(*gif.Group) {
+				continue
+			}
+		}
+		_, err = SubscriptionBatchesCol.UpdateOne(ctx, bson.M{"_id": username}, bson.M{
+			"$addToSet": bson.M{
+				"gifIds":          gif.Id,
+				"subscriptionIds": bson.M{"$each": subscriptionIds},
+			},
+			"$setOnInsert": bson.M{"notifyAt": time.Now().Add(subscriptionBatchWindow)},
+		}, &options.UpdateOptions{Upsert: &TRUE})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ProcessSubscriptionBatches notifies users of the gifs in their batches that are due.
+// Each batch is leased before notifying, and only deleted once the notification has been dispatched,
+// so a failure leaves it to be retried once the lease expires
+func ProcessSubscriptionBatches(ctx context.Context) error {
+	for ctx.Err() == nil {
+		now := time.Now()
+		var batch subscriptionBatch
+		err := SubscriptionBatchesCol.FindOneAndUpdate(ctx, bson.M{
+			"notifyAt": bson.M{"$lte": now},
+			"$or": bson.A{
+				bson.M{"processingAt": bson.M{"$exists": false}},
+				bson.M{"processingAt": bson.M{"$lte": now.Add(-subscriptionBatchLease)}},
+			},
+		}, bson.M{"$set": bson.M{"processingAt": now}}).Decode(&batch)
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		gifIds := batch.GifIds
+		if len(gifIds) > subscriptionBatchMaxGifs {
+			gifIds = gifIds[len(gifIds)-subscriptionBatchMaxGifs:]
+		}
+		err = notifications.NotifyUser(batch.Username, NewUlid(), notifications.TagSubscriptionGifs, map[string]interface{}{
+			"gifIds":          gifIds,
+			"count":           len(batch.GifIds),
+			"subscriptionIds": batch.SubscriptionIds,
+		})
+		if err != nil {
+			return err
+		}
+		// gifs may have been added to the batch while it was being notified of, those are left for the next batch
+		res, err := SubscriptionBatchesCol.DeleteOne(ctx, bson.M{"_id": batch.Username, "gifIds": bson.M{"$size": len(batch.GifIds)}})
+		if err != nil {
+			return err
+		}
+		if res.DeletedCount == 0 {
+			_, err = SubscriptionBatchesCol.UpdateOne(ctx, bson.M{"_id": batch.Username}, bson.M{
+				"$pullAll": bson.M{"gifIds": batch.GifIds},
+				"$set":     bson.M{"notifyAt": time.Now().Add(subscriptionBatchWindow)},
+				"$unset":   bson.M{"processingAt": ""},
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -6,9 +6,12 @@ import (
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo/options"
 	. "kittygifs/util"
+	"kittygifs/util/metrics"
+	"time"
 )
 
 func RunTagCount(ctx context.Context) (map[string]int32, error) {
+	start := time.Now()
 	// gets tags from the tags collection and their counts into a map like {"tag1": 5, "tag2": 3}
 	cur, err := TagsCol.Aggregate(ctx, bson.A{
 		bson.D{
@@ -87,10 +90,13 @@ func RunTagCount(ctx context.Context) (map[string]int32, error) {
 	updateOptions := &options.UpdateOptions{
 		Upsert: &TRUE,
 	}
+	// the number of tags with a wrong count, including new and deleted tags
+	drift := 0
 	// updates the tags collection with the new counts, handles new too
 	for tag, count := range res {
 		previousCount, exists := previousTagCounts[tag]
 		if !exists || count != previousCount {
+			drift++
 			_, err = TagsCol.UpdateOne(ctx, bson.M{"_id": tag}, bson.M{"$set": bson.M{"count": count}}, updateOptions)
 			if err != nil {
 				return nil, err
@@ -101,11 +107,15 @@ func RunTagCount(ctx context.Context) (map[string]int32, error) {
 	for tag, _ := range previousTagCounts {
 		_, exists := res[tag]
 		if !exists {
+			drift++
 			_, err = TagsCol.DeleteOne(ctx, bson.M{"_id": tag})
 			if err != nil {
 				return nil, err
 			}
 		}
 	}
+	metrics.TagCountDuration.Set(time.Since(start).Seconds())
+	metrics.TagCountDrift.Set(float64(drift))
+	metrics.TagCountLastSuccess.Set(float64(time.Now().Unix()))
 	return res, nil
 }
@@ -0,0 +1,98 @@
+package routes
+
+import (
+	"context"
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	. "kittygifs/util"
+	"kittygifs/util/audit"
+	"slices"
+	"strconv"
+	"time"
+)
+
+func MountAdmin(mounting *Mounting) {
+	mounting.Authed.GET("/admin/audit", requirePermission(PermViewAuditLog), func(c *gin.Context) {
+		type Request struct {
+			Actor  string `form:"actor"`
+			Action string `form:"action"`
+			Target string `form:"target"`
+			Since  string `form:"since"`
+			Until  string `form:"until"`
+			Before string `form:"before"`
+			Max    string `form:"max"`
+		}
+		var req Request
+		err := c.ShouldBindQuery(&req)
+		if err != nil {
+			c.JSON(400, Error(err))
+			return
+		}
+		filter := bson.M{}
+		if req.Actor != "" {
+			filter["actor"] = req.Actor
+		}
+		if req.Action != "" {
+			if !slices.Contains(audit.Actions, req.Action) {
+				c.JSON(400, ErrorStr("invalid action"))
+				return
+			}
+			filter["action"] = req.Action
+		}
+		if req.Target != "" {
+			filter["target"] = req.Target
+		}
+		if req.Since != "" || req.Until != "" {
+			timeFilter := bson.M{}
+			if req.Since != "" {
+				since, err := time.Parse(time.RFC3339, req.Since)
+				if err != nil {
+					c.JSON(400, ErrorStr("invalid since"))
+					return
+				}
+				timeFilter["$gte"] = since
+			}
+			if req.Until != "" {
+				until, err := time.Parse(time.RFC3339, req.Until)
+				if err != nil {
+					c.JSON(400, ErrorStr("invalid until"))
+					return
+				}
+				timeFilter["$lt"] = until
+			}
+			filter["time"] = timeFilter
+		}
+		if req.Before != "" {
+			filter["_id"] = bson.M{"$lt": req.Before}
+		}
+		var maxNum int64 = 100
+		if req.Max != "" {
+			maxNum, err = strconv.ParseInt(req.Max, 10, 64)
+			if err != nil || maxNum < 1 || maxNum > 500 {
+				c.JSON(400, ErrorStr("invalid max"))
+				return
+			}
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		cur, err := AuditCol.Find(ctx, filter, &options.FindOptions{
+			Limit: &maxNum,
+			Sort:  bson.M{"_id": -1},
+		})
+		if err != nil {
+			c.JSON(500, Error(err))
+			return
+		}
+		var entries []audit.Entry
+		err = cur.All(ctx, &entries)
+		if err != nil {
+			c.JSON(500, Error(err))
+			return
+		}
+		if entries == nil {
+			entries = []audit.Entry{}
+		}
+		c.JSON(200, entries)
+	})
+}
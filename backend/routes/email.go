@@ -0,0 +1,328 @@
+package routes
+
+import (
+	"context"
+	"errors"
+	"github.com/alexedwards/argon2id"
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	. "kittygifs/util"
+	"kittygifs/util/mail"
+	"log"
+	netMail "net/mail"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Mailer is nil if email isn't configured
+var Mailer mail.Mailer
+
+const (
+	tokenPurposeVerifyEmail   = "verifyEmail"
+	tokenPurposeResetPassword = "resetPassword"
+	verifyEmailLifetime       = 24 * time.Hour
+	resetPasswordLifetime     = time.Hour
+)
+
+type VerificationToken struct {
+	Hash      string    `bson:"_id"`
+	Purpose   string    `bson:"purpose"`
+	Username  string    `bson:"username"`
+	Email     string    `bson:"email,omitempty"`
+	ExpiresAt time.Time `bson:"expiresAt"`
+}
+
+func MountEmail(mounting *Mounting) {
+	mounting.Authed.PUT("/users/self/email", mounting.PasswordRateLimit, func(c *gin.Context) {
+		type Request struct {
+			Email       string `json:"email"`
+			Password    string `json:"password"`
+			ReauthToken string `json:"reauthToken"`
+		}
+		var req Request
+		err := c.BindJSON(&req)
+		if err != nil {
+			c.JSON(400, Error(err))
+			return
+		}
+		if !requireMailer(c) {
+			return
+		}
+		email, err := normalizeEmail(req.Email)
+		if err != nil {
+			c.JSON(400, Error(err))
+			return
+		}
+		user := GetUser(c)
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		if !checkPasswordOrReauth(ctx, c, user, req.Password, req.ReauthToken) {
+			return
+		}
+		count, err := UsersCol.CountDocuments(ctx, bson.M{"email": email, "emailVerified": true})
+		if err != nil {
+			c.JSON(500, Error(err))
+			return
+		}
+		if count > 0 {
+			c.JSON(400, ErrorStr("email already in use"))
+			return
+		}
+		_, err = UsersCol.UpdateOne(ctx, bson.M{"_id": user.Username},
+			bson.M{"$set": bson.M{"email": email}, "$unset": bson.M{"emailVerified": ""}})
+		if err != nil {
+			c.JSON(500, Error(err))
+			return
+		}
+		token, err := createVerificationToken(ctx, tokenPurposeVerifyEmail, user.Username, email, verifyEmailLifetime)
+		if err != nil {
+			c.JSON(500, Error(err))
+			return
+		}
+		err = Mailer.Send(ctx, mail.Message{
+			To:      email,
+			Subject: "Verify your email for kittygifs",
+			Body: "Hi " + user.Username + ",\n\n" +
+				"confirm this is your email address with the following link or token, it is valid for 24 hours.\n\n" +
+				frontendLink("/verifyEmail", token) + "\n\n" +
+				"If you didn't add this email to your kittygifs account, you can ignore this email.",
+		})
+		if err != nil {
+			c.JSON(500, Error(err))
+			return
+		}
+		c.Status(204)
+	})
+	mounting.Authed.DELETE("/users/self/email", mounting.PasswordRateLimit, func(c *gin.Context) {
+		type Request struct {
+			Password    string `json:"password"`
+			ReauthToken string `json:"reauthToken"`
+		}
+		var req Request
+		err := c.BindJSON(&req)
+		if err != nil {
+			c.JSON(400, Error(err))
+			return
+		}
+		user := GetUser(c)
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if !checkPasswordOrReauth(ctx, c, user, req.Password, req.ReauthToken) {
+			return
+		}
+		_, err = UsersCol.UpdateOne(ctx, bson.M{"_id": user.Username}, bson.M{"$unset": bson.M{"email": "", "emailVerified": ""}})
+		if err != nil {
+			c.JSON(500, Error(err))
+			return
+		}
+		_, err = VerificationTokensCol.DeleteMany(ctx, bson.M{"username": user.Username})
+		if err != nil {
+			c.JSON(500, Error(err))
+			return
+		}
+		c.Status(204)
+	})
+	mounting.Normal.POST("/users/verifyEmail", func(c *gin.Context) {
+		type Request struct {
+			Token string `json:"token"`
+		}
+		var req Request
+		err := c.BindJSON(&req)
+		if err != nil {
+			c.JSON(400, Error(err))
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		token, ok := useVerificationToken(ctx, c, req.Token, tokenPurposeVerifyEmail, verifyEmailLifetime)
+		if !ok {
+			return
+		}
+		res, err := UsersCol.UpdateOne(ctx, bson.M{"_id": token.Username, "email": token.Email},
+			bson.M{"$set": bson.M{"emailVerified": true}})
+		if mongo.IsDuplicateKeyError(err) {
+			c.JSON(400, ErrorStr("email already in use"))
+			return
+		} else if err != nil {
+			c.JSON(500, Error(err))
+			return
+		}
+		if res.MatchedCount == 0 {
+			c.JSON(400, ErrorStr("the email has been changed since the token was sent"))
+			return
+		}
+		c.Status(204)
+	})
+	mounting.Normal.POST("/users/forgotPassword", mounting.PasswordRateLimit, func(c *gin.Context) {
+		type Request struct {
+			// Username or Email identifies the user
+			Username string  `json:"username"`
+			Email    string  `json:"email"`
+			Captcha  *string `json:"captcha"`
+		}
+		var req Request
+		err := c.BindJSON(&req)
+		if err != nil {
+			c.JSON(400, Error(err))
+			return
+		}
+		if !requireMailer(c) {
+			return
+		}
+		if verifyCaptcha(c, req.Captcha) != true {
+			return
+		}
+		filter := bson.M{"_id": req.Username, "emailVerified": true}
+		if req.Username == "" {
+			email, err := normalizeEmail(req.Email)
+			if err != nil {
+				c.JSON(400, Error(err))
+				return
+			}
+			filter = bson.M{"email": email, "emailVerified": true}
+		}
+		// the response doesn't depend on whether the user exists, so it can't be used to find out
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer cancel()
+			var user User
+			err := UsersCol.FindOne(ctx, filter).Decode(&user)
+			if errors.Is(err, mongo.ErrNoDocuments) {
+				return
+			} else if err != nil {
+				log.Println("failed to find user for password reset:", err)
+				return
+			}
+			_, err = VerificationTokensCol.DeleteMany(ctx, bson.M{"username": user.Username, "purpose": tokenPurposeResetPassword})
+			if err != nil {
+				log.Println("failed to delete old password reset tokens:", err)
+				return
+			}
+			token, err := createVerificationToken(ctx, tokenPurposeResetPassword, user.Username, "", resetPasswordLifetime)
+			if err != nil {
+				log.Println("failed to create password reset token:", err)
+				return
+			}
+			err = Mailer.Send(ctx, mail.Message{
+				To:      *user.Email,
+				Subject: "Reset your kittygifs password",
+				Body: "Hi " + user.Username + ",\n\n" +
+					"you can reset your password with the following link or token, it is valid for 1 hour.\n\n" +
+					frontendLink("/resetPassword", token) + "\n\n" +
+					"If you didn't request a password reset, you can ignore this email.",
+			})
+			if err != nil {
+				log.Println("failed to send password reset email:", err)
+			}
+		}()
+		c.Status(204)
+	})
+	mounting.Normal.POST("/users/resetPasswordWithToken", mounting.PasswordRateLimit, func(c *gin.Context) {
+		type Request struct {
+			Token       string `json:"token"`
+			NewPassword string `json:"newPassword"`
+		}
+		var req Request
+		err := c.BindJSON(&req)
+		if err != nil {
+			c.JSON(400, Error(err))
+			return
+		}
+		if len(req.NewPassword) < 8 {
+			c.JSON(400, ErrorStr("new password too short(<8)"))
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		token, ok := useVerificationToken(ctx, c, req.Token, tokenPurposeResetPassword, resetPasswordLifetime)
+		if !ok {
+			return
+		}
+		hash, err := argon2id.CreateHash(req.NewPassword, Argon2idParams)
+		if err != nil {
+			c.JSON(500, Error(err))
+			return
+		}
+		_, err = UsersCol.UpdateOne(ctx, bson.M{"_id": token.Username}, bson.M{"$set": bson.M{"passwordHash": hash}})
+		if err != nil {
+			c.JSON(500, Error(err))
+			return
+		}
+		// whoever knew the old password shouldn't stay logged in
+		_, err = SessionsCol.DeleteMany(ctx, bson.M{"username": token.Username})
+		if err != nil {
+			c.JSON(500, Error(err))
+			return
+		}
+		c.Status(200)
+	})
+}
+
+// requireMailer returns true if email is configured, otherwise it writes the error to the response and returns false
+func requireMailer(c *gin.Context) bool {
+	if Mailer == nil {
+		c.JSON(400, ErrorStr("email is not configured on this instance"))
+		return false
+	}
+	return true
+}
+
+// normalizeEmail validates a bare email address and lowercases it
+func normalizeEmail(email string) (string, error) {
+	address, err := netMail.ParseAddress(email)
+	if err != nil || address.Address != email || address.Name != "" {
+		return "", errors.New("invalid email")
+	}
+	if len(email) > 254 {
+		return "", errors.New("email too long(>254)")
+	}
+	return strings.ToLower(email), nil
+}
+
+// frontendLink returns a link to the frontend page with the token, or just the token if frontendUrl isn't configured
+func frontendLink(path, token string) string {
+	if Config.FrontendUrl == "" {
+		return token
+	}
+	return strings.TrimSuffix(Config.FrontendUrl, "/") + path + "?token=" + url.QueryEscape(token)
+}
+
+// createVerificationToken creates a one-time token for the purpose and returns it
+func createVerificationToken(ctx context.Context, purpose, username, email string, lifetime time.Duration) (string, error) {
+	token := GenerateVerificationToken()
+	_, err := VerificationTokensCol.InsertOne(ctx, VerificationToken{
+		Hash:      Config.HashToken(token),
+		Purpose:   purpose,
+		Username:  username,
+		Email:     email,
+		ExpiresAt: time.Now().Add(lifetime),
+	})
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// useVerificationToken checks the token's age and deletes it so it can't be used again, returns the token if it's valid,
+// otherwise it writes the error to the response and returns false
+func useVerificationToken(ctx context.Context, c *gin.Context, token, purpose string, lifetime time.Duration) (*VerificationToken, bool) {
+	createdAt, err := GetVerificationTokenTimestamp(token)
+	// expired tokens are only removed by the TTL index periodically
+	if err != nil || time.Since(createdAt) > lifetime {
+		c.JSON(400, ErrorStr("invalid or expired token"))
+		return nil, false
+	}
+	var verificationToken VerificationToken
+	err = VerificationTokensCol.FindOneAndDelete(ctx, bson.M{"_id": Config.HashToken(token), "purpose": purpose}).
+		Decode(&verificationToken)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		c.JSON(400, ErrorStr("invalid or expired token"))
+		return nil, false
+	} else if err != nil {
+		c.JSON(500, Error(err))
+		return nil, false
+	}
+	return &verificationToken, true
+}
@@ -0,0 +1,193 @@
+package routes
+
+import (
+	"context"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/gridfs"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	. "kittygifs/util"
+	"kittygifs/util/audit"
+	"kittygifs/util/notifications"
+	"slices"
+	"strconv"
+	"time"
+)
+
+var issueStatuses = []string{IssueStatusPending, IssueStatusProcessing, IssueStatusCompleted, IssueStatusFailed,
+	IssueStatusRejected, IssueStatusCancelled, IssueStatusLegacy}
+
+func MountGdpr(mounting *Mounting) {
+	mounting.Authed.GET("/users/self/gdprRequests", func(c *gin.Context) {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		cur, err := IssuesCol.Find(ctx, bson.M{"username": GetUser(c).Username}, &options.FindOptions{Sort: bson.M{"_id": -1}})
+		if err != nil {
+			c.JSON(500, Error(err))
+			return
+		}
+		var issues []Issue
+		err = cur.All(ctx, &issues)
+		if err != nil {
+			c.JSON(500, Error(err))
+			return
+		}
+		if issues == nil {
+			issues = []Issue{}
+		}
+		c.JSON(200, issues)
+	})
+	mounting.Authed.DELETE("/users/self/gdprRequests/:id", func(c *gin.Context) {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		res, err := IssuesCol.UpdateOne(ctx, bson.M{
+			"_id":      c.Param("id"),
+			"username": GetUser(c).Username,
+			"status":   IssueStatusPending,
+		}, bson.M{"$set": bson.M{"status": IssueStatusCancelled, "updatedAt": time.Now()}})
+		if err != nil {
+			c.JSON(500, Error(err))
+			return
+		}
+		if res.MatchedCount == 0 {
+			c.JSON(404, ErrorStr("pending request not found"))
+			return
+		}
+		notifications.MustDeleteNotificationsByEventId(c.Param("id"))
+		c.Status(204)
+	})
+	mounting.Authed.GET("/users/self/gdprRequests/:id/export", func(c *gin.Context) {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		count, err := IssuesCol.CountDocuments(ctx, bson.M{
+			"_id":             c.Param("id"),
+			"username":        GetUser(c).Username,
+			"exportExpiresAt": bson.M{"$gt": time.Now()},
+		})
+		if err != nil {
+			c.JSON(500, Error(err))
+			return
+		}
+		if count == 0 {
+			c.JSON(404, ErrorStr("export not found"))
+			return
+		}
+		stream, err := ExportsBucket.OpenDownloadStream(c.Param("id"))
+		if errors.Is(err, gridfs.ErrFileNotFound) {
+			c.JSON(404, ErrorStr("export not found"))
+			return
+		} else if err != nil {
+			c.JSON(500, Error(err))
+			return
+		}
+		defer stream.Close()
+		file := stream.GetFile()
+		c.DataFromReader(200, file.Length, "application/zip", stream, map[string]string{
+			"Content-Disposition": `attachment; filename="` + file.Name + `"`,
+		})
+	})
+	mounting.Authed.GET("/admin/gdprRequests", requirePermission(PermManageGdpr), func(c *gin.Context) {
+		type Request struct {
+			Status   string `form:"status"`
+			Username string `form:"username"`
+			Before   string `form:"before"`
+			Max      string `form:"max"`
+		}
+		var req Request
+		err := c.ShouldBindQuery(&req)
+		if err != nil {
+			c.JSON(400, Error(err))
+			return
+		}
+		filter := bson.M{}
+		if req.Status != "" {
+			if !slices.Contains(issueStatuses, req.Status) {
+				c.JSON(400, ErrorStr("invalid status"))
+				return
+			}
+			filter["status"] = req.Status
+		}
+		if req.Username != "" {
+			filter["username"] = req.Username
+		}
+		if req.Before != "" {
+			filter["_id"] = bson.M{"$lt": req.Before}
+		}
+		var maxNum int64 = 100
+		if req.Max != "" {
+			maxNum, err = strconv.ParseInt(req.Max, 10, 64)
+			if err != nil || maxNum < 1 || maxNum > 500 {
+				c.JSON(400, ErrorStr("invalid max"))
+				return
+			}
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		cur, err := IssuesCol.Find(ctx, filter, &options.FindOptions{
+			Limit: &maxNum,
+			Sort:  bson.M{"_id": -1},
+		})
+		if err != nil {
+			c.JSON(500, Error(err))
+			return
+		}
+		var issues []Issue
+		err = cur.All(ctx, &issues)
+		if err != nil {
+			c.JSON(500, Error(err))
+			return
+		}
+		if issues == nil {
+			issues = []Issue{}
+		}
+		c.JSON(200, issues)
+	})
+	mounting.Authed.POST("/admin/gdprRequests/:id/approve", requirePermission(PermManageGdpr), func(c *gin.Context) {
+		now := time.Now()
+		issue, ok := resolveIssue(c, bson.M{"type": IssueTypeDeletion}, bson.M{"executeAfter": now})
+		if !ok {
+			return
+		}
+		audit.MustRecord(c, audit.GdprApprove, issue.Id, nil, issue)
+		c.JSON(200, issue)
+	})
+	mounting.Authed.POST("/admin/gdprRequests/:id/reject", requirePermission(PermManageGdpr), func(c *gin.Context) {
+		issue, ok := resolveIssue(c, bson.M{}, bson.M{"status": IssueStatusRejected})
+		if !ok {
+			return
+		}
+		audit.MustRecord(c, audit.GdprReject, issue.Id, nil, issue)
+		notifications.MustDeleteNotificationsByEventId(issue.Id)
+		notifications.MustNotifyUser(issue.Username, issue.Id, notifications.GdprRequestUpdate, map[string]interface{}{
+			"issueId":     issue.Id,
+			"requestType": issue.Type,
+			"status":      issue.Status,
+		})
+		c.JSON(200, issue)
+	})
+}
+
+// resolveIssue applies the update to the pending issue given by the id param and records the authenticated user
+// as having resolved it, returns the updated issue, otherwise it writes the error to the response and returns false
+func resolveIssue(c *gin.Context, filter, set bson.M) (*Issue, bool) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	filter["_id"] = c.Param("id")
+	filter["status"] = IssueStatusPending
+	set["resolvedBy"] = GetUser(c).Username
+	set["updatedAt"] = time.Now()
+	after := options.After
+	var issue Issue
+	err := IssuesCol.FindOneAndUpdate(ctx, filter, bson.M{"$set": set},
+		&options.FindOneAndUpdateOptions{ReturnDocument: &after}).Decode(&issue)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		c.JSON(404, ErrorStr("pending request not found"))
+		return nil, false
+	} else if err != nil {
+		c.JSON(500, Error(err))
+		return nil, false
+	}
+	return &issue, true
+}
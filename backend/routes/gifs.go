@@ -9,9 +9,15 @@ import (
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo/options"
 	"io"
+	"kittygifs/other"
 	. "kittygifs/util"
+	"kittygifs/util/audit"
+	"kittygifs/util/metrics"
 	"kittygifs/util/notifications"
+	"kittygifs/util/webhooks"
 	"net/http"
+	"reflect"
+	"slices"
 	"strconv"
 	"time"
 )
@@ -51,75 +57,18 @@ func MountGifs(mounting *Mounting) {
 				return
 			}
 		}
+		queryString, ok := expandQuery(ctx, c, queryString, user)
+		if !ok {
+			return
+		}
 		query, err := ParseQuery(queryString, username)
 		if err != nil {
 			c.JSON(400, ErrorStr("failed to parse query: "+err.Error()))
 			return
 		}
-		search := map[string]interface{}{}
-		if query.Group == nil && query.IncludeGroups == nil {
-			search["group"] = bson.M{"$exists": false}
-		}
-		if query.Uploader != "" {
-			search["uploader"] = query.Uploader
-		}
-		if query.NoteRegex != "" {
-			search["note"] = primitive.Regex{Pattern: query.NoteRegex, Options: "i"}
-		}
-		if query.NoteText != "" {
-			search["$text"] = bson.M{"$search": query.NoteText}
-		}
-		tags := query.Tags
-		if len(tags) > 0 {
-			tagsQuery := bson.M{}
-			// todo: clean this up
-			if len(tags) > 1 {
-				newTagsQuery := make([]interface{}, len(tags)-1)
-				for i, v := range tags[:len(tags)-1] {
-					newTagsQuery[i] = v
-				}
-				tagsQuery["$all"] = newTagsQuery
-			}
-			var arr []interface{}
-			if rr, ok := tagsQuery["$all"]; ok {
-				arr = rr.([]interface{})
-			} else {
-				arr = []interface{}{}
-			}
-			tagsQuery["$all"] = append(arr, primitive.Regex{Pattern: "^" + tags[len(tags)-1] + ".*$"})
-			search["tags"] = tagsQuery
-		}
-		if query.IncludeGroups != nil || query.Group != nil {
-			if query.IncludeGroups != nil {
-				if !user.HasGroups(*query.IncludeGroups) {
-					c.JSON(403, ErrorStr("you do not have access to these groups"))
-					return
-				}
-				groupsOr := make([]bson.M, 0, 2)
-				var includeGroups *[]string
-				if len(*query.IncludeGroups) == 0 {
-					if user != nil && user.Groups != nil {
-						includeGroups = user.Groups
-						tmp := append(*includeGroups, "@"+user.Username)
-						includeGroups = &tmp
-					}
-				} else {
-					includeGroups = query.IncludeGroups
-				}
-				groupsOr = append(groupsOr, bson.M{"group": bson.M{"$exists": false}})
-				{
-					thisOr := bson.M{"group": bson.M{"$in": includeGroups}}
-					groupsOr = append(groupsOr, thisOr)
-				}
-				search["$or"] = groupsOr
-			}
-			if query.Group != nil {
-				if !user.HasGroup(*query.Group) {
-					c.JSON(403, ErrorStr("you do not have access to these groups"))
-					return
-				}
-				search["group"] = query.Group
-			}
+		search, ok := searchFilter(ctx, c, query, user)
+		if !ok {
+			return
 		}
 		gifs := make([]Gif, 0, maxNum)
 		cursor, err := GifsCol.Find(ctx, search, &options.FindOptions{
@@ -205,12 +154,14 @@ func MountGifs(mounting *Mounting) {
 
 			res, err := http.DefaultClient.Get("https://tenor.com/view/" + match[1])
 			if err != nil {
+				metrics.TenorFetchFailures.Inc("request")
 				c.JSON(500, Error(err))
 				return
 			}
 			defer res.Body.Close()
 			body, err := io.ReadAll(res.Body)
 			if err != nil {
+				metrics.TenorFetchFailures.Inc("request")
 				c.JSON(500, Error(err))
 				return
 			}
@@ -218,6 +169,7 @@ func MountGifs(mounting *Mounting) {
 			// PreviewGif
 			match = TenorPreviewGifUrl.FindStringSubmatch(bytes.NewBuffer(body).String())
 			if len(match) == 0 {
+				metrics.TenorFetchFailures.Inc("parse")
 				c.JSON(400, ErrorStr("could not find gif url for preview in tenor page"))
 				return
 			}
@@ -229,6 +181,7 @@ func MountGifs(mounting *Mounting) {
 			// PreviewVideo
 			match = TenorPreviewVideoUrl.FindStringSubmatch(bytes.NewBuffer(body).String())
 			if len(match) == 0 {
+				metrics.TenorFetchFailures.Inc("parse")
 				c.JSON(400, ErrorStr("could not find video url for preview in tenor page"))
 				return
 			}
@@ -240,6 +193,7 @@ func MountGifs(mounting *Mounting) {
 			// PreviewVideoWebm
 			match = TenorPreviewVideoWebmUrl.FindStringSubmatch(bytes.NewBuffer(body).String())
 			if len(match) == 0 {
+				metrics.TenorFetchFailures.Inc("parse")
 				c.JSON(400, ErrorStr("could not find webm video url for preview in tenor page"))
 				return
 			}
@@ -275,6 +229,8 @@ func MountGifs(mounting *Mounting) {
 			c.JSON(500, Error(err))
 			return
 		}
+		go webhooks.MustPublish(gif.Uploader, webhooks.GifCreate, gif.Id, gif)
+		go other.MustMatchSubscriptions(gif)
 		c.JSON(200, gif)
 	})
 	mounting.Authed.PATCH("/gifs/:id", func(c *gin.Context) {
@@ -295,10 +251,11 @@ func MountGifs(mounting *Mounting) {
 			c.JSON(500, Error(err))
 			return
 		}
-		if originalGif.Uploader != c.GetString("username") && !user.HasGroup("perm:edit_all_gifs") {
-			c.JSON(403, ErrorStr("you are not the uploader of this gif nor do you have perm:edit_all_gifs"))
+		if !canEditGif(user, &originalGif) {
+			c.JSON(403, ErrorStr("you are not the uploader of this gif nor do you have the edit_all_gifs permission"))
 			return
 		}
+		before := originalGif
 
 		originalGif.Group = edit.Group
 		if originalGif.Group != nil && *originalGif.Group == "" {
@@ -318,11 +275,192 @@ func MountGifs(mounting *Mounting) {
 			return
 		}
 		GifsCol.FindOneAndReplace(ctx, bson.M{"_id": c.Param("id")}, originalGif)
+		if before.Uploader != user.Username {
+			audit.MustRecord(c, audit.GifEdit, before.Id, before, originalGif)
+		}
+		go webhooks.MustPublish(user.Username, webhooks.GifEdit, originalGif.Id, originalGif)
 		if gifEditRequest := c.Query("gifEditSuggestion"); gifEditRequest != "" {
 			go notifications.MustDeleteNotificationsByEventId(gifEditRequest)
 		}
 		c.JSON(200, originalGif)
 	})
+	mounting.Authed.POST("/gifs/bulk-edit", func(c *gin.Context) {
+		user := GetUser(c)
+		type Request struct {
+			Query      *string  `json:"query"`
+			Ids        []string `json:"ids"`
+			AddTags    []string `json:"addTags"`
+			RemoveTags []string `json:"removeTags"`
+			Group      *string  `json:"group"`
+			Note       *string  `json:"note"`
+			DryRun     bool     `json:"dryRun"`
+		}
+		var req Request
+		err := c.BindJSON(&req)
+		if err != nil {
+			c.JSON(400, Error(err))
+			return
+		}
+		if (req.Query == nil) == (req.Ids == nil) {
+			c.JSON(400, ErrorStr("exactly one of query or ids must be specified"))
+			return
+		}
+		if len(req.Ids) > bulkEditMax {
+			c.JSON(400, ErrorStr("too many ids(>"+strconv.Itoa(bulkEditMax)+")"))
+			return
+		}
+		if err = ValidateTags(req.AddTags); err != nil {
+			c.JSON(400, Error(err))
+			return
+		}
+		if req.Group != nil && *req.Group == "private" {
+			privateGroup := "@" + user.Username
+			req.Group = &privateGroup
+		} else if req.Group != nil && *req.Group != "" && !user.HasGroup(*req.Group) {
+			c.JSON(403, ErrorStr("you do not have the group "+*req.Group))
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		var filter bson.M
+		if req.Query != nil {
+			if len(*req.Query) > 256 {
+				c.JSON(400, ErrorStr("query too long(>256)"))
+				return
+			}
+			queryString, ok := expandQuery(ctx, c, *req.Query, user)
+			if !ok {
+				return
+			}
+			query, err := ParseQuery(queryString, &user.Username)
+			if err != nil {
+				c.JSON(400, ErrorStr("failed to parse query: "+err.Error()))
+				return
+			}
+			filter, ok = searchFilter(ctx, c, query, user)
+			if !ok {
+				return
+			}
+		} else {
+			// gifs in groups the user can't see are left out, the same as IDs of gifs that don't exist
+			filter = bson.M{"_id": bson.M{"$in": req.Ids}}
+			if !user.HasGroup("admin") {
+				groups := []string{"@" + user.Username}
+				if user.Groups != nil {
+					groups = append(groups, *user.Groups...)
+				}
+				filter["$or"] = bson.A{
+					bson.M{"group": bson.M{"$exists": false}},
+					bson.M{"group": bson.M{"$in": groups}},
+				}
+			}
+		}
+		limit := int64(bulkEditMax + 1)
+		cur, err := GifsCol.Find(ctx, filter, &options.FindOptions{Limit: &limit})
+		if err != nil {
+			c.JSON(500, Error(err))
+			return
+		}
+		var gifs []Gif
+		err = cur.All(ctx, &gifs)
+		if err != nil {
+			c.JSON(500, Error(err))
+			return
+		}
+		if len(gifs) > bulkEditMax {
+			c.JSON(400, ErrorStr("too many matching gifs(>"+strconv.Itoa(bulkEditMax)+"), narrow down the query"))
+			return
+		}
+		type Skipped struct {
+			Id    string `json:"id"`
+			Error string `json:"error"`
+		}
+		skipped := []Skipped{}
+		type change struct {
+			before Gif
+			after  Gif
+		}
+		changes := make([]change, 0, len(gifs))
+		for _, gif := range gifs {
+			if !canEditGif(user, &gif) {
+				skipped = append(skipped, Skipped{gif.Id, "you are not the uploader of this gif nor do you have the edit_all_gifs permission"})
+				continue
+			}
+			edited := gif
+			edited.Tags = make([]string, 0, len(gif.Tags)+len(req.AddTags))
+			for _, tag := range gif.Tags {
+				if !slices.Contains(req.RemoveTags, tag) {
+					edited.Tags = append(edited.Tags, tag)
+				}
+			}
+			for _, tag := range req.AddTags {
+				if !slices.Contains(edited.Tags, tag) {
+					edited.Tags = append(edited.Tags, tag)
+				}
+			}
+			if req.Group != nil {
+				if *req.Group == "" {
+					edited.Group = nil
+				} else {
+					edited.Group = req.Group
+				}
+			}
+			if req.Note != nil {
+				edited.Note = *req.Note
+			}
+			if err = ValidateGif(edited); err != nil {
+				skipped = append(skipped, Skipped{gif.Id, err.Error()})
+				continue
+			}
+			if reflect.DeepEqual(gif, edited) {
+				continue
+			}
+			changes = append(changes, change{gif, edited})
+		}
+		if req.DryRun {
+			sample := make([]Gif, 0, bulkEditSampleSize)
+			for _, ch := range changes {
+				if len(sample) == bulkEditSampleSize {
+					break
+				}
+				sample = append(sample, ch.after)
+			}
+			c.JSON(200, gin.H{
+				"matched":  len(gifs),
+				"affected": len(changes),
+				"skipped":  skipped,
+				"sample":   sample,
+			})
+			return
+		}
+		affected := 0
+		for _, ch := range changes {
+			// the gif is only replaced if the fields that can be edited haven't changed since it was read
+			unchanged := bson.M{"_id": ch.before.Id, "tags": ch.before.Tags, "note": ch.before.Note}
+			if ch.before.Group != nil {
+				unchanged["group"] = *ch.before.Group
+			} else {
+				unchanged["group"] = bson.M{"$exists": false}
+			}
+			res, err := GifsCol.ReplaceOne(ctx, unchanged, ch.after)
+			if err != nil {
+				skipped = append(skipped, Skipped{ch.before.Id, err.Error()})
+				continue
+			}
+			if res.MatchedCount == 0 {
+				skipped = append(skipped, Skipped{ch.before.Id, "the gif was changed during the bulk edit"})
+				continue
+			}
+			affected++
+			audit.MustRecord(c, audit.GifBulkEdit, ch.before.Id, ch.before, ch.after)
+			go webhooks.MustPublish(c.GetString("username"), webhooks.GifEdit, ch.after.Id, ch.after)
+		}
+		c.JSON(200, gin.H{
+			"matched":  len(gifs),
+			"affected": affected,
+			"skipped":  skipped,
+		})
+	})
 	mounting.Authed.DELETE("/gifs/:id", func(c *gin.Context) {
 		userGet, _ := c.Get("user")
 		user := userGet.(*User)
@@ -335,11 +473,15 @@ func MountGifs(mounting *Mounting) {
 			c.JSON(500, Error(err))
 			return
 		}
-		if originalGif.Uploader != c.GetString("username") && !user.HasGroup("perm:delete_all_gifs") {
-			c.JSON(403, ErrorStr("you are not the uploader of this gif nor do you have perm:delete_all_gifs"))
+		if originalGif.Uploader != c.GetString("username") && !user.HasPermission(PermDeleteAllGifs) {
+			c.JSON(403, ErrorStr("you are not the uploader of this gif nor do you have the delete_all_gifs permission"))
 			return
 		}
 		GifsCol.FindOneAndDelete(ctx, bson.M{"_id": c.Param("id")})
+		if originalGif.Uploader != user.Username {
+			audit.MustRecord(c, audit.GifDelete, originalGif.Id, originalGif, nil)
+		}
+		go webhooks.MustPublish(user.Username, webhooks.GifDelete, originalGif.Id, originalGif)
 		c.JSON(200, originalGif)
 	})
 	mounting.Authed.POST("/gifs/:id/edit/suggestions", func(c *gin.Context) {
@@ -372,3 +514,97 @@ func MountGifs(mounting *Mounting) {
 		c.Status(200)
 	})
 }
+
+const (
+	bulkEditMax        = 500
+	bulkEditSampleSize = 10
+)
+
+// canEditGif returns true if the user is the uploader of the gif or has the edit_all_gifs permission
+func canEditGif(user *User, gif *Gif) bool {
+	return gif.Uploader == user.Username || user.HasPermission(PermEditAllGifs)
+}
+
+// searchFilter builds the MongoDB filter for a parsed search query, returns false if the requested groups
+// don't exist or the user is not allowed to search them, in which case the error is written to the response
+func searchFilter(ctx context.Context, c *gin.Context, query *ComprehensiveQuery, user *User) (bson.M, bool) {
+	{
+		var groups []string
+		if query.IncludeGroups != nil {
+			groups = append(groups, *query.IncludeGroups...)
+		}
+		if query.Group != nil {
+			groups = append(groups, *query.Group)
+		}
+		if err := ValidateGroupsExist(ctx, groups); err != nil {
+			c.JSON(400, Error(err))
+			return nil, false
+		}
+	}
+	search := bson.M{}
+	if query.Group == nil && query.IncludeGroups == nil {
+		search["group"] = bson.M{"$exists": false}
+	}
+	if query.Uploader != "" {
+		search["uploader"] = query.Uploader
+	}
+	if query.NoteRegex != "" {
+		search["note"] = primitive.Regex{Pattern: query.NoteRegex, Options: "i"}
+	}
+	if query.NoteText != "" {
+		search["$text"] = bson.M{"$search": query.NoteText}
+	}
+	tags := query.Tags
+	if len(tags) > 0 {
+		tagsQuery := bson.M{}
+		// todo: clean this up
+		if len(tags) > 1 {
+			newTagsQuery := make([]interface{}, len(tags)-1)
+			for i, v := range tags[:len(tags)-1] {
+				newTagsQuery[i] = v
+			}
+			tagsQuery["$all"] = newTagsQuery
+		}
+		var arr []interface{}
+		if rr, ok := tagsQuery["$all"]; ok {
+			arr = rr.([]interface{})
+		} else {
+			arr = []interface{}{}
+		}
+		tagsQuery["$all"] = append(arr, primitive.Regex{Pattern: "^" + tags[len(tags)-1] + ".*$"})
+		search["tags"] = tagsQuery
+	}
+	if query.IncludeGroups != nil || query.Group != nil {
+		if query.IncludeGroups != nil {
+			if !user.HasGroups(*query.IncludeGroups) {
+				c.JSON(403, ErrorStr("you do not have access to these groups"))
+				return nil, false
+			}
+			groupsOr := make([]bson.M, 0, 2)
+			var includeGroups *[]string
+			if len(*query.IncludeGroups) == 0 {
+				if user != nil && user.Groups != nil {
+					includeGroups = user.Groups
+					tmp := append(*includeGroups, "@"+user.Username)
+					includeGroups = &tmp
+				}
+			} else {
+				includeGroups = query.IncludeGroups
+			}
+			groupsOr = append(groupsOr, bson.M{"group": bson.M{"$exists": false}})
+			{
+				thisOr := bson.M{"group": bson.M{"$in": includeGroups}}
+				groupsOr = append(groupsOr, thisOr)
+			}
+			search["$or"] = groupsOr
+		}
+		if query.Group != nil {
+			if !user.HasGroup(*query.Group) {
+				c.JSON(403, ErrorStr("you do not have access to these groups"))
+				return nil, false
+			}
+			search["group"] = query.Group
+		}
+	}
+	return search, true
+}
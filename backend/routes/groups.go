@@ -0,0 +1,450 @@
+package routes
+
+import (
+	"context"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	. "kittygifs/util"
+	"kittygifs/util/notifications"
+	"slices"
+	"time"
+)
+
+func MountGroups(mounting *Mounting) {
+	mounting.Authed.GET("/groups", func(c *gin.Context) {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		cur, err := GroupsCol.Find(ctx, bson.M{})
+		if err != nil {
+			c.JSON(500, Error(err))
+			return
+		}
+		var groups []Group
+		err = cur.All(ctx, &groups)
+		if err != nil {
+			c.JSON(500, Error(err))
+			return
+		}
+		if groups == nil {
+			groups = []Group{}
+		}
+		c.JSON(200, groups)
+	})
+	mounting.Authed.GET("/groups/:group", func(c *gin.Context) {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		group, ok := findGroup(ctx, c)
+		if !ok {
+			return
+		}
+		c.JSON(200, group)
+	})
+	mounting.Authed.POST("/groups", requirePermission(PermManageGroups), func(c *gin.Context) {
+		var group Group
+		err := c.BindJSON(&group)
+		if err != nil {
+			c.JSON(400, Error(err))
+			return
+		}
+		if group.Owners == nil {
+			group.Owners = []string{}
+		}
+		if IsPermissionGroupName(group.Name) {
+			group.IsPermission = true
+		}
+		if err = ValidateGroup(group); err != nil {
+			c.JSON(400, Error(err))
+			return
+		}
+		if group.IsPermission && !canManageGroup(GetUser(c), &group) {
+			c.JSON(403, ErrorStr("you do not have the "+PermManageRoles+" permission"))
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		_, err = GroupsCol.InsertOne(ctx, group)
+		if mongo.IsDuplicateKeyError(err) {
+			c.JSON(400, ErrorStr("group already exists"))
+			return
+		} else if err != nil {
+			c.JSON(500, Error(err))
+			return
+		}
+		c.JSON(200, group)
+	})
+	mounting.Authed.PATCH("/groups/:group", func(c *gin.Context) {
+		user := GetUser(c)
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		group, ok := findGroup(ctx, c)
+		if !ok {
+			return
+		}
+		if !canManageGroup(user, group) {
+			c.JSON(403, ErrorStr("you are not an owner of this group"))
+			return
+		}
+		var update Group
+		err := c.BindJSON(&update)
+		if err != nil {
+			c.JSON(400, Error(err))
+			return
+		}
+		group.Description = update.Description
+		// owners, the permission flag and the TOTP requirement can only be changed by group managers
+		if user.HasPermission(PermManageGroups) {
+			if update.Owners != nil {
+				group.Owners = update.Owners
+			}
+			group.IsPermission = update.IsPermission || IsPermissionGroupName(group.Name)
+			// don't let managers lock themselves out of the group
+			if update.RequireTotp && !group.RequireTotp && user.HasGroup(group.Name) && !user.TotpEnabled() {
+				c.JSON(400, ErrorStr("enable TOTP before requiring it for a group you are a member of"))
+				return
+			}
+			group.RequireTotp = update.RequireTotp
+		}
+		if err = ValidateGroup(*group); err != nil {
+			c.JSON(400, Error(err))
+			return
+		}
+		_, err = GroupsCol.ReplaceOne(ctx, bson.M{"_id": group.Name}, group)
+		if err != nil {
+			c.JSON(500, Error(err))
+			return
+		}
+		c.JSON(200, group)
+	})
+	mounting.Authed.DELETE("/groups/:group", requirePermission(PermManageGroups), func(c *gin.Context) {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		group, ok := findGroup(ctx, c)
+		if !ok {
+			return
+		}
+		if !canManageGroup(GetUser(c), group) {
+			c.JSON(403, ErrorStr("you do not have the "+PermManageRoles+" permission"))
+			return
+		}
+		count, err := GifsCol.CountDocuments(ctx, bson.M{"group": c.Param("group")})
+		if err != nil {
+			c.JSON(500, Error(err))
+			return
+		}
+		if count > 0 {
+			c.JSON(400, ErrorStr("group still has gifs"))
+			return
+		}
+		_, err = GroupsCol.DeleteOne(ctx, bson.M{"_id": c.Param("group")})
+		if err != nil {
+			c.JSON(500, Error(err))
+			return
+		}
+		_, err = UsersCol.UpdateMany(ctx, bson.M{"groups": c.Param("group")}, bson.M{"$pull": bson.M{"groups": c.Param("group")}})
+		if err != nil {
+			c.JSON(500, Error(err))
+			return
+		}
+		// the invites would add users back to the group, if it were created again
+		_, err = GroupInvitesCol.DeleteMany(ctx, bson.M{"group": c.Param("group")})
+		if err != nil {
+			c.JSON(500, Error(err))
+			return
+		}
+		c.Status(204)
+	})
+	mounting.Authed.GET("/groups/:group/members", func(c *gin.Context) {
+		user := GetUser(c)
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		group, ok := findGroup(ctx, c)
+		if !ok {
+			return
+		}
+		if !canManageGroup(user, group) && !user.HasGroup(group.Name) {
+			c.JSON(403, ErrorStr("you are not a member of this group"))
+			return
+		}
+		cur, err := UsersCol.Find(ctx, bson.M{"groups": group.Name})
+		if err != nil {
+			c.JSON(500, Error(err))
+			return
+		}
+		members := []string{}
+		for cur.Next(ctx) {
+			var member User
+			err = cur.Decode(&member)
+			if err != nil {
+				c.JSON(500, Error(err))
+				return
+			}
+			members = append(members, member.Username)
+		}
+		c.JSON(200, members)
+	})
+	mounting.Authed.PUT("/groups/:group/members/:username", func(c *gin.Context) {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		group, ok := findGroup(ctx, c)
+		if !ok {
+			return
+		}
+		if !canManageGroup(GetUser(c), group) {
+			c.JSON(403, ErrorStr("you are not an owner of this group"))
+			return
+		}
+		res, err := UsersCol.UpdateOne(ctx, bson.M{"_id": c.Param("username")}, bson.M{"$addToSet": bson.M{"groups": group.Name}})
+		if err != nil {
+			c.JSON(500, Error(err))
+			return
+		}
+		if res.MatchedCount == 0 {
+			c.JSON(404, ErrorStr("user not found"))
+			return
+		}
+		c.Status(204)
+	})
+	mounting.Authed.DELETE("/groups/:group/members/:username", func(c *gin.Context) {
+		user := GetUser(c)
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		group, ok := findGroup(ctx, c)
+		if !ok {
+			return
+		}
+		// anyone can leave a group
+		if !canManageGroup(user, group) && c.Param("username") != user.Username {
+			c.JSON(403, ErrorStr("you are not an owner of this group"))
+			return
+		}
+		_, err := UsersCol.UpdateOne(ctx, bson.M{"_id": c.Param("username")}, bson.M{"$pull": bson.M{"groups": group.Name}})
+		if err != nil {
+			c.JSON(500, Error(err))
+			return
+		}
+		c.Status(204)
+	})
+
+	// invites
+	mounting.Authed.GET("/groups/:group/invites", func(c *gin.Context) {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		group, ok := findGroup(ctx, c)
+		if !ok {
+			return
+		}
+		if !canManageGroup(GetUser(c), group) {
+			c.JSON(403, ErrorStr("you are not an owner of this group"))
+			return
+		}
+		cur, err := GroupInvitesCol.Find(ctx, bson.M{
+			"group":     group.Name,
+			"expiresAt": bson.M{"$gt": time.Now()},
+			"$expr":     bson.M{"$lt": bson.A{"$uses", "$maxUses"}},
+		})
+		if err != nil {
+			c.JSON(500, Error(err))
+			return
+		}
+		var invites []GroupInvite
+		err = cur.All(ctx, &invites)
+		if err != nil {
+			c.JSON(500, Error(err))
+			return
+		}
+		if invites == nil {
+			invites = []GroupInvite{}
+		}
+		c.JSON(200, invites)
+	})
+	mounting.Authed.POST("/groups/:group/invites", func(c *gin.Context) {
+		user := GetUser(c)
+		type Request struct {
+			// ExpiresIn is the number of seconds the invite is valid for
+			ExpiresIn int64   `json:"expiresIn"`
+			MaxUses   int32   `json:"maxUses"`
+			Username  *string `json:"username"`
+		}
+		var req Request
+		err := c.BindJSON(&req)
+		if err != nil {
+			c.JSON(400, Error(err))
+			return
+		}
+		if req.ExpiresIn == 0 {
+			req.ExpiresIn = int64(groupInviteDefaultExpiry.Seconds())
+		} else if req.ExpiresIn < 60 || req.ExpiresIn > int64(groupInviteMaxExpiry.Seconds()) {
+			c.JSON(400, ErrorStr("invalid expiresIn, must be between 60 seconds and 30 days"))
+			return
+		}
+		if req.MaxUses == 0 {
+			req.MaxUses = 1
+		} else if req.MaxUses < 0 || req.MaxUses > 1000 {
+			c.JSON(400, ErrorStr("invalid maxUses(<1 or >1000)"))
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		group, ok := findGroup(ctx, c)
+		if !ok {
+			return
+		}
+		if !canManageGroup(user, group) {
+			c.JSON(403, ErrorStr("you are not an owner of this group"))
+			return
+		}
+		if req.Username != nil {
+			count, err := UsersCol.CountDocuments(ctx, bson.M{"_id": *req.Username})
+			if err != nil {
+				c.JSON(500, Error(err))
+				return
+			}
+			if count == 0 {
+				c.JSON(404, ErrorStr("user not found"))
+				return
+			}
+		}
+		invite := GroupInvite{
+			Code:      GenerateRandomString(16),
+			Group:     group.Name,
+			CreatedBy: user.Username,
+			ExpiresAt: time.Now().Add(time.Duration(req.ExpiresIn) * time.Second),
+			MaxUses:   req.MaxUses,
+			Username:  req.Username,
+		}
+		_, err = GroupInvitesCol.InsertOne(ctx, invite)
+		if err != nil {
+			c.JSON(500, Error(err))
+			return
+		}
+		if invite.Username != nil {
+			go notifications.MustNotifyUser(*invite.Username, invite.Code, notifications.GroupInvitation, map[string]interface{}{
+				"group":     invite.Group,
+				"code":      invite.Code,
+				"username":  user.Username,
+				"expiresAt": invite.ExpiresAt,
+			})
+		}
+		c.JSON(200, invite)
+	})
+	mounting.Authed.DELETE("/groups/:group/invites/:code", func(c *gin.Context) {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		group, ok := findGroup(ctx, c)
+		if !ok {
+			return
+		}
+		if !canManageGroup(GetUser(c), group) {
+			c.JSON(403, ErrorStr("you are not an owner of this group"))
+			return
+		}
+		_, err := GroupInvitesCol.DeleteOne(ctx, bson.M{"_id": c.Param("code"), "group": group.Name})
+		if err != nil {
+			c.JSON(500, Error(err))
+			return
+		}
+		go notifications.MustDeleteNotificationsByEventId(c.Param("code"))
+		c.Status(204)
+	})
+	mounting.Authed.POST("/groups/join", func(c *gin.Context) {
+		user := GetUser(c)
+		type Request struct {
+			Code string `json:"code"`
+		}
+		var req Request
+		err := c.BindJSON(&req)
+		if err != nil {
+			c.JSON(400, Error(err))
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		var invite GroupInvite
+		err = GroupInvitesCol.FindOne(ctx, bson.M{"_id": req.Code}).Decode(&invite)
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			c.JSON(400, ErrorStr("invalid or expired invite"))
+			return
+		} else if err != nil {
+			c.JSON(500, Error(err))
+			return
+		}
+		if user.Groups != nil && slices.Contains(*user.Groups, invite.Group) {
+			c.JSON(400, ErrorStr("you are already a member of this group"))
+			return
+		}
+		// invites are deleted with their group, but invites of groups deleted before that may be left
+		count, err := GroupsCol.CountDocuments(ctx, bson.M{"_id": invite.Group})
+		if err != nil {
+			c.JSON(500, Error(err))
+			return
+		}
+		if count == 0 {
+			c.JSON(400, ErrorStr("invalid or expired invite"))
+			return
+		}
+		// claim a use of the invite, this fails if it has been used up, expired or is for someone else
+		err = GroupInvitesCol.FindOneAndUpdate(ctx, bson.M{
+			"_id":       req.Code,
+			"expiresAt": bson.M{"$gt": time.Now()},
+			"$expr":     bson.M{"$lt": bson.A{"$uses", "$maxUses"}},
+			"$or": bson.A{
+				bson.M{"username": bson.M{"$exists": false}},
+				bson.M{"username": user.Username},
+			},
+		}, bson.M{"$inc": bson.M{"uses": 1}}).Err()
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			c.JSON(400, ErrorStr("invalid or expired invite"))
+			return
+		} else if err != nil {
+			c.JSON(500, Error(err))
+			return
+		}
+		_, err = UsersCol.UpdateOne(ctx, bson.M{"_id": user.Username}, bson.M{"$addToSet": bson.M{"groups": invite.Group}})
+		if err != nil {
+			releaseGroupInvite(ctx, req.Code)
+			c.JSON(500, Error(err))
+			return
+		}
+		go notifications.MustDeleteNotifications(bson.M{"eventId": invite.Code, "username": user.Username})
+		c.JSON(200, gin.H{"group": invite.Group})
+	})
+}
+
+// releaseGroupInvite gives back a use of the invite claimed when joining its group
+func releaseGroupInvite(ctx context.Context, code string) {
+	_, _ = GroupInvitesCol.UpdateOne(ctx, bson.M{"_id": code, "uses": bson.M{"$gt": 0}}, bson.M{"$inc": bson.M{"uses": -1}})
+}
+
+const (
+	groupInviteDefaultExpiry = 7 * 24 * time.Hour
+	groupInviteMaxExpiry     = 30 * 24 * time.Hour
+)
+
+// findGroup finds the group given by the group parameter, otherwise it writes the error to the response and returns false
+func findGroup(ctx context.Context, c *gin.Context) (*Group, bool) {
+	var group Group
+	err := GroupsCol.FindOne(ctx, bson.M{"_id": c.Param("group")}).Decode(&group)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		c.JSON(404, ErrorStr("group not found"))
+		return nil, false
+	} else if err != nil {
+		c.JSON(500, Error(err))
+		return nil, false
+	}
+	return &group, true
+}
+
+// canManageGroup returns true if the user has the manage_groups permission or is an owner of the group,
+// permission groups can only be managed by admins
+func canManageGroup(user *User, group *Group) bool {
+	if group.IsPermission {
+		// admins have every permission, so a user that could join admin could get any other permission
+		if group.Name == "admin" {
+			return user.HasGroup("admin")
+		}
+		return user.HasPermission(PermManageRoles)
+	}
+	return user.HasPermission(PermManageGroups) || slices.Contains(group.Owners, user.Username)
+}
@@ -0,0 +1,93 @@
+package routes
+
+import (
+	"context"
+	"github.com/gin-gonic/gin"
+	. "kittygifs/util"
+	"sync/atomic"
+	"time"
+)
+
+// started is set once MongoDB is connected, migrations have run and all routes are served
+var started atomic.Bool
+
+type healthCheck struct {
+	Status     string  `json:"status"`
+	DurationMs float64 `json:"durationMs"`
+	Error      string  `json:"error,omitempty"`
+	// Version and Expected are the migration versions
+	Version  *int `json:"version,omitempty"`
+	Expected *int `json:"expected,omitempty"`
+}
+
+func MountHealth(mounting *Mounting) {
+	// liveness, the server can respond to requests
+	mounting.Normal.GET("/healthz", func(c *gin.Context) {
+		c.JSON(200, gin.H{"status": "ok"})
+	})
+	// readiness, the server can handle requests that use the database.
+	// Background jobs are reported, but don't affect the status
+	mounting.Normal.GET("/readyz", func(c *gin.Context) {
+		if !started.Load() {
+			c.JSON(503, gin.H{
+				"status": "unavailable",
+				"checks": map[string]*healthCheck{
+					"startup": {Status: "failing", Error: "connecting to MongoDB and running migrations"},
+				},
+				"jobs": JobStatuses(),
+			})
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		checks := map[string]*healthCheck{
+			"mongo":      checkMongo(ctx),
+			"migrations": checkMigrations(ctx),
+		}
+		status, code := "ok", 200
+		for _, check := range checks {
+			if check.Status != "ok" {
+				status, code = "unavailable", 503
+			}
+		}
+		c.JSON(code, gin.H{
+			"status": status,
+			"checks": checks,
+			"jobs":   JobStatuses(),
+		})
+	})
+}
+
+func checkMongo(ctx context.Context) *healthCheck {
+	start := time.Now()
+	err := MongoClient.Ping(ctx, nil)
+	return newHealthCheck(start, err)
+}
+
+// checkMigrations checks that the database has been migrated to what this version of the server expects,
+// another instance of a different version may have migrated it further
+func checkMigrations(ctx context.Context) *healthCheck {
+	start := time.Now()
+	version, err := GetMigrationVersion(ctx)
+	check := newHealthCheck(start, err)
+	if err != nil {
+		return check
+	}
+	expected := len(Migrations)
+	check.Version = &version
+	check.Expected = &expected
+	if version != expected {
+		check.Status = "failing"
+		check.Error = "migration version doesn't match"
+	}
+	return check
+}
+
+func newHealthCheck(start time.Time, err error) *healthCheck {
+	check := &healthCheck{Status: "ok", DurationMs: float64(time.Since(start).Microseconds()) / 1000}
+	if err != nil {
+		check.Status = "failing"
+		check.Error = err.Error()
+	}
+	return check
+}
@@ -0,0 +1,32 @@
+package routes
+
+import (
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestReadyzWhileStarting(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	MountHealth(&Mounting{Normal: r.Group("/")})
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/healthz", nil))
+	assert.Equal(t, 200, w.Code)
+
+	// MongoDB isn't connected yet, so it must not be pinged
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/readyz", nil))
+	assert.Equal(t, 503, w.Code)
+	var res struct {
+		Status string                 `json:"status"`
+		Checks map[string]healthCheck `json:"checks"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &res))
+	assert.Equal(t, "unavailable", res.Status)
+	assert.Equal(t, "failing", res.Checks["startup"].Status)
+}
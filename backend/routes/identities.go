@@ -0,0 +1,154 @@
+package routes
+
+import (
+	"context"
+	"errors"
+	"github.com/alexedwards/argon2id"
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	. "kittygifs/util"
+	"time"
+)
+
+type IdentityInfo struct {
+	Provider string `json:"provider"`
+	// ProviderName is the name of the provider shown to users
+	ProviderName string `json:"providerName"`
+	Subject      string `json:"subject"`
+}
+
+func MountIdentities(mounting *Mounting) {
+	mounting.Authed.GET("/users/self/identities", func(c *gin.Context) {
+		user := GetUser(c)
+		identities := make([]IdentityInfo, len(user.Identities))
+		for i, identity := range user.Identities {
+			identities[i] = IdentityInfo{
+				Provider:     identity.Provider,
+				ProviderName: providerName(identity.Provider),
+				Subject:      identity.Subject,
+			}
+		}
+		c.JSON(200, gin.H{
+			"identities":  identities,
+			"hasPassword": user.PasswordHash != "",
+		})
+	})
+	mounting.Authed.DELETE("/users/self/identities/:provider", mounting.PasswordRateLimit, func(c *gin.Context) {
+		type Request struct {
+			Password    string `json:"password"`
+			ReauthToken string `json:"reauthToken"`
+		}
+		var req Request
+		err := c.BindJSON(&req)
+		if err != nil {
+			c.JSON(400, Error(err))
+			return
+		}
+		user := GetUser(c)
+		provider := c.Param("provider")
+		linked := false
+		for _, identity := range user.Identities {
+			linked = linked || identity.Provider == provider
+		}
+		if !linked {
+			c.JSON(404, ErrorStr("no identity of this provider is linked"))
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if !checkPasswordOrReauth(ctx, c, user, req.Password, req.ReauthToken) {
+			return
+		}
+		unlinked, err := UnlinkIdentity(ctx, user.Username, provider)
+		if err != nil {
+			c.JSON(500, Error(err))
+			return
+		}
+		if !unlinked {
+			c.JSON(400, ErrorStr("cannot unlink the only way to sign in, set a password first"))
+			return
+		}
+		c.Status(204)
+	})
+	mounting.Authed.POST("/users/self/password", mounting.PasswordRateLimit, func(c *gin.Context) {
+		type Request struct {
+			ReauthToken string `json:"reauthToken"`
+			NewPassword string `json:"newPassword"`
+		}
+		var req Request
+		err := c.BindJSON(&req)
+		if err != nil {
+			c.JSON(400, Error(err))
+			return
+		}
+		if len(req.NewPassword) < 8 {
+			c.JSON(400, ErrorStr("new password too short(<8)"))
+			return
+		}
+		user := GetUser(c)
+		if user.PasswordHash != "" {
+			c.JSON(400, ErrorStr("the account already has a password, use /users/resetPassword to change it"))
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if !checkPasswordOrReauth(ctx, c, user, "", req.ReauthToken) {
+			return
+		}
+		hash, err := argon2id.CreateHash(req.NewPassword, Argon2idParams)
+		if err != nil {
+			c.JSON(500, Error(err))
+			return
+		}
+		// the password may have been set by another request since the user was loaded
+		res, err := UsersCol.UpdateOne(ctx, bson.M{"_id": user.Username, "passwordHash": bson.M{"$in": bson.A{"", nil}}},
+			bson.M{"$set": bson.M{"passwordHash": hash}})
+		if err != nil {
+			c.JSON(500, Error(err))
+			return
+		}
+		if res.MatchedCount == 0 {
+			c.JSON(400, ErrorStr("the account already has a password, use /users/resetPassword to change it"))
+			return
+		}
+		c.Status(204)
+	})
+}
+
+// checkPasswordOrReauth checks the user's password, or the reauth token from signing in again with a linked identity
+// provider if it's given, the latter being the only option for users without a password.
+// Returns false and responds with an error if neither is valid
+func checkPasswordOrReauth(ctx context.Context, c *gin.Context, user *User, password, reauthToken string) bool {
+	if reauthToken == "" {
+		if user.PasswordHash == "" {
+			c.JSON(401, ErrorStr("the account has no password, reauthenticate with a linked identity provider"))
+			return false
+		}
+		return CheckPassword(c, password, user.PasswordHash)
+	}
+	username, err := States.Take(ctx, "sso:reauth:"+reauthToken)
+	if errors.Is(err, ErrStateNotFound) || (err == nil && username != user.Username) {
+		c.JSON(401, ErrorStr("invalid reauth token"))
+		return false
+	} else if err != nil {
+		c.JSON(500, Error(err))
+		return false
+	}
+	return true
+}
+
+// providerName returns the name of the identity provider shown to users
+func providerName(provider string) string {
+	if provider == "logto" {
+		return "Logto"
+	}
+	for _, config := range Config.Oidc {
+		if config.Id == provider {
+			if config.Name == "" {
+				return config.Id
+			}
+			return config.Name
+		}
+	}
+	return provider
+}
@@ -0,0 +1,40 @@
+package routes
+
+import (
+	"context"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	. "kittygifs/util"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestCheckPasswordOrReauth(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	ctx := context.Background()
+	States = NewMemoryStateStore()
+	user := &User{Username: "kitty"}
+	check := func(password, reauthToken string) (bool, int) {
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		ok := checkPasswordOrReauth(ctx, c, user, password, reauthToken)
+		return ok, w.Code
+	}
+
+	// users without a password have to reauthenticate
+	ok, code := check("", "")
+	assert.False(t, ok)
+	assert.Equal(t, 401, code)
+
+	assert.NoError(t, States.Set(ctx, "sso:reauth:token", "kitty", time.Minute))
+	assert.NoError(t, States.Set(ctx, "sso:reauth:other", "someone else", time.Minute))
+	ok, _ = check("", "other")
+	assert.False(t, ok)
+	ok, _ = check("", "token")
+	assert.True(t, ok)
+	// reauth tokens can only be used once
+	ok, code = check("", "token")
+	assert.False(t, ok)
+	assert.Equal(t, 401, code)
+}
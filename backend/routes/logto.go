@@ -1,24 +1,25 @@
 package routes
 
 import (
-	"context"
 	"crypto/rand"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/gin-contrib/sessions"
-	"github.com/gin-contrib/sessions/memstore"
+	"github.com/gin-contrib/sessions/cookie"
 	"github.com/gin-gonic/gin"
 	"github.com/logto-io/go/client"
 	"github.com/logto-io/go/core"
-	"go.mongodb.org/mongo-driver/bson"
 	. "kittygifs/util"
-	"log"
 	"net/http"
 	"net/url"
 	"strings"
 )
 
+// States stores the state of sign-in flows, set in RunGin
+var States StateStore
+
 func MountLogto(mounting *Mounting) {
 	if Config.Logto == nil {
 		return
@@ -28,13 +29,26 @@ func MountLogto(mounting *Mounting) {
 		AppId:     Config.Logto.AppId,
 		AppSecret: Config.Logto.AppSecret,
 	}
-	store := memstore.NewStore([]byte("your session secret"))
+	// the cookie only holds the flow ID, the flow's state is in States
+	store := cookie.NewStore(Config.DeriveKey("logto cookie authentication"), Config.DeriveKey("logto cookie encryption"))
+	store.Options(sessions.Options{
+		Path:     "/logto",
+		MaxAge:   int(ssoFlowLifetime.Seconds()),
+		Secure:   strings.HasPrefix(Config.ApiUrl, "https://"),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
 	logto := mounting.Normal.Group("/logto", sessions.Sessions("logto-session", store))
-	logtoFirsts := make(map[string]string)
-	sessionTokens := make(map[string]string)
 	logto.GET("/sign-in", func(ctx *gin.Context) {
-		session := sessions.Default(ctx)
-		storage := &SessionStorage{Session: session}
+		if !allowedReturnUri(ctx.Query("return")) {
+			ctx.String(http.StatusBadRequest, "return URI not allowed")
+			return
+		}
+		storage, err := newLogtoFlow(ctx, ctx.Query("reauth") == "true")
+		if err != nil {
+			ctx.String(http.StatusInternalServerError, err.Error())
+			return
+		}
 		logtoClient := client.NewLogtoClient(
 			logtoConfig,
 			storage,
@@ -52,156 +66,24 @@ func MountLogto(mounting *Mounting) {
 		ctx.Redirect(http.StatusTemporaryRedirect, signInUri)
 	})
 	logto.GET("/callback", func(ctx *gin.Context) {
-		state := ctx.Query("state")
-		log.Println("state:", state)
-		state, err := url.QueryUnescape(state)
-		log.Println("state:", state)
+		userInfo, returnUri, err := handleLogtoCallback(ctx, logtoConfig)
 		if err != nil {
-			ctx.JSON(500, Error(err))
+			ctx.String(http.StatusBadRequest, err.Error())
 			return
 		}
-		returnUri := strings.Split(state, "|")[1]
-		log.Println("returnUri:", returnUri)
-
-		session := sessions.Default(ctx)
-		logtoClient := client.NewLogtoClient(
-			logtoConfig,
-			&SessionStorage{Session: session},
-		)
-
-		// The sign-in callback request is handled by Logto
-		err = logtoClient.HandleSignInCallback(ctx.Request)
-		if err != nil {
-			ctx.String(http.StatusInternalServerError, err.Error())
-			return
-		}
-
-		userInfo, err := logtoClient.FetchUserInfo()
-		if err != nil {
-			ctx.String(http.StatusInternalServerError, err.Error())
-			return
-		}
-		res := UsersCol.FindOne(context.TODO(), bson.M{"logtoId": userInfo.Sub})
-		var user User
-		err = res.Decode(&user)
-		if err == nil {
-			// user already exists
-			session, err := createSession(ctx, user.Username)
-			if err != nil {
-				ctx.JSON(500, Error(err))
-				return
-			}
-			token := generateRandomString(24)
-			sessionTokens[token] = session.Token
-			ctx.Redirect(http.StatusTemporaryRedirect, returnUri+"?token="+token)
-			return
-		}
-		if !Config.AllowSignup {
-			ctx.Redirect(http.StatusTemporaryRedirect, returnUri+"?signupDisabled=true")
-			return
-		}
-
-		logtoFirstId := generateRandomString(16)
-		logtoFirsts[logtoFirstId] = userInfo.Sub
-
-		// Jump to the page specified by the developer.
-		// This example takes the user back to the home page.
-		ctx.Redirect(http.StatusTemporaryRedirect, returnUri+"?logtoFirstId="+logtoFirstId)
-	})
-	logto.GET("/sessionToken", func(ctx *gin.Context) {
-		token := ctx.Query("token")
-		sessionToken, ok := sessionTokens[token]
-		if !ok {
-			ctx.JSON(400, ErrorStr("invalid token!"))
-			return
-		}
-		delete(sessionTokens, token)
-		ctx.JSON(200, gin.H{
-			"token": sessionToken,
-		})
+		reauth, _ := sessions.Default(ctx).Get("reauth").(bool)
+		completeSsoSignIn(ctx, Identity{Provider: "logto", Subject: userInfo.Sub}, returnUri, "logtoFirstId", reauth)
 	})
-	logto.POST("/link", mounting.SessionedHandler, mounting.AuthedHandler, func(ctx *gin.Context) {
-		type Request struct {
-			LogtoFirstId string `json:"logtoFirstId"`
-		}
-		var req Request
-		err := ctx.BindJSON(&req)
-		if err != nil {
-			ctx.JSON(400, Error(err))
-			return
-		}
-		logtoUserId, ok := logtoFirsts[req.LogtoFirstId]
-		if !ok {
-			ctx.JSON(400, ErrorStr("invalid logtoFirstId"))
-			return
-		}
-		delete(logtoFirsts, req.LogtoFirstId)
-		user := GetUser(ctx)
-		user.LogtoId = &logtoUserId
-		_, err = UsersCol.ReplaceOne(ctx, bson.M{"_id": user.Username}, user)
-		if err != nil {
-			ctx.JSON(500, Error(err))
-			return
-		}
-		ctx.Status(200)
-	})
-	logto.POST("/registerAccount", func(ctx *gin.Context) {
-		if !Config.AllowSignup {
-			ctx.JSON(403, ErrorStr("signup is disabled by the server admin"))
-			return
-		}
-		type Request struct {
-			LogtoFirstId string `json:"logtoFirstId"`
-			Username     string `json:"username"`
-		}
-		var req Request
-		err := ctx.BindJSON(&req)
-		if err != nil {
-			ctx.JSON(400, Error(err))
-			return
-		}
-		logtoUserId, ok := logtoFirsts[req.LogtoFirstId]
+	mountSsoAccountRoutes(logto, mounting)
+	logto.GET("/sign-out", func(ctx *gin.Context) {
+		storage, ok := currentLogtoFlow(ctx)
 		if !ok {
-			ctx.JSON(400, ErrorStr("invalid logtoFirstId"))
-			return
-		}
-		delete(logtoFirsts, req.LogtoFirstId)
-		err = ValidateUsername(req.Username, ctx)
-		if err != nil {
-			ctx.JSON(400, Error(err))
-			return
-		}
-		// check that there isn't already a user with the same logto user id
-		count, err := UsersCol.CountDocuments(ctx, bson.M{"logtoId": logtoUserId})
-		if err != nil {
-			ctx.JSON(500, Error(err))
-			return
-		}
-		if count > 0 {
-			ctx.JSON(400, ErrorStr("user with the same logto user ID exists!"))
-			return
-		}
-		user := User{
-			Username: req.Username,
-			LogtoId:  &logtoUserId,
-		}
-		_, err = UsersCol.InsertOne(ctx, user)
-		if err != nil {
-			ctx.JSON(500, Error(err))
+			ctx.String(http.StatusBadRequest, "no sign-in session")
 			return
 		}
-		session, err := createSession(ctx, user.Username)
-		if err != nil {
-			ctx.JSON(500, Error(err))
-			return
-		}
-		ctx.JSON(200, session)
-	})
-	logto.GET("/sign-out", func(ctx *gin.Context) {
-		session := sessions.Default(ctx)
 		logtoClient := client.NewLogtoClient(
 			logtoConfig,
-			&SessionStorage{Session: session},
+			storage,
 		)
 
 		// The sign-out request is handled by Logto.
@@ -217,6 +99,59 @@ func MountLogto(mounting *Mounting) {
 	})
 }
 
+// newLogtoFlow starts a new sign-in flow and stores its ID in the cookie, reauth is set for flows confirming
+// the identity of a signed in user
+func newLogtoFlow(ctx *gin.Context, reauth bool) (*StateStorage, error) {
+	session := sessions.Default(ctx)
+	flowId := generateRandomString(24)
+	session.Set("flowId", flowId)
+	session.Set("reauth", reauth)
+	err := session.Save()
+	if err != nil {
+		return nil, err
+	}
+	return &StateStorage{Store: States, FlowId: flowId, TTL: ssoFlowLifetime}, nil
+}
+
+// currentLogtoFlow returns the storage of the sign-in flow in the cookie, or false if there isn't one
+func currentLogtoFlow(ctx *gin.Context) (*StateStorage, bool) {
+	flowId, ok := sessions.Default(ctx).Get("flowId").(string)
+	if !ok {
+		return nil, false
+	}
+	return &StateStorage{Store: States, FlowId: flowId, TTL: ssoFlowLifetime}, true
+}
+
+// handleLogtoCallback finishes the sign-in flow in the cookie, verifying the callback and the ID token,
+// and returns the Logto user and the URI to return the user to
+func handleLogtoCallback(ctx *gin.Context, logtoConfig *client.LogtoConfig) (core.UserInfoResponse, string, error) {
+	storage, ok := currentLogtoFlow(ctx)
+	if !ok {
+		return core.UserInfoResponse{}, "", errors.New("no sign-in session, it may have expired")
+	}
+	_, returnUri, ok := strings.Cut(ctx.Query("state"), "|")
+	if !ok {
+		return core.UserInfoResponse{}, "", errors.New("invalid state")
+	}
+	logtoClient := client.NewLogtoClient(
+		logtoConfig,
+		storage,
+	)
+
+	// The sign-in callback request is handled by Logto, this checks the state against the one in the flow
+	// and clears it so the callback can't be replayed
+	err := logtoClient.HandleSignInCallback(ctx.Request)
+	if err != nil {
+		return core.UserInfoResponse{}, "", err
+	}
+
+	userInfo, err := logtoClient.FetchUserInfo()
+	if err != nil {
+		return core.UserInfoResponse{}, "", err
+	}
+	return userInfo, returnUri, nil
+}
+
 // These two methods are manually taken from the logto Go library because you can't change the state by default
 
 func fetchOidcConfig(logtoConfig *client.LogtoConfig) (core.OidcConfigResponse, error) {
@@ -0,0 +1,180 @@
+package routes
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-contrib/sessions/cookie"
+	"github.com/gin-gonic/gin"
+	"github.com/go-jose/go-jose/v4"
+	"github.com/logto-io/go/client"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	. "kittygifs/util"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// fakeOidcProvider is a minimal OIDC provider that issues a code for any authorization request
+// and checks PKCE when the code is exchanged
+type fakeOidcProvider struct {
+	server        *httptest.Server
+	key           *rsa.PrivateKey
+	clientId      string
+	subject       string
+	codeChallenge string
+	// nonce is included in ID tokens if set
+	nonce string
+}
+
+func newFakeOidcProvider(t *testing.T, clientId, subject string) *fakeOidcProvider {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	provider := &fakeOidcProvider{key: key, clientId: clientId, subject: subject}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/oidc/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 provider.issuer(),
+			"authorization_endpoint": provider.issuer() + "/auth",
+			"token_endpoint":         provider.issuer() + "/token",
+			"userinfo_endpoint":      provider.issuer() + "/me",
+			"jwks_uri":               provider.issuer() + "/jwks",
+			"end_session_endpoint":   provider.issuer() + "/session/end",
+			"revocation_endpoint":    provider.issuer() + "/token/revocation",
+		})
+	})
+	mux.HandleFunc("/oidc/jwks", func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(jose.JSONWebKeySet{Keys: []jose.JSONWebKey{
+			{Key: &key.PublicKey, KeyID: "test", Algorithm: string(jose.RS256), Use: "sig"},
+		}})
+	})
+	mux.HandleFunc("/oidc/token", func(w http.ResponseWriter, r *http.Request) {
+		_ = r.ParseForm()
+		verifier := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+		if r.PostForm.Get("code") != "test-code" ||
+			base64.RawURLEncoding.EncodeToString(verifier[:]) != provider.codeChallenge {
+			w.WriteHeader(400)
+			_, _ = w.Write([]byte(`{"error": "invalid_grant"}`))
+			return
+		}
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			"access_token": "test-access-token",
+			"id_token":     provider.idToken(t),
+			"expires_in":   3600,
+		})
+	})
+	mux.HandleFunc("/oidc/me", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer test-access-token" {
+			w.WriteHeader(401)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(map[string]string{"sub": provider.subject})
+	})
+	provider.server = httptest.NewServer(mux)
+	t.Cleanup(provider.server.Close)
+	return provider
+}
+
+func (provider *fakeOidcProvider) issuer() string {
+	return provider.server.URL + "/oidc"
+}
+
+func (provider *fakeOidcProvider) idToken(t *testing.T) string {
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.RS256, Key: provider.key},
+		(&jose.SignerOptions{}).WithHeader("kid", "test"))
+	require.NoError(t, err)
+	now := time.Now().Unix()
+	claims := map[string]interface{}{
+		"iss": provider.issuer(),
+		"sub": provider.subject,
+		"aud": provider.clientId,
+		"iat": now,
+		"exp": now + 3600,
+	}
+	if provider.nonce != "" {
+		claims["nonce"] = provider.nonce
+	}
+	payload, _ := json.Marshal(claims)
+	jws, err := signer.Sign(payload)
+	require.NoError(t, err)
+	token, err := jws.CompactSerialize()
+	require.NoError(t, err)
+	return token
+}
+
+func TestLogtoSignInFlow(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	provider := newFakeOidcProvider(t, "test-app", "logto-user")
+	Config = &Configuration{
+		Secret: "a secret that is long enough to be used",
+		ApiUrl: "http://api.test",
+		Logto:  &LogtoConfiguration{Endpoint: provider.server.URL, AppId: "test-app", AppSecret: "app-secret"},
+	}
+	States = NewMemoryStateStore()
+	logtoConfig := &client.LogtoConfig{Endpoint: provider.server.URL, AppId: "test-app", AppSecret: "app-secret"}
+
+	// the sign-in route is mounted as is, the callback is split at handleLogtoCallback as the rest needs the database
+	r := gin.New()
+	store := cookie.NewStore(Config.DeriveKey("logto cookie authentication"), Config.DeriveKey("logto cookie encryption"))
+	logto := r.Group("/logto", sessions.Sessions("logto-session", store))
+	logto.GET("/sign-in", func(ctx *gin.Context) {
+		storage, err := newLogtoFlow(ctx, false)
+		require.NoError(t, err)
+		signInUri, err := SignIn(client.NewLogtoClient(logtoConfig, storage), logtoConfig, storage,
+			Config.ApiUrl+"/logto/callback", ctx.Query("return"))
+		require.NoError(t, err)
+		ctx.Redirect(http.StatusTemporaryRedirect, signInUri)
+	})
+	logto.GET("/callback", func(ctx *gin.Context) {
+		userInfo, returnUri, err := handleLogtoCallback(ctx, logtoConfig)
+		if err != nil {
+			ctx.String(400, err.Error())
+			return
+		}
+		ctx.JSON(200, gin.H{"sub": userInfo.Sub, "return": returnUri})
+	})
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "http://api.test/logto/sign-in?return=http://frontend.test/done", nil))
+	require.Equal(t, http.StatusTemporaryRedirect, w.Code)
+	signInUri, err := url.Parse(w.Header().Get("Location"))
+	require.NoError(t, err)
+	assert.Equal(t, provider.issuer()+"/auth", signInUri.Scheme+"://"+signInUri.Host+signInUri.Path)
+	provider.codeChallenge = signInUri.Query().Get("code_challenge")
+	state := signInUri.Query().Get("state")
+	cookies := w.Result().Cookies()
+	require.NotEmpty(t, cookies)
+
+	callback := func(state string, withCookie bool) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/logto/callback?code=test-code&state="+url.QueryEscape(state), nil)
+		req.Host = "api.test"
+		if withCookie {
+			for _, c := range cookies {
+				req.AddCookie(c)
+			}
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	// the state has to match the one of the flow in the cookie
+	assert.Equal(t, 400, callback("wrong|http://evil.test", true).Code)
+	assert.Equal(t, 400, callback(state, false).Code)
+
+	w = callback(state, true)
+	require.Equal(t, 200, w.Code, w.Body.String())
+	var result map[string]string
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &result))
+	assert.Equal(t, "logto-user", result["sub"])
+	assert.Equal(t, "http://frontend.test/done", result["return"])
+
+	// the flow's state is used up
+	assert.Equal(t, 400, callback(state, true).Code)
+}
@@ -0,0 +1,49 @@
+package routes
+
+import (
+	"context"
+	"crypto/subtle"
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	. "kittygifs/util"
+	"kittygifs/util/metrics"
+	"strconv"
+	"time"
+)
+
+var activeSessions = metrics.NewGaugeFunc("kittygifs_active_sessions", "Number of sessions that haven't expired.",
+	func() (float64, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		count, err := SessionsCol.CountDocuments(ctx, bson.M{"expiresAt": bson.M{"$gt": time.Now()}})
+		return float64(count), err
+	})
+
+// metricsMiddleware records the count and duration of requests by their route template,
+// so requests with different IDs in the path are counted together
+func metricsMiddleware(c *gin.Context) {
+	start := time.Now()
+	c.Next()
+	route := c.FullPath()
+	if route == "" {
+		route = "unmatched"
+	}
+	metrics.HttpRequests.Inc(c.Request.Method, route, strconv.Itoa(c.Writer.Status()))
+	metrics.HttpRequestDuration.Observe(time.Since(start).Seconds(), c.Request.Method, route)
+}
+
+func MountMetrics(mounting *Mounting) {
+	if Config.Metrics == nil {
+		return
+	}
+	mounting.Normal.GET("/metrics", func(c *gin.Context) {
+		token := []byte("Bearer " + Config.Metrics.Token)
+		if subtle.ConstantTimeCompare([]byte(c.GetHeader("Authorization")), token) != 1 {
+			c.Status(401)
+			return
+		}
+		c.Header("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		c.Status(200)
+		_ = metrics.DefaultRegistry.Write(c.Writer)
+	})
+}
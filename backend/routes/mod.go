@@ -8,12 +8,20 @@ import (
 	"github.com/ross714/hcaptcha"
 	"go.mongodb.org/mongo-driver/bson"
 	. "kittygifs/util"
+	"kittygifs/util/mail"
+	"kittygifs/util/metrics"
+	"net/http"
+	"strings"
+	"sync/atomic"
 	"time"
 )
 
 var Config *Configuration
 var HCaptchaClient *hcaptcha.Client
 
+// sessionUpdateInterval is how often the last used time of a session is updated
+const sessionUpdateInterval = time.Minute
+
 type Mounting struct {
 	Normal            *gin.RouterGroup
 	Sessioned         *gin.RouterGroup
@@ -23,9 +31,30 @@ type Mounting struct {
 	PasswordRateLimit gin.HandlerFunc
 }
 
-func RunGin(config *Configuration) error {
+// RunGin starts the server with only the health routes, so they can respond while connecting to MongoDB,
+// and serves all routes once initialized is closed
+func RunGin(config *Configuration, initialized <-chan struct{}) error {
+	var router atomic.Pointer[gin.Engine]
+	startup := gin.Default()
+	MountHealth(&Mounting{Normal: startup.Group("/")})
+	router.Store(startup)
+	go func() {
+		<-initialized
+		router.Store(newRouter(config))
+		started.Store(true)
+	}()
+	return http.ListenAndServe(config.Address, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		router.Load().ServeHTTP(w, req)
+	}))
+}
+
+// newRouter sets up the router with all routes mounted
+func newRouter(config *Configuration) *gin.Engine {
 	Config = config
+	Mailer = mail.New(config)
+	States = &MongoStateStore{Col: StatesCol, HashKey: config.HashToken}
 	r := gin.Default()
+	r.Use(metricsMiddleware)
 	r.Use(func(c *gin.Context) {
 		if config.AccessControlAllowOrigin != nil {
 			acao := config.AccessControlAllowOrigin
@@ -44,7 +73,7 @@ func RunGin(config *Configuration) error {
 				}
 			}
 		}
-		c.Header("Access-Control-Allow-Headers", "Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, x-session-token, accept, origin, Cache-Control, X-Requested-With")
+		c.Header("Access-Control-Allow-Headers", "Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, x-session-token, Authorization, accept, origin, Cache-Control, X-Requested-With")
 		c.Header("Access-Control-Allow-Methods", "POST, OPTIONS, GET, PUT, PATCH, DELETE")
 		c.Header("Access-Control-Max-Age", "86400")
 		if c.Request.Method == "OPTIONS" {
@@ -53,7 +82,8 @@ func RunGin(config *Configuration) error {
 		}
 		c.Next()
 	})
-	r.Use(gzip.Gzip(gzip.DefaultCompression))
+	// streams are flushed as events happen, which compression would hold back
+	r.Use(gzip.Gzip(gzip.DefaultCompression, gzip.WithExcludedPaths([]string{"/notifications/stream"})))
 	store := ratelimit.InMemoryStore(&ratelimit.InMemoryOptions{
 		Limit: 16,
 		Rate:  time.Minute,
@@ -62,6 +92,7 @@ func RunGin(config *Configuration) error {
 	// plus it's not like you need to send a lot of requests to these routes
 	passwordRL := ratelimit.RateLimiter(store, &ratelimit.Options{
 		ErrorHandler: func(c *gin.Context, info ratelimit.Info) {
+			metrics.RateLimitRejections.Inc(c.FullPath())
 			c.Status(429)
 		},
 		KeyFunc: func(c *gin.Context) string {
@@ -71,24 +102,65 @@ func RunGin(config *Configuration) error {
 	sessionedHandler := func(c *gin.Context) {
 		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 		defer cancel()
-		sessionToken := c.GetHeader("x-session-token")
-		if sessionToken == "" {
+		token := c.GetHeader("x-session-token")
+		if authorization := c.GetHeader("Authorization"); token == "" && strings.HasPrefix(authorization, "Bearer ") {
+			token = authorization[len("Bearer "):]
+		}
+		if token == "" {
 			c.Next()
 			return
 		}
-		var session UserSession
-		err := SessionsCol.FindOne(ctx, bson.M{"_id": sessionToken}).Decode(&session)
+		var username string
+		if strings.HasPrefix(token, ApiTokenPrefix) {
+			apiToken, err := authenticateApiToken(ctx, c, token)
+			if err != nil {
+				c.JSON(500, Error(err))
+				c.Abort()
+				return
+			}
+			if apiToken == nil {
+				c.Next()
+				return
+			}
+			if !checkApiTokenScope(c, apiToken) {
+				return
+			}
+			c.Set("apiToken", apiToken)
+			username = apiToken.Username
+		} else {
+			session, err := authenticateSession(ctx, c, token)
+			if err != nil {
+				c.JSON(500, Error(err))
+				c.Abort()
+				return
+			}
+			if session == nil {
+				c.Next()
+				return
+			}
+			c.Set("sessionToken", token)
+			username = session.Username
+		}
+		var user User
+		err := UsersCol.FindOne(ctx, bson.M{"_id": username}).Decode(&user)
 		if err != nil {
 			c.Next()
 			return
 		}
-		var user User
-		err = UsersCol.FindOne(ctx, bson.M{"_id": session.Username}).Decode(&user)
+		// must be done before loading permissions, so suspended groups don't grant any
+		err = user.SuspendTotpGroups(ctx)
 		if err != nil {
-			c.Next()
+			c.JSON(500, Error(err))
+			c.Abort()
 			return
 		}
-		c.Set("username", session.Username)
+		err = user.LoadPermissions(ctx)
+		if err != nil {
+			c.JSON(500, Error(err))
+			c.Abort()
+			return
+		}
+		c.Set("username", username)
 		c.Set("user", &user)
 		c.Next()
 	}
@@ -112,13 +184,30 @@ func RunGin(config *Configuration) error {
 	}
 	MountGifs(mounting)
 	MountUsers(mounting)
+	MountTotp(mounting)
+	MountEmail(mounting)
 	MountNotifications(mounting)
 	MountSync(mounting)
 	MountTags(mounting)
 	MountLogto(mounting)
+	MountOidc(mounting)
+	MountIdentities(mounting)
+	MountSignupInvites(mounting)
+	MountGdpr(mounting)
+	MountAdmin(mounting)
+	MountGroups(mounting)
+	MountRoles(mounting)
+	MountApiTokens(mounting)
+	MountWebhooks(mounting)
+	MountSubscriptions(mounting)
+	MountSearches(mounting)
+	MountMetrics(mounting)
+	MountHealth(mounting)
 
 	info := gin.H{
-		"allowSignup": config.AllowSignup,
+		"allowSignup":      config.AllowSignup,
+		"inviteOnlySignup": config.AllowSignup && config.InviteOnlySignup,
+		"email":            Mailer != nil,
 	}
 	if config.Captcha != nil {
 		HCaptchaClient = hcaptcha.New(config.Captcha.SecretKey, config.Captcha.SiteKey)
@@ -131,9 +220,29 @@ func RunGin(config *Configuration) error {
 			"allowLegacySignup": config.Logto.AllowLegacySignup,
 		}
 	}
+	if len(config.Oidc) != 0 {
+		providers := make([]gin.H, len(config.Oidc))
+		for i, provider := range config.Oidc {
+			providers[i] = gin.H{"id": provider.Id, "name": provider.Name}
+		}
+		info["oidc"] = providers
+	}
 	mounting.Normal.GET("/", func(c *gin.Context) {
 		c.JSON(200, info)
 	})
 
-	return r.Run(config.Address)
+	return r
+}
+
+// requirePermission returns a handler that responds with 403 if the authenticated user doesn't have the permission,
+// must be used after the authed handler
+func requirePermission(permission string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !GetUser(c).HasPermission(permission) {
+			c.JSON(403, ErrorStr("you do not have the "+permission+" permission"))
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
 }
@@ -0,0 +1,36 @@
+package routes
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	. "kittygifs/util"
+	"testing"
+)
+
+func TestNewRouterMountsRoutes(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r := newRouter(&Configuration{})
+	routes := make(map[string]bool)
+	for _, route := range r.Routes() {
+		routes[route.Method+" "+route.Path] = true
+	}
+	assert.True(t, routes["GET /users/self/gdprRequests"])
+	assert.True(t, routes["DELETE /users/self/gdprRequests/:id"])
+	assert.True(t, routes["GET /admin/gdprRequests"])
+	assert.True(t, routes["POST /users/sessions/totp"])
+	assert.True(t, routes["POST /users/self/totp/confirm"])
+	assert.True(t, routes["PUT /users/self/email"])
+	assert.True(t, routes["POST /users/forgotPassword"])
+}
+
+func TestRouteScopesAreMounted(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r := newRouter(&Configuration{})
+	routes := make(map[string]bool)
+	for _, route := range r.Routes() {
+		routes[route.Method+" "+route.Path] = true
+	}
+	for route := range routeScopes {
+		assert.True(t, routes[route], route)
+	}
+}
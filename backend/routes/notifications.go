@@ -2,19 +2,65 @@ package routes
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
 	"github.com/gin-gonic/gin"
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
 	. "kittygifs/util"
 	notifications "kittygifs/util/notifications"
 	"slices"
+	"strconv"
 	"time"
 )
 
+// streamHeartbeatInterval is how often a comment is sent on idle streams so proxies don't close them
+const streamHeartbeatInterval = 30 * time.Second
+
 func MountNotifications(mounting *Mounting) {
 	mounting.Authed.GET("/notifications", func(c *gin.Context) {
+		type Request struct {
+			Types  []string `form:"type"`
+			Unread bool     `form:"unread"`
+			Before string   `form:"before"`
+			Max    string   `form:"max"`
+		}
+		var req Request
+		err := c.ShouldBindQuery(&req)
+		if err != nil {
+			c.JSON(400, Error(err))
+			return
+		}
+		filter := bson.M{"username": GetUser(c).Username}
+		if len(req.Types) != 0 {
+			for _, notificationType := range req.Types {
+				if !slices.Contains(notifications.NotificationTypes, notificationType) {
+					c.JSON(400, ErrorStr("invalid type"))
+					return
+				}
+			}
+			filter["data.type"] = bson.M{"$in": req.Types}
+		}
+		if req.Unread {
+			filter["readAt"] = bson.M{"$exists": false}
+		}
+		if req.Before != "" {
+			filter["_id"] = bson.M{"$lt": req.Before}
+		}
+		var maxNum int64 = 100
+		if req.Max != "" {
+			maxNum, err = strconv.ParseInt(req.Max, 10, 64)
+			if err != nil || maxNum < 1 || maxNum > 500 {
+				c.JSON(400, ErrorStr("invalid max"))
+				return
+			}
+		}
 		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 		defer cancel()
-		cur, err := NotificationsCol.Find(ctx, bson.M{"username": GetUser(c).Username})
+		cur, err := NotificationsCol.Find(ctx, filter, &options.FindOptions{
+			Limit: &maxNum,
+			Sort:  bson.M{"_id": -1},
+		})
 		if err != nil {
 			c.JSON(500, Error(err))
 			return
@@ -33,12 +79,97 @@ func MountNotifications(mounting *Mounting) {
 	mounting.Authed.GET("/notifications/count", func(c *gin.Context) {
 		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 		defer cancel()
-		count, err := NotificationsCol.CountDocuments(ctx, bson.M{"username": GetUser(c).Username})
+		cur, err := NotificationsCol.Aggregate(ctx, bson.A{
+			bson.M{"$match": bson.M{"username": GetUser(c).Username}},
+			bson.M{"$group": bson.M{
+				"_id":    "$data.type",
+				"count":  bson.M{"$sum": 1},
+				"unread": bson.M{"$sum": bson.M{"$cond": bson.A{bson.M{"$gt": bson.A{"$readAt", nil}}, 0, 1}}},
+			}},
+		})
 		if err != nil {
 			c.JSON(500, Error(err))
 			return
 		}
-		c.JSON(200, gin.H{"count": count})
+		var counts []struct {
+			Type   string `bson:"_id"`
+			Count  int64  `bson:"count"`
+			Unread int64  `bson:"unread"`
+		}
+		err = cur.All(ctx, &counts)
+		if err != nil {
+			c.JSON(500, Error(err))
+			return
+		}
+		var count, unread int64
+		unreadByType := map[string]int64{}
+		for _, typeCount := range counts {
+			count += typeCount.Count
+			unread += typeCount.Unread
+			if typeCount.Unread != 0 {
+				unreadByType[typeCount.Type] = typeCount.Unread
+			}
+		}
+		c.JSON(200, gin.H{
+			"count":        count,
+			"unread":       unread,
+			"unreadByType": unreadByType,
+		})
+	})
+	// any notification can be marked as read, including ones that can't be deleted
+	mounting.Authed.POST("/notifications/:id/read", func(c *gin.Context) {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		count, err := NotificationsCol.CountDocuments(ctx, bson.M{"_id": c.Param("id"), "username": GetUser(c).Username})
+		if err != nil {
+			c.JSON(500, Error(err))
+			return
+		}
+		if count == 0 {
+			c.JSON(404, ErrorStr("notification not found"))
+			return
+		}
+		_, err = notifications.MarkRead(ctx, GetUser(c).Username, bson.M{"_id": c.Param("id")})
+		if err != nil {
+			c.JSON(500, Error(err))
+			return
+		}
+		c.Status(204)
+	})
+	mounting.Authed.POST("/notifications/read", func(c *gin.Context) {
+		type Request struct {
+			// Types limits which notifications are marked as read
+			Types []string `json:"types"`
+			// Before only marks notifications older than the ID as read, e.g. the newest one the user has seen
+			Before string `json:"before"`
+		}
+		var req Request
+		err := c.BindJSON(&req)
+		if err != nil {
+			c.JSON(400, Error(err))
+			return
+		}
+		filter := bson.M{}
+		if len(req.Types) != 0 {
+			for _, notificationType := range req.Types {
+				if !slices.Contains(notifications.NotificationTypes, notificationType) {
+					c.JSON(400, ErrorStr("invalid type"))
+					return
+				}
+			}
+			filter["data.type"] = bson.M{"$in": req.Types}
+		}
+		if req.Before != "" {
+			filter["_id"] = bson.M{"$lte": req.Before}
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		ids, err := notifications.MarkRead(ctx, GetUser(c).Username, filter)
+		if err != nil {
+			c.JSON(500, Error(err))
+			return
+		}
+		c.JSON(200, gin.H{"count": len(ids)})
 	})
 	mounting.Authed.DELETE("/notifications/:id", func(c *gin.Context) {
 		ctx, cancel := context.WithTimeout(context.Background(), 12*time.Second)
@@ -60,13 +191,56 @@ func MountNotifications(mounting *Mounting) {
 		} else {
 			filter = bson.M{"_id": notification.Id}
 		}
-		_, err = NotificationsCol.DeleteMany(ctx, filter)
+		err = notifications.DeleteNotifications(ctx, filter)
 		if err != nil {
 			c.JSON(500, Error(err))
 			return
 		}
 		c.Status(204)
 	})
+	mounting.Authed.GET("/notifications/stream", streamNotifications)
+	mounting.Authed.GET("/notifications/preferences", func(c *gin.Context) {
+		user := GetUser(c)
+		preferences := NotificationPreferences{Channels: map[string][]string{}}
+		if user.NotificationPreferences != nil {
+			preferences.WebhookUrl = user.NotificationPreferences.WebhookUrl
+		}
+		for _, notificationType := range notifications.NotificationTypes {
+			preferences.Channels[notificationType] = notifications.ChannelsFor(user, notificationType)
+		}
+		c.JSON(200, preferences)
+	})
+	mounting.Authed.PUT("/notifications/preferences", func(c *gin.Context) {
+		var req NotificationPreferences
+		err := c.BindJSON(&req)
+		if err != nil {
+			c.JSON(400, Error(err))
+			return
+		}
+		if req.Channels == nil {
+			req.Channels = map[string][]string{}
+		}
+		err = notifications.ValidatePreferences(req)
+		if err != nil {
+			c.JSON(400, Error(err))
+			return
+		}
+		for _, channels := range req.Channels {
+			if slices.Contains(channels, notifications.ChannelEmail) && Mailer == nil {
+				c.JSON(400, ErrorStr("email is not configured on this instance"))
+				return
+			}
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		_, err = UsersCol.UpdateOne(ctx, bson.M{"_id": GetUser(c).Username},
+			bson.M{"$set": bson.M{"notificationPreferences": req}})
+		if err != nil {
+			c.JSON(500, Error(err))
+			return
+		}
+		c.JSON(200, req)
+	})
 	mounting.Authed.GET("/notifications/byEventId/:eventId", func(c *gin.Context) {
 		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 		defer cancel()
@@ -79,3 +253,76 @@ func MountNotifications(mounting *Mounting) {
 		c.JSON(200, notif)
 	})
 }
+
+// streamNotifications streams the user's notification events as Server-Sent Events,
+// resuming after the Last-Event-ID header if present
+func streamNotifications(c *gin.Context) {
+	username := GetUser(c).Username
+	// subscribe before getting missed events so none are lost in between
+	events, unsubscribe := notifications.DefaultHub.Subscribe(username)
+	defer unsubscribe()
+	var missed []notifications.Event
+	sent := make(map[string]bool)
+	reset := false
+	if lastEventId := c.GetHeader("Last-Event-ID"); lastEventId != "" {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		var err error
+		missed, err = notifications.EventsAfter(ctx, username, lastEventId)
+		cancel()
+		if err != nil {
+			c.JSON(500, Error(err))
+			return
+		}
+		// events older than the retention may have been missed too
+		reset = lastEventId < MinUlid(time.Now().Add(-notifications.EventRetention)) || len(missed) == 1000
+	}
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(200)
+	if reset {
+		// the client should get all notifications again
+		_, _ = fmt.Fprint(c.Writer, "event: reset\ndata: {}\n\n")
+	}
+	for _, event := range missed {
+		sent[event.Id] = true
+		if writeEvent(c, event) != nil {
+			return
+		}
+	}
+	c.Writer.Flush()
+	heartbeat := time.NewTicker(streamHeartbeatInterval)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-c.Request.Context().Done():
+			return
+		case event, ok := <-events:
+			if !ok {
+				// the stream fell behind, the client reconnects and resumes
+				return
+			}
+			if sent[event.Id] {
+				continue
+			}
+			if writeEvent(c, event) != nil {
+				return
+			}
+		case <-heartbeat.C:
+			_, err := fmt.Fprint(c.Writer, ": heartbeat\n\n")
+			if err != nil {
+				return
+			}
+		}
+		c.Writer.Flush()
+	}
+}
+
+func writeEvent(c *gin.Context, event notifications.Event) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(c.Writer, "id: %s\nevent: %s\ndata: %s\n\n", event.Id, event.Type, data)
+	return err
+}
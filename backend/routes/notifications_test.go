@@ -0,0 +1,50 @@
+package routes
+
+import (
+	"bufio"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	. "kittygifs/util"
+	"kittygifs/util/notifications"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestStreamNotifications(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/notifications/stream", func(c *gin.Context) {
+		c.Set("user", &User{Username: "kitty"})
+	}, streamNotifications)
+	server := httptest.NewServer(r)
+	defer server.Close()
+
+	res, err := http.Get(server.URL + "/notifications/stream")
+	require.NoError(t, err)
+	defer res.Body.Close()
+	assert.Equal(t, "text/event-stream", res.Header.Get("Content-Type"))
+
+	// the headers are sent once the stream is subscribed
+	notifications.DefaultHub.Deliver(notifications.Event{Id: "other", Username: "someone", Type: notifications.EventCreated})
+	notifications.DefaultHub.Deliver(notifications.Event{
+		Id:              "01J00000000000000000000000",
+		Username:        "kitty",
+		Type:            notifications.EventDeleted,
+		NotificationIds: []string{"01HZZZZZZZZZZZZZZZZZZZZZZZ"},
+	})
+	reader := bufio.NewReader(res.Body)
+	var lines []string
+	for len(lines) < 3 {
+		line, err := reader.ReadString('\n')
+		require.NoError(t, err)
+		lines = append(lines, strings.TrimSuffix(line, "\n"))
+	}
+	assert.Equal(t, []string{
+		"id: 01J00000000000000000000000",
+		"event: deleted",
+		`data: {"id":"01J00000000000000000000000","type":"deleted","notificationIds":["01HZZZZZZZZZZZZZZZZZZZZZZZ"]}`,
+	}, lines)
+}
@@ -0,0 +1,410 @@
+package routes
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	. "kittygifs/util"
+	"kittygifs/util/oidc"
+	"kittygifs/util/webhooks"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	// ssoFlowLifetime is how long a sign-in flow can take
+	ssoFlowLifetime = time.Hour
+	// ssoFirstLifetime is how long a new user of an identity provider has to link or register an account
+	ssoFirstLifetime = 30 * time.Minute
+	// ssoLoginTokenLifetime is how long the frontend has to exchange the login token for a session token
+	ssoLoginTokenLifetime = 5 * time.Minute
+	// reauthTokenLifetime is how long a re-authentication with an identity provider can be used instead of a password
+	reauthTokenLifetime = 5 * time.Minute
+	// oidcStateCookie holds the state of the current sign-in flow, so a callback can't be completed in another browser
+	oidcStateCookie = "oidc-state"
+)
+
+// OidcProviders are the configured OIDC providers by ID, set in MountOidc
+var OidcProviders = map[string]*oidc.Provider{}
+
+// oidcFlow is the state of an OIDC sign-in flow, stored in States under its state parameter
+type oidcFlow struct {
+	Provider     string `json:"provider"`
+	Nonce        string `json:"nonce"`
+	CodeVerifier string `json:"codeVerifier"`
+	ReturnUri    string `json:"returnUri"`
+	// Reauth is set for flows confirming the identity of a signed in user
+	Reauth bool `json:"reauth"`
+}
+
+func MountOidc(mounting *Mounting) {
+	for i := range Config.Oidc {
+		OidcProviders[Config.Oidc[i].Id] = oidc.NewProvider(&Config.Oidc[i])
+	}
+	if len(OidcProviders) == 0 {
+		return
+	}
+	group := mounting.Normal.Group("/oidc")
+	group.GET("/:provider/sign-in", func(ctx *gin.Context) {
+		signInUri, err := startOidcFlow(ctx, ctx.Param("provider"), ctx.Query("return"), ctx.Query("reauth") == "true")
+		if err != nil {
+			ctx.String(http.StatusBadRequest, err.Error())
+			return
+		}
+		ctx.Redirect(http.StatusTemporaryRedirect, signInUri)
+	})
+	group.GET("/:provider/callback", func(ctx *gin.Context) {
+		identity, flow, err := handleOidcCallback(ctx)
+		if err != nil {
+			ctx.String(http.StatusBadRequest, err.Error())
+			return
+		}
+		completeSsoSignIn(ctx, identity, flow.ReturnUri, "firstId", flow.Reauth)
+	})
+	mountSsoAccountRoutes(group, mounting)
+}
+
+// startOidcFlow stores a new sign-in flow for the provider and returns the URI to redirect the user to
+func startOidcFlow(ctx *gin.Context, providerId, returnUri string, reauth bool) (string, error) {
+	provider, ok := OidcProviders[providerId]
+	if !ok {
+		return "", errors.New("unknown provider")
+	}
+	if !allowedReturnUri(returnUri) {
+		return "", errors.New("return URI not allowed")
+	}
+	state := generateRandomString(24)
+	flow := oidcFlow{
+		Provider:     providerId,
+		Nonce:        generateRandomString(24),
+		CodeVerifier: oidc.GenerateCodeVerifier(),
+		ReturnUri:    returnUri,
+		Reauth:       reauth,
+	}
+	signInUri, err := provider.AuthCodeUrl(ctx, oidcRedirectUri(providerId), state, flow.Nonce, flow.CodeVerifier)
+	if err != nil {
+		return "", err
+	}
+	value, err := json.Marshal(flow)
+	if err != nil {
+		return "", err
+	}
+	err = States.Set(ctx, "oidc:flow:"+state, string(value), ssoFlowLifetime)
+	if err != nil {
+		return "", err
+	}
+	http.SetCookie(ctx.Writer, &http.Cookie{
+		Name:     oidcStateCookie,
+		Value:    state,
+		Path:     "/oidc",
+		MaxAge:   int(ssoFlowLifetime.Seconds()),
+		Secure:   strings.HasPrefix(Config.ApiUrl, "https://"),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return signInUri, nil
+}
+
+// handleOidcCallback finishes the sign-in flow of the callback, verifying that it was started in this browser
+// and the ID token, and returns the identity and the flow
+func handleOidcCallback(ctx *gin.Context) (Identity, *oidcFlow, error) {
+	if errorCode := ctx.Query("error"); errorCode != "" {
+		return Identity{}, nil, errors.New("sign-in failed: " + errorCode + " " + ctx.Query("error_description"))
+	}
+	state := ctx.Query("state")
+	cookie, err := ctx.Cookie(oidcStateCookie)
+	if err != nil || cookie != state {
+		return Identity{}, nil, errors.New("no sign-in session, it may have expired")
+	}
+	// the flow is used up so the callback can't be replayed
+	value, err := States.Take(ctx, "oidc:flow:"+state)
+	if errors.Is(err, ErrStateNotFound) {
+		return Identity{}, nil, errors.New("no sign-in session, it may have expired")
+	} else if err != nil {
+		return Identity{}, nil, err
+	}
+	http.SetCookie(ctx.Writer, &http.Cookie{Name: oidcStateCookie, Path: "/oidc", MaxAge: -1, HttpOnly: true})
+	var flow oidcFlow
+	err = json.Unmarshal([]byte(value), &flow)
+	if err != nil {
+		return Identity{}, nil, err
+	}
+	provider, ok := OidcProviders[flow.Provider]
+	if !ok || flow.Provider != ctx.Param("provider") {
+		return Identity{}, nil, errors.New("unknown provider")
+	}
+	tokens, err := provider.Exchange(ctx, ctx.Query("code"), oidcRedirectUri(flow.Provider), flow.CodeVerifier)
+	if err != nil {
+		return Identity{}, nil, err
+	}
+	claims, err := provider.VerifyIdToken(ctx, tokens.IdToken, flow.Nonce)
+	if err != nil {
+		return Identity{}, nil, err
+	}
+	return Identity{Provider: flow.Provider, Subject: claims.Subject}, &flow, nil
+}
+
+func oidcRedirectUri(providerId string) string {
+	return Config.ApiUrl + "/oidc/" + url.PathEscape(providerId) + "/callback"
+}
+
+// allowedReturnUri returns true if the origin of the URI is the frontend's or one of the allowed origins,
+// the user is sent back to it with a login or reauth token, so it must not be a site of someone else
+func allowedReturnUri(returnUri string) bool {
+	parsed, err := url.Parse(returnUri)
+	if err != nil || parsed.Scheme == "" || parsed.Host == "" {
+		return false
+	}
+	origin := strings.ToLower(parsed.Scheme + "://" + parsed.Host)
+	allowed := []string{Config.FrontendUrl}
+	if Config.AccessControlAllowOrigin != nil {
+		allowed = append(allowed, *Config.AccessControlAllowOrigin...)
+	}
+	for _, allowedUri := range allowed {
+		// "*" allows all origins to use the API, not to receive tokens
+		if allowedUri == "" || allowedUri == "*" {
+			continue
+		}
+		allowedParsed, err := url.Parse(allowedUri)
+		if err != nil {
+			continue
+		}
+		if origin == strings.ToLower(allowedParsed.Scheme+"://"+allowedParsed.Host) {
+			return true
+		}
+	}
+	return false
+}
+
+// completeSsoSignIn redirects the user back to the frontend, with a login token if the identity is linked to a user
+// or with an ID under firstIdParam that can be used to link or register an account.
+// If reauth is set, it's with a reauth token instead, which can be used in place of the user's password
+func completeSsoSignIn(ctx *gin.Context, identity Identity, returnUri string, firstIdParam string, reauth bool) {
+	// checked again in case the flow was started before return URIs were checked
+	if !allowedReturnUri(returnUri) {
+		ctx.String(http.StatusBadRequest, "return URI not allowed")
+		return
+	}
+	var user User
+	err := UsersCol.FindOne(ctx, identityFilter(identity)).Decode(&user)
+	if err == nil && reauth {
+		token := generateRandomString(24)
+		err = States.Set(ctx, "sso:reauth:"+token, user.Username, reauthTokenLifetime)
+		if err != nil {
+			ctx.JSON(500, Error(err))
+			return
+		}
+		redirectWithParam(ctx, returnUri, "reauthToken", token)
+		return
+	} else if err == nil {
+		// the session is created when the token is exchanged
+		token := generateRandomString(24)
+		err = States.Set(ctx, "sso:login:"+token, user.Username, ssoLoginTokenLifetime)
+		if err != nil {
+			ctx.JSON(500, Error(err))
+			return
+		}
+		redirectWithParam(ctx, returnUri, "token", token)
+		return
+	} else if !errors.Is(err, mongo.ErrNoDocuments) {
+		ctx.JSON(500, Error(err))
+		return
+	}
+	if reauth {
+		ctx.String(http.StatusBadRequest, "the identity isn't linked to an account")
+		return
+	}
+	if !Config.AllowSignup {
+		redirectWithParam(ctx, returnUri, "signupDisabled", "true")
+		return
+	}
+	value, err := json.Marshal(identity)
+	if err != nil {
+		ctx.JSON(500, Error(err))
+		return
+	}
+	firstId := generateRandomString(16)
+	err = States.Set(ctx, "sso:first:"+firstId, string(value), ssoFirstLifetime)
+	if err != nil {
+		ctx.JSON(500, Error(err))
+		return
+	}
+	redirectWithParam(ctx, returnUri, firstIdParam, firstId)
+}
+
+// redirectWithParam redirects to the URI with the query parameter set, keeping its other parameters
+func redirectWithParam(ctx *gin.Context, uri string, key string, value string) {
+	parsed, err := url.Parse(uri)
+	if err != nil {
+		ctx.String(http.StatusBadRequest, "invalid return URI")
+		return
+	}
+	query := parsed.Query()
+	query.Set(key, value)
+	parsed.RawQuery = query.Encode()
+	ctx.Redirect(http.StatusTemporaryRedirect, parsed.String())
+}
+
+// identityFilter matches the user with the identity
+func identityFilter(identity Identity) bson.M {
+	return bson.M{"identities": bson.M{"$elemMatch": bson.M{"provider": identity.Provider, "subject": identity.Subject}}}
+}
+
+// getFirstIdentity gets the identity of a first sign-in, take uses it up
+func getFirstIdentity(ctx *gin.Context, firstId string, take bool) (*Identity, error) {
+	var value string
+	var err error
+	if take {
+		value, err = States.Take(ctx, "sso:first:"+firstId)
+	} else {
+		value, err = States.Get(ctx, "sso:first:"+firstId)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var identity Identity
+	err = json.Unmarshal([]byte(value), &identity)
+	return &identity, err
+}
+
+// mountSsoAccountRoutes mounts the routes for finishing a sign-in with an identity provider on the group
+func mountSsoAccountRoutes(group *gin.RouterGroup, mounting *Mounting) {
+	// logtoFirstId is accepted for the routes under /logto
+	type FirstIdRequest struct {
+		FirstId      string `json:"firstId"`
+		LogtoFirstId string `json:"logtoFirstId"`
+	}
+	firstIdOf := func(req FirstIdRequest) string {
+		if req.FirstId != "" {
+			return req.FirstId
+		}
+		return req.LogtoFirstId
+	}
+	group.GET("/sessionToken", func(ctx *gin.Context) {
+		username, err := States.Take(ctx, "sso:login:"+ctx.Query("token"))
+		if errors.Is(err, ErrStateNotFound) {
+			ctx.JSON(400, ErrorStr("invalid token!"))
+			return
+		} else if err != nil {
+			ctx.JSON(500, Error(err))
+			return
+		}
+		session, err := createSession(ctx, ctx, username)
+		if err != nil {
+			ctx.JSON(500, Error(err))
+			return
+		}
+		ctx.JSON(200, gin.H{
+			"token": session.Token,
+		})
+	})
+	group.POST("/link", mounting.SessionedHandler, mounting.AuthedHandler, func(ctx *gin.Context) {
+		var req FirstIdRequest
+		err := ctx.BindJSON(&req)
+		if err != nil {
+			ctx.JSON(400, Error(err))
+			return
+		}
+		identity, err := getFirstIdentity(ctx, firstIdOf(req), true)
+		if errors.Is(err, ErrStateNotFound) {
+			ctx.JSON(400, ErrorStr("invalid firstId"))
+			return
+		} else if err != nil {
+			ctx.JSON(500, Error(err))
+			return
+		}
+		user := GetUser(ctx)
+		res, err := UsersCol.UpdateOne(ctx,
+			bson.M{"_id": user.Username, "identities.provider": bson.M{"$ne": identity.Provider}},
+			bson.M{"$push": bson.M{"identities": identity}})
+		if mongo.IsDuplicateKeyError(err) {
+			ctx.JSON(400, ErrorStr("the identity is already linked to another user"))
+			return
+		} else if err != nil {
+			ctx.JSON(500, Error(err))
+			return
+		}
+		if res.MatchedCount == 0 {
+			ctx.JSON(400, ErrorStr("an identity of this provider is already linked"))
+			return
+		}
+		ctx.Status(200)
+	})
+	group.POST("/registerAccount", func(ctx *gin.Context) {
+		if !Config.AllowSignup {
+			ctx.JSON(403, ErrorStr("signup is disabled by the server admin"))
+			return
+		}
+		type Request struct {
+			FirstIdRequest
+			Username   string `json:"username"`
+			InviteCode string `json:"inviteCode"`
+		}
+		var req Request
+		err := ctx.BindJSON(&req)
+		if err != nil {
+			ctx.JSON(400, Error(err))
+			return
+		}
+		// the ID is only used up once the account is created, so the user can retry with another username
+		identity, err := getFirstIdentity(ctx, firstIdOf(req.FirstIdRequest), false)
+		if errors.Is(err, ErrStateNotFound) {
+			ctx.JSON(400, ErrorStr("invalid firstId"))
+			return
+		} else if err != nil {
+			ctx.JSON(500, Error(err))
+			return
+		}
+		err = ValidateUsername(req.Username, ctx)
+		if err != nil {
+			ctx.JSON(400, Error(err))
+			return
+		}
+		count, err := UsersCol.CountDocuments(ctx, identityFilter(*identity))
+		if err != nil {
+			ctx.JSON(500, Error(err))
+			return
+		}
+		if count > 0 {
+			ctx.JSON(400, ErrorStr("user with the same identity exists!"))
+			return
+		}
+		groups, ok := claimSignupInvite(ctx, ctx, req.InviteCode, req.Username)
+		if !ok {
+			return
+		}
+		_, err = getFirstIdentity(ctx, firstIdOf(req.FirstIdRequest), true)
+		if err != nil {
+			releaseSignupInvite(ctx, req.InviteCode, req.Username)
+		}
+		if errors.Is(err, ErrStateNotFound) {
+			ctx.JSON(400, ErrorStr("invalid firstId"))
+			return
+		} else if err != nil {
+			ctx.JSON(500, Error(err))
+			return
+		}
+		user := User{
+			Username:   req.Username,
+			Identities: []Identity{*identity},
+			Groups:     signupGroups(groups),
+		}
+		_, err = UsersCol.InsertOne(ctx, user)
+		if err != nil {
+			releaseSignupInvite(ctx, req.InviteCode, req.Username)
+			ctx.JSON(500, Error(err))
+			return
+		}
+		go webhooks.MustPublish(user.Username, webhooks.UserSignup, user.Username, gin.H{"username": user.Username})
+		session, err := createSession(ctx, ctx, user.Username)
+		if err != nil {
+			ctx.JSON(500, Error(err))
+			return
+		}
+		ctx.JSON(200, session)
+	})
+}
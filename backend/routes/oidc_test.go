@@ -0,0 +1,132 @@
+package routes
+
+import (
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	. "kittygifs/util"
+	"kittygifs/util/oidc"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestOidcSignInFlow(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	provider := newFakeOidcProvider(t, "test-client", "oidc-user")
+	Config = &Configuration{
+		Secret:      "a secret that is long enough to be used",
+		ApiUrl:      "http://api.test",
+		FrontendUrl: "http://frontend.test",
+		Oidc: []OidcProviderConfiguration{
+			{Id: "test", Issuer: provider.issuer(), ClientId: "test-client", ClientSecret: "client-secret"},
+		},
+	}
+	require.NoError(t, Config.ValidateOidc())
+	States = NewMemoryStateStore()
+	OidcProviders = map[string]*oidc.Provider{"test": oidc.NewProvider(&Config.Oidc[0])}
+
+	// the sign-in route is mounted as is, the callback is split at handleOidcCallback as the rest needs the database
+	r := gin.New()
+	r.GET("/oidc/:provider/sign-in", func(ctx *gin.Context) {
+		signInUri, err := startOidcFlow(ctx, ctx.Param("provider"), ctx.Query("return"), false)
+		if err != nil {
+			ctx.String(400, err.Error())
+			return
+		}
+		ctx.Redirect(http.StatusTemporaryRedirect, signInUri)
+	})
+	r.GET("/oidc/:provider/callback", func(ctx *gin.Context) {
+		identity, flow, err := handleOidcCallback(ctx)
+		if err != nil {
+			ctx.String(400, err.Error())
+			return
+		}
+		ctx.JSON(200, gin.H{"identity": identity, "return": flow.ReturnUri})
+	})
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/oidc/unknown/sign-in", nil))
+	assert.Equal(t, 400, w.Code)
+
+	// the login token is sent to the return URI, so it has to be the frontend
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/oidc/test/sign-in?return=https://attacker.test/done", nil))
+	assert.Equal(t, 400, w.Code)
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/oidc/test/sign-in?return=http://frontend.test/done", nil))
+	require.Equal(t, http.StatusTemporaryRedirect, w.Code, w.Body.String())
+	signInUri, err := url.Parse(w.Header().Get("Location"))
+	require.NoError(t, err)
+	assert.Equal(t, provider.issuer()+"/auth", signInUri.Scheme+"://"+signInUri.Host+signInUri.Path)
+	assert.Equal(t, "http://api.test/oidc/test/callback", signInUri.Query().Get("redirect_uri"))
+	provider.codeChallenge = signInUri.Query().Get("code_challenge")
+	provider.nonce = signInUri.Query().Get("nonce")
+	state := signInUri.Query().Get("state")
+	cookies := w.Result().Cookies()
+	require.NotEmpty(t, cookies)
+
+	callback := func(state string, withCookie bool) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/oidc/test/callback?code=test-code&state="+url.QueryEscape(state), nil)
+		if withCookie {
+			for _, c := range cookies {
+				req.AddCookie(c)
+			}
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	// the state has to match the one in the cookie
+	assert.Equal(t, 400, callback("wrong", true).Code)
+	assert.Equal(t, 400, callback(state, false).Code)
+
+	w = callback(state, true)
+	require.Equal(t, 200, w.Code, w.Body.String())
+	var result struct {
+		Identity Identity `json:"identity"`
+		Return   string   `json:"return"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &result))
+	assert.Equal(t, Identity{Provider: "test", Subject: "oidc-user"}, result.Identity)
+	assert.Equal(t, "http://frontend.test/done", result.Return)
+
+	// the flow is used up
+	assert.Equal(t, 400, callback(state, true).Code)
+}
+
+func TestAllowedReturnUri(t *testing.T) {
+	Config = &Configuration{
+		FrontendUrl:              "https://gifs.example.com",
+		AccessControlAllowOrigin: &[]string{"*", "tauri://localhost", "http://localhost:5173"},
+	}
+	assert.True(t, allowedReturnUri("https://gifs.example.com/sso?next=/gifs"))
+	assert.True(t, allowedReturnUri("https://GIFS.example.com/sso"))
+	assert.True(t, allowedReturnUri("tauri://localhost/sso"))
+	assert.True(t, allowedReturnUri("http://localhost:5173/sso"))
+	assert.False(t, allowedReturnUri(""))
+	assert.False(t, allowedReturnUri("/sso"))
+	assert.False(t, allowedReturnUri("//evil.example/sso"))
+	assert.False(t, allowedReturnUri("https://evil.example/sso"))
+	assert.False(t, allowedReturnUri("https://gifs.example.com.evil.example/sso"))
+	assert.False(t, allowedReturnUri("http://gifs.example.com/sso"))
+	assert.False(t, allowedReturnUri("http://localhost:8080/sso"))
+	assert.False(t, allowedReturnUri("javascript:alert(1)"))
+}
+
+func TestRedirectWithParam(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest("GET", "/oidc/test/callback", nil)
+	redirectWithParam(c, "https://gifs.example.com/sso?next=%2Fgifs&token=old", "token", "a b")
+	assert.Equal(t, http.StatusTemporaryRedirect, w.Code)
+	location, err := url.Parse(w.Header().Get("Location"))
+	require.NoError(t, err)
+	assert.Equal(t, "/gifs", location.Query().Get("next"))
+	assert.Equal(t, []string{"a b"}, location.Query()["token"])
+}
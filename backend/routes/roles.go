@@ -0,0 +1,114 @@
+package routes
+
+import (
+	"context"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	. "kittygifs/util"
+	"kittygifs/util/audit"
+	"time"
+)
+
+func MountRoles(mounting *Mounting) {
+	mounting.Normal.GET("/permissions", func(c *gin.Context) {
+		c.JSON(200, Permissions)
+	})
+	mounting.Authed.GET("/users/self/permissions", func(c *gin.Context) {
+		c.JSON(200, GetUser(c).Permissions)
+	})
+	mounting.Authed.GET("/roles", func(c *gin.Context) {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		cur, err := RolesCol.Find(ctx, bson.M{})
+		if err != nil {
+			c.JSON(500, Error(err))
+			return
+		}
+		var roles []Role
+		err = cur.All(ctx, &roles)
+		if err != nil {
+			c.JSON(500, Error(err))
+			return
+		}
+		if roles == nil {
+			roles = []Role{}
+		}
+		c.JSON(200, roles)
+	})
+	mounting.Authed.PUT("/roles/:role", requirePermission(PermManageRoles), func(c *gin.Context) {
+		var role Role
+		err := c.BindJSON(&role)
+		if err != nil {
+			c.JSON(400, Error(err))
+			return
+		}
+		role.Name = c.Param("role")
+		if role.Permissions == nil {
+			role.Permissions = []string{}
+		}
+		if err = ValidateRole(role); err != nil {
+			c.JSON(400, Error(err))
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		var before *Role
+		{
+			var existing Role
+			err = RolesCol.FindOne(ctx, bson.M{"_id": role.Name}).Decode(&existing)
+			if err == nil {
+				before = &existing
+			} else if !errors.Is(err, mongo.ErrNoDocuments) {
+				c.JSON(500, Error(err))
+				return
+			}
+		}
+		TRUE := true
+		_, err = RolesCol.ReplaceOne(ctx, bson.M{"_id": role.Name}, role, &options.ReplaceOptions{Upsert: &TRUE})
+		if err != nil {
+			c.JSON(500, Error(err))
+			return
+		}
+		// the role is held through its group, which only admins can manage the members of
+		_, err = GroupsCol.UpdateOne(ctx, bson.M{"_id": RoleGroupPrefix + role.Name}, bson.M{"$setOnInsert": Group{
+			Name:         RoleGroupPrefix + role.Name,
+			Owners:       []string{},
+			IsPermission: true,
+		}}, &options.UpdateOptions{Upsert: &TRUE})
+		if err != nil {
+			c.JSON(500, Error(err))
+			return
+		}
+		audit.MustRecord(c, audit.RoleEdit, role.Name, before, role)
+		c.JSON(200, role)
+	})
+	mounting.Authed.DELETE("/roles/:role", requirePermission(PermManageRoles), func(c *gin.Context) {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		var role Role
+		err := RolesCol.FindOneAndDelete(ctx, bson.M{"_id": c.Param("role")}).Decode(&role)
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			c.JSON(404, ErrorStr("role not found"))
+			return
+		} else if err != nil {
+			c.JSON(500, Error(err))
+			return
+		}
+		groupName := RoleGroupPrefix + role.Name
+		_, err = GroupsCol.DeleteOne(ctx, bson.M{"_id": groupName})
+		if err != nil {
+			c.JSON(500, Error(err))
+			return
+		}
+		_, err = UsersCol.UpdateMany(ctx, bson.M{"groups": groupName}, bson.M{"$pull": bson.M{"groups": groupName}})
+		if err != nil {
+			c.JSON(500, Error(err))
+			return
+		}
+		audit.MustRecord(c, audit.RoleDelete, role.Name, role, nil)
+		c.Status(204)
+	})
+}
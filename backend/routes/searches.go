@@ -0,0 +1,215 @@
+package routes
+
+import (
+	"context"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	. "kittygifs/util"
+	"strings"
+	"time"
+)
+
+// maxSavedSearches is the most saved searches a user can have
+const maxSavedSearches = 50
+
+func MountSearches(mounting *Mounting) {
+	mounting.Authed.GET("/users/self/searches", func(c *gin.Context) {
+		user := GetUser(c)
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		filter := bson.M{"username": user.Username}
+		// searches shared with the user's groups are included
+		if user.Groups != nil && len(*user.Groups) != 0 {
+			filter = bson.M{"$or": bson.A{filter, bson.M{"group": bson.M{"$in": *user.Groups}}}}
+		}
+		cur, err := SavedSearchesCol.Find(ctx, filter, options.Find().SetSort(bson.M{"name": 1}))
+		if err != nil {
+			c.JSON(500, Error(err))
+			return
+		}
+		searches := []SavedSearch{}
+		err = cur.All(ctx, &searches)
+		if err != nil {
+			c.JSON(500, Error(err))
+			return
+		}
+		c.JSON(200, searches)
+	})
+	mounting.Authed.POST("/users/self/searches", func(c *gin.Context) {
+		user := GetUser(c)
+		type Request struct {
+			Name  string  `json:"name"`
+			Query string  `json:"query"`
+			Group *string `json:"group"`
+		}
+		var req Request
+		err := c.BindJSON(&req)
+		if err != nil {
+			c.JSON(400, Error(err))
+			return
+		}
+		now := time.Now()
+		search := SavedSearch{
+			Id:        NewUlid(),
+			Username:  user.Username,
+			Name:      req.Name,
+			Query:     req.Query,
+			Group:     req.Group,
+			CreatedAt: now,
+			UpdatedAt: now,
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if !validateSavedSearch(ctx, c, user, &search) {
+			return
+		}
+		count, err := SavedSearchesCol.CountDocuments(ctx, bson.M{"username": user.Username})
+		if err != nil {
+			c.JSON(500, Error(err))
+			return
+		}
+		if count >= maxSavedSearches {
+			c.JSON(400, ErrorStr("too many saved searches(>50)"))
+			return
+		}
+		_, err = SavedSearchesCol.InsertOne(ctx, search)
+		if mongo.IsDuplicateKeyError(err) {
+			c.JSON(400, ErrorStr("you already have a saved search with this name"))
+			return
+		} else if err != nil {
+			c.JSON(500, Error(err))
+			return
+		}
+		c.JSON(200, search)
+	})
+	mounting.Authed.PATCH("/users/self/searches/:name", func(c *gin.Context) {
+		user := GetUser(c)
+		type Request struct {
+			Name  *string `json:"name"`
+			Query *string `json:"query"`
+			// Group is the group to share the search with, an empty string stops sharing it
+			Group *string `json:"group"`
+		}
+		var req Request
+		err := c.BindJSON(&req)
+		if err != nil {
+			c.JSON(400, Error(err))
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		var search SavedSearch
+		err = SavedSearchesCol.FindOne(ctx, bson.M{"username": user.Username, "name": c.Param("name")}).Decode(&search)
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			c.JSON(404, ErrorStr("saved search not found"))
+			return
+		} else if err != nil {
+			c.JSON(500, Error(err))
+			return
+		}
+		if req.Name != nil {
+			search.Name = *req.Name
+		}
+		if req.Query != nil {
+			search.Query = *req.Query
+		}
+		if req.Group != nil {
+			search.Group = req.Group
+			if *req.Group == "" {
+				search.Group = nil
+			}
+		}
+		search.UpdatedAt = time.Now()
+		if !validateSavedSearch(ctx, c, user, &search) {
+			return
+		}
+		_, err = SavedSearchesCol.ReplaceOne(ctx, bson.M{"_id": search.Id}, search)
+		if mongo.IsDuplicateKeyError(err) {
+			c.JSON(400, ErrorStr("you already have a saved search with this name"))
+			return
+		} else if err != nil {
+			c.JSON(500, Error(err))
+			return
+		}
+		c.JSON(200, search)
+	})
+	mounting.Authed.DELETE("/users/self/searches/:name", func(c *gin.Context) {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		res, err := SavedSearchesCol.DeleteOne(ctx, bson.M{"username": GetUser(c).Username, "name": c.Param("name")})
+		if err != nil {
+			c.JSON(500, Error(err))
+			return
+		}
+		if res.DeletedCount == 0 {
+			c.JSON(404, ErrorStr("saved search not found"))
+			return
+		}
+		c.Status(204)
+	})
+}
+
+// expandQuery expands the saved searches used in the query.
+// Returns false and responds with an error if one isn't found or can't be used by the user
+func expandQuery(ctx context.Context, c *gin.Context, query string, user *User) (string, bool) {
+	if !strings.Contains(query, SavedSearchPrefix) {
+		return query, true
+	}
+	if user == nil {
+		c.JSON(401, ErrorStr("saved searches can only be used when signed in"))
+		return "", false
+	}
+	expanded, err := ExpandSavedSearches(ctx, query, user)
+	if errors.Is(err, ErrSavedSearchNotFound) || errors.Is(err, ErrTooManySavedSearches) {
+		c.JSON(400, Error(err))
+		return "", false
+	} else if err != nil {
+		c.JSON(500, Error(err))
+		return "", false
+	}
+	return expanded, true
+}
+
+// validateSavedSearch checks the name, that the query can be parsed and searched by the user,
+// and that the user has the group it's shared with. Returns false and responds with an error if it's invalid
+func validateSavedSearch(ctx context.Context, c *gin.Context, user *User, search *SavedSearch) bool {
+	if !SavedSearchValidation.MatchString(search.Name) {
+		c.JSON(400, ErrorStr("invalid name"))
+		return false
+	}
+	if len(search.Query) > 256 {
+		c.JSON(400, ErrorStr("query too long(>256)"))
+		return false
+	}
+	// saved searches can't be nested, so expanding them never recurses
+	if strings.Contains(search.Query, SavedSearchPrefix) {
+		c.JSON(400, ErrorStr("saved searches cannot use other saved searches"))
+		return false
+	}
+	query, err := ParseQuery(search.Query, &user.Username)
+	if err != nil {
+		c.JSON(400, ErrorStr("failed to parse query: "+err.Error()))
+		return false
+	}
+	if _, ok := searchFilter(ctx, c, query, user); !ok {
+		return false
+	}
+	if search.Group != nil {
+		if *search.Group == "" || strings.HasPrefix(*search.Group, "@") {
+			c.JSON(400, ErrorStr("invalid group"))
+			return false
+		}
+		if err := ValidateGroupsExist(ctx, []string{*search.Group}); err != nil {
+			c.JSON(400, Error(err))
+			return false
+		}
+		if !user.HasGroup(*search.Group) {
+			c.JSON(403, ErrorStr("you do not have the group "+*search.Group))
+			return false
+		}
+	}
+	return true
+}
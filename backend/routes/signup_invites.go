@@ -0,0 +1,168 @@
+package routes
+
+import (
+	"context"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	. "kittygifs/util"
+	"kittygifs/util/audit"
+	"time"
+)
+
+const (
+	signupInviteDefaultExpiry = 7 * 24 * time.Hour
+	signupInviteMaxExpiry     = 90 * 24 * time.Hour
+)
+
+func MountSignupInvites(mounting *Mounting) {
+	mounting.Authed.GET("/signupInvites", requirePermission(PermSignupInvites), func(c *gin.Context) {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		filter := bson.M{"expiresAt": bson.M{"$gt": time.Now()}}
+		if !GetUser(c).HasPermission(PermManageSignupInvites) {
+			filter["createdBy"] = GetUser(c).Username
+		}
+		cur, err := SignupInvitesCol.Find(ctx, filter, options.Find().SetSort(bson.M{"createdAt": -1}))
+		if err != nil {
+			c.JSON(500, Error(err))
+			return
+		}
+		invites := []SignupInvite{}
+		err = cur.All(ctx, &invites)
+		if err != nil {
+			c.JSON(500, Error(err))
+			return
+		}
+		c.JSON(200, invites)
+	})
+	mounting.Authed.POST("/signupInvites", requirePermission(PermSignupInvites), func(c *gin.Context) {
+		user := GetUser(c)
+		type Request struct {
+			// ExpiresIn is the number of seconds the invite is valid for
+			ExpiresIn int64    `json:"expiresIn"`
+			MaxUses   int32    `json:"maxUses"`
+			Groups    []string `json:"groups"`
+		}
+		var req Request
+		err := c.BindJSON(&req)
+		if err != nil {
+			c.JSON(400, Error(err))
+			return
+		}
+		if req.ExpiresIn == 0 {
+			req.ExpiresIn = int64(signupInviteDefaultExpiry.Seconds())
+		} else if req.ExpiresIn < 60 || req.ExpiresIn > int64(signupInviteMaxExpiry.Seconds()) {
+			c.JSON(400, ErrorStr("invalid expiresIn, must be between 60 seconds and 90 days"))
+			return
+		}
+		if req.MaxUses == 0 {
+			req.MaxUses = 1
+		} else if req.MaxUses < 0 || req.MaxUses > 1000 {
+			c.JSON(400, ErrorStr("invalid maxUses(<1 or >1000)"))
+			return
+		}
+		if req.Groups == nil {
+			req.Groups = []string{}
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		// only groups the user could add members to themselves can be given
+		for _, name := range req.Groups {
+			var group Group
+			err = GroupsCol.FindOne(ctx, bson.M{"_id": name}).Decode(&group)
+			if errors.Is(err, mongo.ErrNoDocuments) {
+				c.JSON(404, ErrorStr("group "+name+" not found"))
+				return
+			} else if err != nil {
+				c.JSON(500, Error(err))
+				return
+			}
+			if !canManageGroup(user, &group) {
+				c.JSON(403, ErrorStr("you cannot manage the members of group "+name))
+				return
+			}
+		}
+		now := time.Now()
+		invite := SignupInvite{
+			Code:      GenerateRandomString(16),
+			CreatedBy: user.Username,
+			CreatedAt: now,
+			ExpiresAt: now.Add(time.Duration(req.ExpiresIn) * time.Second),
+			MaxUses:   req.MaxUses,
+			Groups:    req.Groups,
+			UsedBy:    []string{},
+		}
+		_, err = SignupInvitesCol.InsertOne(ctx, invite)
+		if err != nil {
+			c.JSON(500, Error(err))
+			return
+		}
+		audit.MustRecord(c, audit.SignupInviteCreate, invite.Code, nil, invite)
+		c.JSON(200, invite)
+	})
+	mounting.Authed.DELETE("/signupInvites/:code", requirePermission(PermSignupInvites), func(c *gin.Context) {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		filter := bson.M{"_id": c.Param("code")}
+		if !GetUser(c).HasPermission(PermManageSignupInvites) {
+			filter["createdBy"] = GetUser(c).Username
+		}
+		res, err := SignupInvitesCol.DeleteOne(ctx, filter)
+		if err != nil {
+			c.JSON(500, Error(err))
+			return
+		}
+		if res.DeletedCount == 0 {
+			c.JSON(404, ErrorStr("invite not found"))
+			return
+		}
+		c.Status(204)
+	})
+}
+
+// claimSignupInvite uses up a use of the signup invite for the user if signup is invite-only, and returns the groups
+// the user should get. Returns false and responds with an error if the invite is invalid.
+// If creating the user fails, the use should be given back with releaseSignupInvite
+func claimSignupInvite(ctx context.Context, c *gin.Context, code, username string) ([]string, bool) {
+	if !Config.InviteOnlySignup {
+		return nil, true
+	}
+	if code == "" {
+		c.JSON(403, ErrorStr("signup is invite-only, an invite code is required"))
+		return nil, false
+	}
+	var invite SignupInvite
+	err := SignupInvitesCol.FindOneAndUpdate(ctx, bson.M{
+		"_id":       code,
+		"expiresAt": bson.M{"$gt": time.Now()},
+		"$expr":     bson.M{"$lt": bson.A{"$uses", "$maxUses"}},
+	}, bson.M{"$inc": bson.M{"uses": 1}, "$push": bson.M{"usedBy": username}}).Decode(&invite)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		c.JSON(403, ErrorStr("invalid or expired invite"))
+		return nil, false
+	} else if err != nil {
+		c.JSON(500, Error(err))
+		return nil, false
+	}
+	return invite.Groups, true
+}
+
+// releaseSignupInvite gives back the use of the invite claimed by claimSignupInvite
+func releaseSignupInvite(ctx context.Context, code, username string) {
+	if !Config.InviteOnlySignup {
+		return
+	}
+	_, _ = SignupInvitesCol.UpdateOne(ctx, bson.M{"_id": code, "usedBy": username},
+		bson.M{"$inc": bson.M{"uses": -1}, "$pull": bson.M{"usedBy": username}})
+}
+
+// signupGroups returns the groups of a new user
+func signupGroups(groups []string) *[]string {
+	if len(groups) == 0 {
+		return nil
+	}
+	return &groups
+}
@@ -0,0 +1,127 @@
+package routes
+
+import (
+	"context"
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	. "kittygifs/util"
+	"time"
+)
+
+// maxTagSubscriptions is the most subscriptions a user can have
+const maxTagSubscriptions = 100
+
+func MountSubscriptions(mounting *Mounting) {
+	mounting.Authed.GET("/subscriptions", func(c *gin.Context) {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		cur, err := TagSubscriptionsCol.Find(ctx, bson.M{"username": GetUser(c).Username},
+			options.Find().SetSort(bson.M{"_id": 1}))
+		if err != nil {
+			c.JSON(500, Error(err))
+			return
+		}
+		subscriptions := []TagSubscription{}
+		err = cur.All(ctx, &subscriptions)
+		if err != nil {
+			c.JSON(500, Error(err))
+			return
+		}
+		c.JSON(200, subscriptions)
+	})
+	mounting.Authed.POST("/subscriptions", func(c *gin.Context) {
+		user := GetUser(c)
+		type Request struct {
+			Tag   string `json:"tag"`
+			Query string `json:"query"`
+		}
+		var req Request
+		err := c.BindJSON(&req)
+		if err != nil {
+			c.JSON(400, Error(err))
+			return
+		}
+		if (req.Tag == "") == (req.Query == "") {
+			c.JSON(400, ErrorStr("either tag or query must be set"))
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if req.Tag != "" {
+			if !TagValidation.MatchString(req.Tag) {
+				c.JSON(400, ErrorStr("invalid tag"))
+				return
+			}
+		} else {
+			if len(req.Query) > 256 {
+				c.JSON(400, ErrorStr("query too long(>256)"))
+				return
+			}
+			// saved searches are expanded now, so the subscription isn't affected by them changing
+			var ok bool
+			req.Query, ok = expandQuery(ctx, c, req.Query, user)
+			if !ok {
+				return
+			}
+			query, err := ParseQuery(req.Query, &user.Username)
+			if err != nil {
+				c.JSON(400, ErrorStr("failed to parse query: "+err.Error()))
+				return
+			}
+			// checks the groups like searching would
+			if _, ok := searchFilter(ctx, c, query, user); !ok {
+				return
+			}
+		}
+		count, err := TagSubscriptionsCol.CountDocuments(ctx, bson.M{"username": user.Username})
+		if err != nil {
+			c.JSON(500, Error(err))
+			return
+		}
+		if count >= maxTagSubscriptions {
+			c.JSON(400, ErrorStr("too many subscriptions(>100)"))
+			return
+		}
+		filter := bson.M{"username": user.Username, "tag": bson.M{"$exists": false}, "query": req.Query}
+		if req.Tag != "" {
+			filter = bson.M{"username": user.Username, "tag": req.Tag}
+		}
+		count, err = TagSubscriptionsCol.CountDocuments(ctx, filter)
+		if err != nil {
+			c.JSON(500, Error(err))
+			return
+		}
+		if count > 0 {
+			c.JSON(400, ErrorStr("you are already subscribed to this"))
+			return
+		}
+		subscription := TagSubscription{
+			Id:        NewUlid(),
+			Username:  user.Username,
+			Tag:       req.Tag,
+			Query:     req.Query,
+			CreatedAt: time.Now(),
+		}
+		_, err = TagSubscriptionsCol.InsertOne(ctx, subscription)
+		if err != nil {
+			c.JSON(500, Error(err))
+			return
+		}
+		c.JSON(200, subscription)
+	})
+	mounting.Authed.DELETE("/subscriptions/:id", func(c *gin.Context) {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		res, err := TagSubscriptionsCol.DeleteOne(ctx, bson.M{"_id": c.Param("id"), "username": GetUser(c).Username})
+		if err != nil {
+			c.JSON(500, Error(err))
+			return
+		}
+		if res.DeletedCount == 0 {
+			c.JSON(404, ErrorStr("subscription not found"))
+			return
+		}
+		c.Status(204)
+	})
+}
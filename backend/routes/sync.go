@@ -3,6 +3,7 @@ package routes
 import (
 	"bytes"
 	"context"
+	"encoding/json"
 	"errors"
 	"github.com/gin-gonic/gin"
 	"go.mongodb.org/mongo-driver/bson"
@@ -10,56 +11,333 @@ import (
 	"go.mongodb.org/mongo-driver/mongo/options"
 	"io"
 	. "kittygifs/util"
+	"strconv"
+	"strings"
 	"time"
 )
 
 func MountSync(mounting *Mounting) {
-	mounting.Authed.GET("/sync/settings", func(c *gin.Context) {
+	mounting.Authed.GET("/sync", func(c *gin.Context) {
 		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 		defer cancel()
-		var syncSettings map[string]interface{}
-		err := SyncSettingsCol.FindOne(ctx, bson.M{"_id": GetUser(c).Username}).Decode(&syncSettings)
-		if errors.Is(err, mongo.ErrNoDocuments) {
-			c.Status(404)
+		cur, err := SyncSettingsCol.Find(ctx, bson.M{"username": GetUser(c).Username},
+			options.Find().SetProjection(bson.M{"data": 0}).SetSort(bson.M{"namespace": 1}))
+		if err != nil {
+			c.JSON(500, Error(err))
 			return
-		} else if err != nil {
+		}
+		namespaces := []SyncSettings{}
+		err = cur.All(ctx, &namespaces)
+		if err != nil {
 			c.JSON(500, Error(err))
 			return
 		}
-		c.JSON(200, syncSettings)
+		c.JSON(200, namespaces)
 	})
-	mounting.Authed.POST("/sync/settings", func(c *gin.Context) {
-		byteBody, err := io.ReadAll(c.Request.Body)
+	mounting.Authed.GET("/sync/:namespace", func(c *gin.Context) {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		settings, err := findSyncSettings(ctx, GetUser(c).Username, c.Param("namespace"))
 		if err != nil {
 			c.JSON(500, Error(err))
 			return
 		}
-		c.Request.Body = io.NopCloser(bytes.NewBuffer(byteBody))
-
-		if byteBody == nil {
-			c.JSON(400, ErrorStr("empty body"))
+		if settings == nil {
+			c.JSON(404, ErrorStr("namespace not found"))
+			return
+		}
+		c.Header("ETag", syncETag(settings))
+		if c.GetHeader("If-None-Match") == syncETag(settings) {
+			c.Status(304)
+			return
+		}
+		c.JSON(200, settings.Data)
+	})
+	mounting.Authed.POST("/sync/:namespace", func(c *gin.Context) {
+		namespace := c.Param("namespace")
+		if !SyncNamespaceValidation.MatchString(namespace) {
+			c.JSON(400, ErrorStr("invalid namespace"))
 			return
-		} else if len(byteBody) > 4_000 {
-			c.JSON(400, ErrorStr("body too large"))
+		}
+		data, ok := bindSyncBody(c, Config.SyncNamespace(namespace).MaxSize)
+		if !ok {
 			return
 		}
 		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 		defer cancel()
-		var syncSettings map[string]interface{}
-		err = c.BindJSON(&syncSettings)
+		current, err := findSyncSettings(ctx, GetUser(c).Username, namespace)
+		if err != nil {
+			c.JSON(500, Error(err))
+			return
+		}
+		if !checkIfMatch(c, current) {
+			return
+		}
+		saveSyncSettings(ctx, c, GetUser(c).Username, namespace, current, data)
+	})
+	mounting.Authed.PATCH("/sync/:namespace", func(c *gin.Context) {
+		namespace := c.Param("namespace")
+		if !SyncNamespaceValidation.MatchString(namespace) {
+			c.JSON(400, ErrorStr("invalid namespace"))
+			return
+		}
+		patch, ok := bindSyncBody(c, Config.SyncNamespace(namespace).MaxSize)
+		if !ok {
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		current, err := findSyncSettings(ctx, GetUser(c).Username, namespace)
+		if err != nil {
+			c.JSON(500, Error(err))
+			return
+		}
+		if !checkIfMatch(c, current) {
+			return
+		}
+		var target map[string]interface{}
+		if current != nil {
+			target = current.Data
+		}
+		data := MergePatch(target, patch).(map[string]interface{})
+		saveSyncSettings(ctx, c, GetUser(c).Username, namespace, current, data)
+	})
+	mounting.Authed.DELETE("/sync/:namespace", func(c *gin.Context) {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		username := GetUser(c).Username
+		current, err := findSyncSettings(ctx, username, c.Param("namespace"))
+		if err != nil {
+			c.JSON(500, Error(err))
+			return
+		}
+		if current == nil {
+			c.JSON(404, ErrorStr("namespace not found"))
+			return
+		}
+		if !checkIfMatch(c, current) {
+			return
+		}
+		res, err := SyncSettingsCol.DeleteOne(ctx, bson.M{"_id": current.Id, "version": current.Version})
+		if err != nil {
+			c.JSON(500, Error(err))
+			return
+		}
+		if res.DeletedCount == 0 {
+			c.JSON(412, ErrorStr("sync settings have changed"))
+			return
+		}
+		_, err = SyncHistoryCol.DeleteMany(ctx, bson.M{"username": username, "namespace": current.Namespace})
+		if err != nil {
+			c.JSON(500, Error(err))
+			return
+		}
+		c.Status(204)
+	})
+	mounting.Authed.GET("/sync/:namespace/history", func(c *gin.Context) {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		cur, err := SyncHistoryCol.Find(ctx, bson.M{"username": GetUser(c).Username, "namespace": c.Param("namespace")},
+			options.Find().SetSort(bson.M{"version": -1}))
+		if err != nil {
+			c.JSON(500, Error(err))
+			return
+		}
+		versions := []SyncSettingsVersion{}
+		err = cur.All(ctx, &versions)
+		if err != nil {
+			c.JSON(500, Error(err))
+			return
+		}
+		c.JSON(200, versions)
+	})
+	mounting.Authed.POST("/sync/:namespace/restore/:version", func(c *gin.Context) {
+		version, err := strconv.ParseInt(c.Param("version"), 10, 64)
 		if err != nil {
-			c.JSON(400, Error(err))
+			c.JSON(400, ErrorStr("invalid version"))
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		username := GetUser(c).Username
+		namespace := c.Param("namespace")
+		var previous SyncSettingsVersion
+		err = SyncHistoryCol.FindOne(ctx, bson.M{"username": username, "namespace": namespace, "version": version}).
+			Decode(&previous)
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			c.JSON(404, ErrorStr("version not found"))
+			return
+		} else if err != nil {
+			c.JSON(500, Error(err))
 			return
 		}
-		truePtr := true
-		_, err = SyncSettingsCol.ReplaceOne(ctx, bson.M{"_id": GetUser(c).Username}, bson.M{
-			"_id":  GetUser(c).Username,
-			"data": syncSettings,
-		}, &options.ReplaceOptions{Upsert: &truePtr})
+		current, err := findSyncSettings(ctx, username, namespace)
 		if err != nil {
 			c.JSON(500, Error(err))
 			return
 		}
-		c.Status(200)
+		if !checkIfMatch(c, current) {
+			return
+		}
+		// restoring saves the old data as a new version, so the restore can be undone too
+		saveSyncSettings(ctx, c, username, namespace, current, previous.Data)
 	})
 }
+
+// syncETag includes the ID of the settings with the version, the version starts at 1 again if the namespace
+// is deleted and created again, the ID is new
+func syncETag(settings *SyncSettings) string {
+	return `"` + settings.Id + "-" + strconv.FormatInt(settings.Version, 10) + `"`
+}
+
+// findSyncSettings returns nil if the user doesn't have anything saved in the namespace
+func findSyncSettings(ctx context.Context, username string, namespace string) (*SyncSettings, error) {
+	var settings SyncSettings
+	err := SyncSettingsCol.FindOne(ctx, bson.M{"username": username, "namespace": namespace}).Decode(&settings)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return &settings, nil
+}
+
+// bindSyncBody reads a JSON object no larger than maxSize.
+// Returns false and responds with an error if the body is invalid
+func bindSyncBody(c *gin.Context, maxSize int) (map[string]interface{}, bool) {
+	byteBody, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		c.JSON(500, Error(err))
+		return nil, false
+	}
+	c.Request.Body = io.NopCloser(bytes.NewBuffer(byteBody))
+
+	if len(byteBody) == 0 {
+		c.JSON(400, ErrorStr("empty body"))
+		return nil, false
+	} else if len(byteBody) > maxSize {
+		c.JSON(400, ErrorStr("body too large"))
+		return nil, false
+	}
+	var data map[string]interface{}
+	err = c.BindJSON(&data)
+	if err != nil {
+		c.JSON(400, Error(err))
+		return nil, false
+	}
+	if data == nil {
+		c.JSON(400, ErrorStr("body must be an object"))
+		return nil, false
+	}
+	return data, true
+}
+
+// checkIfMatch checks the If-Match header against the current sync settings, which are nil if the user has none.
+// Returns false and responds with 412 if they have changed since the client got them
+func checkIfMatch(c *gin.Context, current *SyncSettings) bool {
+	header := c.GetHeader("If-Match")
+	if header == "" {
+		return true
+	}
+	if current != nil {
+		for _, tag := range strings.Split(header, ",") {
+			tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+			if tag == "*" || tag == syncETag(current) {
+				return true
+			}
+		}
+	}
+	c.JSON(412, ErrorStr("sync settings have changed"))
+	return false
+}
+
+// saveSyncSettings replaces the current sync settings with a new version and keeps the current one in the history,
+// responding with the saved data. Responds with 412 if the settings were changed by another request in the meantime
+func saveSyncSettings(ctx context.Context, c *gin.Context, username string, namespace string, current *SyncSettings,
+	data map[string]interface{}) {
+	namespaceConfig := Config.SyncNamespace(namespace)
+	encoded, err := json.Marshal(data)
+	if err != nil {
+		c.JSON(400, Error(err))
+		return
+	} else if len(encoded) > namespaceConfig.MaxSize {
+		c.JSON(400, ErrorStr("settings too large"))
+		return
+	}
+	if namespaceConfig.Schema != nil {
+		// validated as decoded from JSON, data restored from the history is decoded from BSON
+		var decoded interface{}
+		err = json.Unmarshal(encoded, &decoded)
+		if err != nil {
+			c.JSON(500, Error(err))
+			return
+		}
+		err = namespaceConfig.Schema.Validate(decoded)
+		if err != nil {
+			c.JSON(400, ErrorStr("settings don't match the schema: "+err.Error()))
+			return
+		}
+	}
+	settings := SyncSettings{
+		Id:        NewUlid(),
+		Username:  username,
+		Namespace: namespace,
+		Data:      data,
+		Version:   1,
+		UpdatedAt: time.Now(),
+	}
+	if current == nil {
+		count, err := SyncSettingsCol.CountDocuments(ctx, bson.M{"username": username})
+		if err != nil {
+			c.JSON(500, Error(err))
+			return
+		}
+		if count >= MaxSyncNamespaces {
+			c.JSON(400, ErrorStr("too many namespaces(>20)"))
+			return
+		}
+		_, err = SyncSettingsCol.InsertOne(ctx, settings)
+		if mongo.IsDuplicateKeyError(err) {
+			c.JSON(412, ErrorStr("sync settings have changed"))
+			return
+		} else if err != nil {
+			c.JSON(500, Error(err))
+			return
+		}
+	} else {
+		settings.Id = current.Id
+		settings.Version = current.Version + 1
+		res, err := SyncSettingsCol.ReplaceOne(ctx, bson.M{"_id": current.Id, "version": current.Version}, settings)
+		if err != nil {
+			c.JSON(500, Error(err))
+			return
+		}
+		if res.MatchedCount == 0 {
+			c.JSON(412, ErrorStr("sync settings have changed"))
+			return
+		}
+		_, err = SyncHistoryCol.InsertOne(ctx, SyncSettingsVersion{
+			Id:        NewUlid(),
+			Username:  username,
+			Namespace: namespace,
+			Data:      current.Data,
+			Version:   current.Version,
+			SavedAt:   current.UpdatedAt,
+		})
+		if err != nil {
+			c.JSON(500, Error(err))
+			return
+		}
+		_, err = SyncHistoryCol.DeleteMany(ctx, bson.M{
+			"username":  username,
+			"namespace": namespace,
+			"version":   bson.M{"$lte": current.Version - int64(Config.SyncHistorySize)},
+		})
+		if err != nil {
+			c.JSON(500, Error(err))
+			return
+		}
+	}
+	c.Header("ETag", syncETag(&settings))
+	c.JSON(200, settings.Data)
+}
@@ -2,10 +2,14 @@ package routes
 
 import (
 	"context"
+	"errors"
 	"github.com/gin-gonic/gin"
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
 	"kittygifs/other"
 	. "kittygifs/util"
+	"kittygifs/util/audit"
+	"kittygifs/util/webhooks"
 	"time"
 )
 
@@ -40,11 +44,7 @@ func MountTags(mounting *Mounting) {
 		}
 		c.JSON(200, tag)
 	})
-	mounting.Authed.GET("/tags/update", func(c *gin.Context) {
-		if !GetUser(c).HasGroup("admin") {
-			c.Status(403)
-			return
-		}
+	mounting.Authed.GET("/tags/update", requirePermission(PermManageTags), func(c *gin.Context) {
 		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
 		defer cancel()
 		res, err := other.RunTagCount(ctx)
@@ -54,11 +54,7 @@ func MountTags(mounting *Mounting) {
 		}
 		c.JSON(200, res)
 	})
-	mounting.Authed.GET("/tags/forceImplicationsUpdate", func(c *gin.Context) {
-		if !GetUser(c).HasGroup("admin") {
-			c.Status(403)
-			return
-		}
+	mounting.Authed.GET("/tags/forceImplicationsUpdate", requirePermission(PermManageTags), func(c *gin.Context) {
 		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
 		defer cancel()
 		// get tags that have implications
@@ -102,11 +98,7 @@ func MountTags(mounting *Mounting) {
 		}
 		c.Status(200)
 	})
-	mounting.Authed.PATCH("/tags/:tag", func(c *gin.Context) {
-		if !GetUser(c).HasGroup("perm:edit_tags") {
-			c.Status(403)
-			return
-		}
+	mounting.Authed.PATCH("/tags/:tag", requirePermission(PermEditTags), func(c *gin.Context) {
 		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 		defer cancel()
 		var tag Tag
@@ -121,6 +113,7 @@ func MountTags(mounting *Mounting) {
 			c.JSON(400, Error(err))
 			return
 		}
+		before := tag
 		tag.Description = update.Description
 		tag.Category = update.Category
 		tag.Implications = update.Implications
@@ -133,13 +126,11 @@ func MountTags(mounting *Mounting) {
 			c.JSON(500, Error(err))
 			return
 		}
+		audit.MustRecord(c, audit.TagEdit, tag.Name, before, tag)
+		go webhooks.MustPublish(c.GetString("username"), webhooks.TagEdit, tag.Name, tag)
 		c.Status(200)
 	})
-	mounting.Authed.POST("/tags/:tag/rename", func(c *gin.Context) {
-		if !GetUser(c).HasGroup("perm:delete_tags") {
-			c.Status(403)
-			return
-		}
+	mounting.Authed.POST("/tags/:tag/rename", requirePermission(PermEditTags), func(c *gin.Context) {
 		newName := c.Query("new")
 		if newName == "" {
 			c.JSON(400, ErrorStr("new name is empty"))
@@ -197,26 +188,32 @@ func MountTags(mounting *Mounting) {
 			c.JSON(500, Error(err))
 			return
 		}
-		c.Status(200)
-	})
-	mounting.Authed.DELETE("/tags/:tag", func(c *gin.Context) {
-		if !GetUser(c).HasGroup("perm:delete_tags") {
-			c.Status(403)
+		_, err = TagSubscriptionsCol.UpdateMany(ctx, bson.M{"tag": c.Param("tag")}, bson.M{"$set": bson.M{"tag": newName}})
+		if err != nil {
+			c.JSON(500, Error(err))
 			return
 		}
+		audit.MustRecord(c, audit.TagRename, c.Param("tag"), gin.H{"name": c.Param("tag")}, gin.H{"name": newName, "merged": newExists})
+		go webhooks.MustPublish(c.GetString("username"), webhooks.TagRename, c.Param("tag"), gin.H{"name": newName, "merged": newExists})
+		c.Status(200)
+	})
+	mounting.Authed.DELETE("/tags/:tag", requirePermission(PermDeleteTags), func(c *gin.Context) {
 		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 		defer cancel()
-		_, err := TagsCol.DeleteOne(ctx, bson.M{"_id": c.Param("tag")})
-		if err != nil {
+		var tag Tag
+		err := TagsCol.FindOneAndDelete(ctx, bson.M{"_id": c.Param("tag")}).Decode(&tag)
+		if err != nil && !errors.Is(err, mongo.ErrNoDocuments) {
 			c.JSON(500, Error(err))
 			return
 		}
 		// delete all usages
-		_, err = GifsCol.UpdateMany(ctx, bson.M{"tags": c.Param("tag")}, bson.M{"$pull": bson.M{"tags": c.Param("tag")}})
+		res, err := GifsCol.UpdateMany(ctx, bson.M{"tags": c.Param("tag")}, bson.M{"$pull": bson.M{"tags": c.Param("tag")}})
 		if err != nil {
 			c.JSON(500, Error(err))
 			return
 		}
+		audit.MustRecord(c, audit.TagDelete, c.Param("tag"), gin.H{"tag": tag, "gifs": res.ModifiedCount}, nil)
+		go webhooks.MustPublish(c.GetString("username"), webhooks.TagDelete, c.Param("tag"), gin.H{"gifs": res.ModifiedCount})
 		c.Status(200)
 	})
 
@@ -240,11 +237,7 @@ func MountTags(mounting *Mounting) {
 		}
 		c.JSON(200, tagCategories)
 	})
-	mounting.Authed.POST("/tags/categories", func(c *gin.Context) {
-		if !GetUser(c).HasGroup("perm:edit_tags") {
-			c.Status(403)
-			return
-		}
+	mounting.Authed.POST("/tags/categories", requirePermission(PermEditTags), func(c *gin.Context) {
 		var category TagCategory
 		err := c.BindJSON(&category)
 		if err != nil {
@@ -262,13 +255,10 @@ func MountTags(mounting *Mounting) {
 			c.JSON(500, Error(err))
 			return
 		}
+		audit.MustRecord(c, audit.TagCategoryCreate, category.Name, nil, category)
 		c.Status(200)
 	})
-	mounting.Authed.PATCH("/tags/categories/:category", func(c *gin.Context) {
-		if !GetUser(c).HasGroup("perm:edit_tags") {
-			c.Status(403)
-			return
-		}
+	mounting.Authed.PATCH("/tags/categories/:category", requirePermission(PermEditTags), func(c *gin.Context) {
 		var update TagCategory
 		err := c.BindJSON(&update)
 		if err != nil {
@@ -311,13 +301,17 @@ func MountTags(mounting *Mounting) {
 				return
 			}
 		}
-		c.Status(200)
-	})
-	mounting.Authed.DELETE("/tags/categories/:category", func(c *gin.Context) {
-		if !GetUser(c).HasGroup("perm:edit_tags") {
-			c.Status(403)
+		// the category as stored after the update is recorded, not only the fields in the request
+		var after TagCategory
+		err = TagCategoriesCol.FindOne(ctx, bson.M{"_id": update.Name}).Decode(&after)
+		if err != nil {
+			c.JSON(500, Error(err))
 			return
 		}
+		audit.MustRecord(c, audit.TagCategoryEdit, category.Name, category, after)
+		c.Status(200)
+	})
+	mounting.Authed.DELETE("/tags/categories/:category", requirePermission(PermEditTags), func(c *gin.Context) {
 		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 		defer cancel()
 		// remove all usages of the category
@@ -326,11 +320,13 @@ func MountTags(mounting *Mounting) {
 			c.JSON(500, Error(err))
 			return
 		}
-		_, err = TagCategoriesCol.DeleteOne(ctx, bson.M{"_id": c.Param("category")})
-		if err != nil {
+		var category TagCategory
+		err = TagCategoriesCol.FindOneAndDelete(ctx, bson.M{"_id": c.Param("category")}).Decode(&category)
+		if err != nil && !errors.Is(err, mongo.ErrNoDocuments) {
 			c.JSON(500, Error(err))
 			return
 		}
+		audit.MustRecord(c, audit.TagCategoryDelete, c.Param("category"), category, nil)
 		c.Status(200)
 	})
 }
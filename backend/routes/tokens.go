@@ -0,0 +1,205 @@
+package routes
+
+import (
+	"context"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	. "kittygifs/util"
+	"time"
+)
+
+// routeScopes maps the routes that can be used with API tokens to the scope they require,
+// routes that aren't listed can only be used with a session
+var routeScopes = map[string]string{
+	"GET /gifs/search":                        ScopeGifsRead,
+	"GET /gifs/:id":                           ScopeGifsRead,
+	"POST /gifs":                              ScopeGifsWrite,
+	"PATCH /gifs/:id":                         ScopeGifsWrite,
+	"POST /gifs/bulk-edit":                    ScopeGifsWrite,
+	"DELETE /gifs/:id":                        ScopeGifsWrite,
+	"POST /gifs/:id/edit/suggestions":         ScopeGifsWrite,
+	"GET /users/:username/info":               ScopeUsersRead,
+	"GET /users/self/permissions":             ScopeUsersRead,
+	"GET /users/self/searches":                ScopeUsersRead,
+	"POST /users/self/searches":               ScopeSearchesWrite,
+	"PATCH /users/self/searches/:name":        ScopeSearchesWrite,
+	"DELETE /users/self/searches/:name":       ScopeSearchesWrite,
+	"GET /tags/update":                        ScopeTagsWrite,
+	"GET /tags/forceImplicationsUpdate":       ScopeTagsWrite,
+	"PATCH /tags/:tag":                        ScopeTagsWrite,
+	"POST /tags/:tag/rename":                  ScopeTagsWrite,
+	"DELETE /tags/:tag":                       ScopeTagsWrite,
+	"POST /tags/categories":                   ScopeTagsWrite,
+	"PATCH /tags/categories/:category":        ScopeTagsWrite,
+	"DELETE /tags/categories/:category":       ScopeTagsWrite,
+	"GET /groups":                             ScopeGroupsRead,
+	"GET /groups/:group":                      ScopeGroupsRead,
+	"GET /groups/:group/members":              ScopeGroupsRead,
+	"GET /groups/:group/invites":              ScopeGroupsRead,
+	"PUT /groups/:group/members/:username":    ScopeGroupsWrite,
+	"DELETE /groups/:group/members/:username": ScopeGroupsWrite,
+	"POST /groups/:group/invites":             ScopeGroupsWrite,
+	"DELETE /groups/:group/invites/:code":     ScopeGroupsWrite,
+	"POST /groups/join":                       ScopeGroupsWrite,
+	"GET /notifications":                      ScopeNotificationsRead,
+	"GET /notifications/count":                ScopeNotificationsRead,
+	"GET /notifications/stream":               ScopeNotificationsRead,
+	"GET /notifications/byEventId/:eventId":   ScopeNotificationsRead,
+	"DELETE /notifications/:id":               ScopeNotificationsWrite,
+	"POST /notifications/:id/read":            ScopeNotificationsWrite,
+	"POST /notifications/read":                ScopeNotificationsWrite,
+	"GET /notifications/preferences":          ScopeNotificationsRead,
+	"GET /subscriptions":                      ScopeNotificationsRead,
+	"POST /subscriptions":                     ScopeNotificationsWrite,
+	"DELETE /subscriptions/:id":               ScopeNotificationsWrite,
+	"GET /sync":                               ScopeSyncRead,
+	"GET /sync/:namespace":                    ScopeSyncRead,
+	"POST /sync/:namespace":                   ScopeSyncWrite,
+	"PATCH /sync/:namespace":                  ScopeSyncWrite,
+	"DELETE /sync/:namespace":                 ScopeSyncWrite,
+	"GET /sync/:namespace/history":            ScopeSyncRead,
+	"POST /sync/:namespace/restore/:version":  ScopeSyncWrite,
+}
+
+// apiTokenUpdateInterval is how often the last used time of an API token is updated
+const apiTokenUpdateInterval = time.Minute
+
+// maxApiTokens is the maximum number of API tokens a user can have
+const maxApiTokens = 25
+
+func MountApiTokens(mounting *Mounting) {
+	mounting.Authed.GET("/users/self/tokens", func(c *gin.Context) {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		cur, err := ApiTokensCol.Find(ctx, bson.M{
+			"username":  GetUser(c).Username,
+			"expiresAt": bson.M{"$not": bson.M{"$lt": time.Now()}},
+		}, &options.FindOptions{Sort: bson.M{"createdAt": -1}})
+		if err != nil {
+			c.JSON(500, Error(err))
+			return
+		}
+		var tokens []ApiToken
+		err = cur.All(ctx, &tokens)
+		if err != nil {
+			c.JSON(500, Error(err))
+			return
+		}
+		if tokens == nil {
+			tokens = []ApiToken{}
+		}
+		c.JSON(200, tokens)
+	})
+	mounting.Authed.POST("/users/self/tokens", func(c *gin.Context) {
+		type Request struct {
+			Name   string   `json:"name"`
+			Scopes []string `json:"scopes"`
+			// ExpiresIn is the number of days the token is valid for, if 0 the token never expires
+			ExpiresIn int `json:"expiresIn"`
+		}
+		var req Request
+		err := c.BindJSON(&req)
+		if err != nil {
+			c.JSON(400, Error(err))
+			return
+		}
+		if req.ExpiresIn < 0 || req.ExpiresIn > 3650 {
+			c.JSON(400, ErrorStr("invalid expiresIn(<0 or >3650)"))
+			return
+		}
+		now := time.Now()
+		token := ApiToken{
+			Id:        NewUlid(),
+			Token:     ApiTokenPrefix + GenerateRandomString(42),
+			Username:  GetUser(c).Username,
+			Name:      req.Name,
+			Scopes:    req.Scopes,
+			CreatedAt: now,
+		}
+		token.TokenHash = Config.HashToken(token.Token)
+		if req.ExpiresIn != 0 {
+			expiresAt := now.Add(time.Duration(req.ExpiresIn) * 24 * time.Hour)
+			token.ExpiresAt = &expiresAt
+		}
+		if err = ValidateApiToken(token); err != nil {
+			c.JSON(400, Error(err))
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		count, err := ApiTokensCol.CountDocuments(ctx, bson.M{"username": token.Username})
+		if err != nil {
+			c.JSON(500, Error(err))
+			return
+		}
+		if count >= maxApiTokens {
+			c.JSON(400, ErrorStr("too many API tokens"))
+			return
+		}
+		_, err = ApiTokensCol.InsertOne(ctx, token)
+		if err != nil {
+			c.JSON(500, Error(err))
+			return
+		}
+		c.JSON(200, token)
+	})
+	mounting.Authed.DELETE("/users/self/tokens/:id", func(c *gin.Context) {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		res, err := ApiTokensCol.DeleteOne(ctx, bson.M{"id": c.Param("id"), "username": GetUser(c).Username})
+		if err != nil {
+			c.JSON(500, Error(err))
+			return
+		}
+		if res.DeletedCount == 0 {
+			c.JSON(404, ErrorStr("token not found"))
+			return
+		}
+		c.Status(204)
+	})
+}
+
+// authenticateApiToken finds the API token and updates its last used time,
+// returns nil if the token does not exist or has expired
+func authenticateApiToken(ctx context.Context, c *gin.Context, token string) (*ApiToken, error) {
+	var apiToken ApiToken
+	err := ApiTokensCol.FindOne(ctx, bson.M{"_id": Config.HashToken(token)}).Decode(&apiToken)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	// expired tokens are only removed by the TTL index periodically
+	if apiToken.ExpiresAt != nil && apiToken.ExpiresAt.Before(now) {
+		return nil, nil
+	}
+	if apiToken.LastUsedAt == nil || now.Sub(*apiToken.LastUsedAt) > apiTokenUpdateInterval {
+		apiToken.LastUsedAt = &now
+		_, err = ApiTokensCol.UpdateOne(ctx, bson.M{"_id": apiToken.TokenHash}, bson.M{"$set": bson.M{"lastUsedAt": now}})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &apiToken, nil
+}
+
+// checkApiTokenScope checks that the API token can be used for the current route,
+// otherwise it writes the error to the response, aborts and returns false
+func checkApiTokenScope(c *gin.Context, apiToken *ApiToken) bool {
+	scope, ok := routeScopes[c.Request.Method+" "+c.FullPath()]
+	if !ok {
+		c.JSON(403, ErrorStr("this route cannot be used with an API token"))
+		c.Abort()
+		return false
+	}
+	if !apiToken.HasScope(scope) {
+		c.JSON(403, ErrorStr("the API token does not have the "+scope+" scope"))
+		c.Abort()
+		return false
+	}
+	return true
+}
@@ -0,0 +1,289 @@
+package routes
+
+import (
+	"context"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	. "kittygifs/util"
+	"time"
+)
+
+const (
+	// loginChallengeLifetime is how long the second step of a login can be completed for
+	loginChallengeLifetime = 5 * time.Minute
+	// loginChallengeAttempts is how many codes can be tried for a login challenge
+	loginChallengeAttempts = 5
+	recoveryCodeCount      = 10
+	totpIssuer             = "kittygifs"
+)
+
+type LoginChallenge struct {
+	Hash      string    `bson:"_id"`
+	Username  string    `bson:"username"`
+	ExpiresAt time.Time `bson:"expiresAt"`
+	Attempts  int       `bson:"attempts"`
+}
+
+func MountTotp(mounting *Mounting) {
+	mounting.Normal.POST("/users/sessions/totp", mounting.PasswordRateLimit, func(c *gin.Context) {
+		type Request struct {
+			Challenge    string `json:"challenge"`
+			Code         string `json:"code"`
+			RecoveryCode string `json:"recoveryCode"`
+		}
+		var req Request
+		err := c.BindJSON(&req)
+		if err != nil {
+			c.JSON(400, Error(err))
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		var challenge LoginChallenge
+		err = LoginChallengesCol.FindOneAndUpdate(ctx, bson.M{
+			"_id":       Config.HashToken(req.Challenge),
+			"expiresAt": bson.M{"$gt": time.Now()},
+			"attempts":  bson.M{"$lt": loginChallengeAttempts},
+		}, bson.M{"$inc": bson.M{"attempts": 1}}).Decode(&challenge)
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			c.JSON(401, ErrorStr("invalid or expired challenge"))
+			return
+		} else if err != nil {
+			c.JSON(500, Error(err))
+			return
+		}
+		var user User
+		err = UsersCol.FindOne(ctx, bson.M{"_id": challenge.Username}).Decode(&user)
+		if err != nil {
+			c.JSON(500, Error(err))
+			return
+		}
+		if !verifySecondFactor(ctx, c, &user, req.Code, req.RecoveryCode) {
+			return
+		}
+		_, err = LoginChallengesCol.DeleteOne(ctx, bson.M{"_id": challenge.Hash})
+		if err != nil {
+			c.JSON(500, Error(err))
+			return
+		}
+		session, err := createSession(ctx, c, user.Username)
+		if err != nil {
+			c.JSON(500, Error(err))
+			return
+		}
+		c.JSON(200, session)
+	})
+	mounting.Authed.POST("/users/self/totp", mounting.PasswordRateLimit, func(c *gin.Context) {
+		type Request struct {
+			Password    string `json:"password"`
+			ReauthToken string `json:"reauthToken"`
+		}
+		var req Request
+		err := c.BindJSON(&req)
+		if err != nil {
+			c.JSON(400, Error(err))
+			return
+		}
+		user := GetUser(c)
+		if user.TotpEnabled() {
+			c.JSON(400, ErrorStr("TOTP is already enabled"))
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if !checkPasswordOrReauth(ctx, c, user, req.Password, req.ReauthToken) {
+			return
+		}
+		secret := GenerateTotpSecret()
+		// the secret is only used once it's confirmed, starting over replaces an unconfirmed one
+		_, err = UsersCol.UpdateOne(ctx, bson.M{"_id": user.Username, "totp.enabled": bson.M{"$ne": true}},
+			bson.M{"$set": bson.M{"totp": UserTotp{Secret: secret, RecoveryCodes: []string{}}}})
+		if err != nil {
+			c.JSON(500, Error(err))
+			return
+		}
+		c.JSON(200, gin.H{
+			"secret": secret,
+			"uri":    TotpUri(totpIssuer, user.Username, secret),
+		})
+	})
+	mounting.Authed.POST("/users/self/totp/confirm", mounting.PasswordRateLimit, func(c *gin.Context) {
+		type Request struct {
+			Code string `json:"code"`
+		}
+		var req Request
+		err := c.BindJSON(&req)
+		if err != nil {
+			c.JSON(400, Error(err))
+			return
+		}
+		user := GetUser(c)
+		if user.Totp == nil {
+			c.JSON(400, ErrorStr("TOTP enrolment has not been started"))
+			return
+		}
+		if user.Totp.Enabled {
+			c.JSON(400, ErrorStr("TOTP is already enabled"))
+			return
+		}
+		step, ok := CheckTotpCode(user.Totp.Secret, req.Code, time.Now(), user.Totp.LastStep)
+		if !ok {
+			c.JSON(401, Error(ErrInvalidTotpCode))
+			return
+		}
+		codes, hashes, err := GenerateRecoveryCodes(recoveryCodeCount)
+		if err != nil {
+			c.JSON(500, Error(err))
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		res, err := UsersCol.UpdateOne(ctx, bson.M{"_id": user.Username, "totp.secret": user.Totp.Secret, "totp.enabled": false},
+			bson.M{"$set": bson.M{"totp.enabled": true, "totp.recoveryCodes": hashes, "totp.lastStep": step}})
+		if err != nil {
+			c.JSON(500, Error(err))
+			return
+		}
+		if res.ModifiedCount == 0 {
+			c.JSON(409, ErrorStr("TOTP enrolment has changed, start over"))
+			return
+		}
+		c.JSON(200, gin.H{"recoveryCodes": codes})
+	})
+	mounting.Authed.POST("/users/self/totp/recoveryCodes", mounting.PasswordRateLimit, func(c *gin.Context) {
+		type Request struct {
+			Password    string `json:"password"`
+			ReauthToken string `json:"reauthToken"`
+			Code        string `json:"code"`
+		}
+		var req Request
+		err := c.BindJSON(&req)
+		if err != nil {
+			c.JSON(400, Error(err))
+			return
+		}
+		user := GetUser(c)
+		if !user.TotpEnabled() {
+			c.JSON(400, ErrorStr("TOTP is not enabled"))
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if !checkPasswordOrReauth(ctx, c, user, req.Password, req.ReauthToken) {
+			return
+		}
+		if !verifySecondFactor(ctx, c, user, req.Code, "") {
+			return
+		}
+		codes, hashes, err := GenerateRecoveryCodes(recoveryCodeCount)
+		if err != nil {
+			c.JSON(500, Error(err))
+			return
+		}
+		_, err = UsersCol.UpdateOne(ctx, bson.M{"_id": user.Username}, bson.M{"$set": bson.M{"totp.recoveryCodes": hashes}})
+		if err != nil {
+			c.JSON(500, Error(err))
+			return
+		}
+		c.JSON(200, gin.H{"recoveryCodes": codes})
+	})
+	mounting.Authed.DELETE("/users/self/totp", mounting.PasswordRateLimit, func(c *gin.Context) {
+		type Request struct {
+			Password     string `json:"password"`
+			ReauthToken  string `json:"reauthToken"`
+			Code         string `json:"code"`
+			RecoveryCode string `json:"recoveryCode"`
+		}
+		var req Request
+		err := c.BindJSON(&req)
+		if err != nil {
+			c.JSON(400, Error(err))
+			return
+		}
+		user := GetUser(c)
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if !checkPasswordOrReauth(ctx, c, user, req.Password, req.ReauthToken) {
+			return
+		}
+		// an unconfirmed enrolment can be cancelled with just the password
+		if user.TotpEnabled() && !verifySecondFactor(ctx, c, user, req.Code, req.RecoveryCode) {
+			return
+		}
+		_, err = UsersCol.UpdateOne(ctx, bson.M{"_id": user.Username}, bson.M{"$unset": bson.M{"totp": ""}})
+		if err != nil {
+			c.JSON(500, Error(err))
+			return
+		}
+		c.Status(204)
+	})
+}
+
+// createLoginChallenge creates a challenge for the second step of a login and returns it
+func createLoginChallenge(ctx context.Context, username string) (string, error) {
+	challenge := GenerateRandomString(42)
+	_, err := LoginChallengesCol.InsertOne(ctx, LoginChallenge{
+		Hash:      Config.HashToken(challenge),
+		Username:  username,
+		ExpiresAt: time.Now().Add(loginChallengeLifetime),
+	})
+	if err != nil {
+		return "", err
+	}
+	return challenge, nil
+}
+
+// verifySecondFactor checks a TOTP code or a recovery code for the user and marks it as used, returns true if it's valid,
+// otherwise it writes the error to the response and returns false
+func verifySecondFactor(ctx context.Context, c *gin.Context, user *User, code, recoveryCode string) bool {
+	if !user.TotpEnabled() {
+		c.JSON(400, ErrorStr("TOTP is not enabled"))
+		return false
+	}
+	if code != "" {
+		step, ok := CheckTotpCode(user.Totp.Secret, code, time.Now(), user.Totp.LastStep)
+		if !ok {
+			c.JSON(401, Error(ErrInvalidTotpCode))
+			return false
+		}
+		// the filter makes concurrent uses of the same code fail
+		res, err := UsersCol.UpdateOne(ctx, bson.M{"_id": user.Username, "totp.lastStep": bson.M{"$lt": step}},
+			bson.M{"$set": bson.M{"totp.lastStep": step}})
+		if err != nil {
+			c.JSON(500, Error(err))
+			return false
+		}
+		if res.ModifiedCount == 0 {
+			c.JSON(401, Error(ErrInvalidTotpCode))
+			return false
+		}
+		return true
+	}
+	if recoveryCode != "" {
+		i, err := MatchRecoveryCode(recoveryCode, user.Totp.RecoveryCodes)
+		if err != nil {
+			c.JSON(500, Error(err))
+			return false
+		}
+		if i == -1 {
+			c.JSON(401, ErrorStr("invalid recovery code"))
+			return false
+		}
+		hash := user.Totp.RecoveryCodes[i]
+		res, err := UsersCol.UpdateOne(ctx, bson.M{"_id": user.Username, "totp.recoveryCodes": hash},
+			bson.M{"$pull": bson.M{"totp.recoveryCodes": hash}})
+		if err != nil {
+			c.JSON(500, Error(err))
+			return false
+		}
+		if res.ModifiedCount == 0 {
+			c.JSON(401, ErrorStr("invalid recovery code"))
+			return false
+		}
+		return true
+	}
+	c.JSON(400, ErrorStr("code or recoveryCode required"))
+	return false
+}
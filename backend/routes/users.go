@@ -1,16 +1,17 @@
 package routes
 
 import (
-	"bytes"
 	"context"
-	"fmt"
+	"errors"
 	"github.com/alexedwards/argon2id"
 	"github.com/gin-gonic/gin"
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 	. "kittygifs/util"
+	"kittygifs/util/audit"
 	"kittygifs/util/notifications"
-	"net/http"
+	"kittygifs/util/webhooks"
 	"time"
 )
 
@@ -46,6 +47,31 @@ func MountUsers(mounting *Mounting) {
 			Username: user.Username,
 			Groups:   user.Groups,
 		}
+		if username == "self" {
+			totpEnabled := user.TotpEnabled()
+			info.TotpEnabled = &totpEnabled
+			if user.Email != nil {
+				info.Email = user.Email
+				info.EmailVerified = &user.EmailVerified
+			}
+			if len(user.SuspendedGroups) > 0 {
+				info.SuspendedGroups = &user.SuspendedGroups
+			}
+		}
+		if username == "self" && user.Groups != nil {
+			cur, err := GroupsCol.Find(ctx, bson.M{"_id": bson.M{"$in": *user.Groups}})
+			if err != nil {
+				c.JSON(500, Error(err))
+				return
+			}
+			groupDetails := []Group{}
+			err = cur.All(ctx, &groupDetails)
+			if err != nil {
+				c.JSON(500, Error(err))
+				return
+			}
+			info.GroupDetails = &groupDetails
+		}
 		if req.Stats {
 			info.Stats = &UserStats{}
 			uploadCount, err := GifsCol.CountDocuments(ctx, bson.M{"uploader": user.Username}, &options.CountOptions{})
@@ -70,9 +96,10 @@ func MountUsers(mounting *Mounting) {
 		ctx, cancel := context.WithTimeout(context.Background(), 16*time.Second)
 		defer cancel()
 		type Request struct {
-			Username string  `json:"username"`
-			Password string  `json:"password"`
-			Captcha  *string `json:"captcha"`
+			Username   string  `json:"username"`
+			Password   string  `json:"password"`
+			Captcha    *string `json:"captcha"`
+			InviteCode string  `json:"inviteCode"`
 		}
 		var req Request
 		err := c.BindJSON(&req)
@@ -100,16 +127,23 @@ func MountUsers(mounting *Mounting) {
 			c.JSON(500, Error(err))
 			return
 		}
+		groups, ok := claimSignupInvite(ctx, c, req.InviteCode, req.Username)
+		if !ok {
+			return
+		}
 		user := User{
 			Username:     req.Username,
 			PasswordHash: hash,
+			Groups:       signupGroups(groups),
 		}
 		_, err = UsersCol.InsertOne(ctx, user)
 		if err != nil {
+			releaseSignupInvite(ctx, req.InviteCode, req.Username)
 			c.JSON(500, Error(err))
 			return
 		}
-		session, err := createSession(ctx, user.Username)
+		go webhooks.MustPublish(user.Username, webhooks.UserSignup, user.Username, gin.H{"username": user.Username})
+		session, err := createSession(ctx, c, user.Username)
 		if err != nil {
 			c.JSON(500, Error(err))
 			return
@@ -141,18 +175,54 @@ func MountUsers(mounting *Mounting) {
 		if !CheckPassword(c, request.Password, user.PasswordHash) {
 			return
 		}
-		session, err := createSession(ctx, user.Username)
+		if user.TotpEnabled() {
+			challenge, err := createLoginChallenge(ctx, user.Username)
+			if err != nil {
+				c.JSON(500, Error(err))
+				return
+			}
+			c.JSON(200, gin.H{
+				"type":      "totpRequired",
+				"challenge": challenge,
+			})
+			return
+		}
+		session, err := createSession(ctx, c, user.Username)
 		if err != nil {
 			c.JSON(500, Error(err))
 			return
 		}
 		c.JSON(200, session)
 	})
-	mounting.Sessioned.DELETE("/users/sessions", func(c *gin.Context) {
+	mounting.Authed.GET("/users/sessions", func(c *gin.Context) {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		cur, err := SessionsCol.Find(ctx, bson.M{
+			"username":  GetUser(c).Username,
+			"expiresAt": bson.M{"$not": bson.M{"$lt": time.Now()}},
+		}, &options.FindOptions{Sort: bson.M{"lastUsedAt": -1}})
+		if err != nil {
+			c.JSON(500, Error(err))
+			return
+		}
+		sessions := []UserSession{}
+		for cur.Next(ctx) {
+			var session UserSession
+			err = cur.Decode(&session)
+			if err != nil {
+				c.JSON(500, Error(err))
+				return
+			}
+			session.Current = session.TokenHash == Config.HashToken(c.GetString("sessionToken"))
+			sessions = append(sessions, session)
+		}
+		c.JSON(200, sessions)
+	})
+	mounting.Authed.DELETE("/users/sessions", func(c *gin.Context) {
 		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 		defer cancel()
 		user := GetUser(c)
-		err := deleteAllOtherSessions(ctx, user.Username, c.GetHeader("x-session-token"))
+		err := deleteAllOtherSessions(ctx, user.Username, c.GetString("sessionToken"))
 		if err != nil {
 			c.JSON(500, Error(err))
 			return
@@ -162,6 +232,7 @@ func MountUsers(mounting *Mounting) {
 	mounting.Authed.POST("/users/resetPassword", mounting.PasswordRateLimit, func(c *gin.Context) {
 		type Request struct {
 			OldPassword string `json:"oldPassword"`
+			ReauthToken string `json:"reauthToken"`
 			NewPassword string `json:"newPassword"`
 		}
 		var req Request
@@ -176,7 +247,9 @@ func MountUsers(mounting *Mounting) {
 		}
 		userGet, _ := c.Get("user")
 		user := userGet.(*User)
-		if !CheckPassword(c, req.OldPassword, user.PasswordHash) {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if !checkPasswordOrReauth(ctx, c, user, req.OldPassword, req.ReauthToken) {
 			return
 		}
 		hash, err := argon2id.CreateHash(req.NewPassword, Argon2idParams)
@@ -184,14 +257,14 @@ func MountUsers(mounting *Mounting) {
 			c.JSON(500, Error(err))
 			return
 		}
-		_, err = UsersCol.UpdateOne(context.Background(), bson.M{"_id": user.Username}, bson.M{"$set": bson.M{"passwordHash": hash}})
+		_, err = UsersCol.UpdateOne(ctx, bson.M{"_id": user.Username}, bson.M{"$set": bson.M{"passwordHash": hash}})
 		if err != nil {
 			c.JSON(500, Error(err))
 			return
 		}
 		c.Status(200)
 	})
-	mounting.Authed.POST("/users/resetPasswordAdmin", func(c *gin.Context) {
+	mounting.Authed.POST("/users/resetPasswordAdmin", requirePermission(PermResetPasswords), func(c *gin.Context) {
 		type Request struct {
 			Username    string `json:"username"`
 			NewPassword string `json:"newPassword"`
@@ -206,11 +279,6 @@ func MountUsers(mounting *Mounting) {
 			c.JSON(400, ErrorStr("new password too short(<8)"))
 			return
 		}
-		user := GetUser(c)
-		if !user.HasGroup("admin") {
-			c.JSON(403, ErrorStr("you are not admin"))
-			return
-		}
 		hash, err := argon2id.CreateHash(req.NewPassword, Argon2idParams)
 		if err != nil {
 			c.JSON(500, Error(err))
@@ -221,24 +289,37 @@ func MountUsers(mounting *Mounting) {
 			c.JSON(500, Error(err))
 			return
 		}
+		audit.MustRecord(c, audit.UserPasswordReset, req.Username, nil, nil)
 		c.Status(200)
 	})
 	mounting.Authed.DELETE("/users/sessions/:token", func(c *gin.Context) {
 		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 		defer cancel()
-		_, err := SessionsCol.DeleteOne(ctx, bson.M{"_id": c.Param("token")})
+		// the session can be given by either its token or ID
+		res, err := SessionsCol.DeleteOne(ctx, bson.M{
+			"username": GetUser(c).Username,
+			"$or": bson.A{
+				bson.M{"_id": Config.HashToken(c.Param("token"))},
+				bson.M{"id": c.Param("token")},
+			},
+		})
 		if err != nil {
 			c.JSON(500, Error(err))
 			return
 		}
+		if res.DeletedCount == 0 {
+			c.JSON(404, ErrorStr("session not found"))
+			return
+		}
 		c.Status(204)
 	})
 	mounting.Authed.POST("/users/gdprRequest", mounting.PasswordRateLimit, func(c *gin.Context) {
 		type Request struct {
-			Password   string `json:"password"`
-			IsDeletion bool   `json:"isDeletion"`
-			KeepPosts  bool   `json:"keepPosts"`
-			Note       string `json:"note"`
+			Password    string `json:"password"`
+			ReauthToken string `json:"reauthToken"`
+			IsDeletion  bool   `json:"isDeletion"`
+			KeepPosts   bool   `json:"keepPosts"`
+			Note        string `json:"note"`
 		}
 		var req Request
 		err := c.BindJSON(&req)
@@ -251,46 +332,70 @@ func MountUsers(mounting *Mounting) {
 			return
 		}
 		user := GetUser(c)
-		if !CheckPassword(c, req.Password, user.PasswordHash) {
-			return
-		}
 		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 		defer cancel()
-		typeString := "request"
-		if req.IsDeletion {
-			typeString = "deletion"
+		if !checkPasswordOrReauth(ctx, c, user, req.Password, req.ReauthToken) {
+			return
+		}
+		issue := Issue{
+			Id:        NewUlid(),
+			Type:      IssueTypeRequest,
+			Username:  user.Username,
+			KeepPosts: req.KeepPosts,
+			Note:      req.Note,
+			Status:    IssueStatusPending,
+			CreatedAt: time.Now(),
 		}
-		_, err = IssuesCol.InsertOne(ctx, bson.M{
-			"type":      typeString,
-			"username":  user.Username,
-			"keepPosts": req.KeepPosts,
-			"note":      req.Note,
+		issue.UpdatedAt = issue.CreatedAt
+		if req.IsDeletion {
+			issue.Type = IssueTypeDeletion
+			executeAfter := issue.CreatedAt.Add(time.Duration(Config.GdprDeletionDelayDays) * 24 * time.Hour)
+			issue.ExecuteAfter = &executeAfter
+		}
+		count, err := IssuesCol.CountDocuments(ctx, bson.M{
+			"username": user.Username,
+			"type":     issue.Type,
+			"status":   bson.M{"$in": bson.A{IssueStatusPending, IssueStatusProcessing}},
 		})
 		if err != nil {
 			c.JSON(500, Error(err))
 			return
 		}
-		go func() {
-			if Config.IssueDiscordWebhook == nil {
-				return
-			}
-			_, _ = http.DefaultClient.Post(*Config.IssueDiscordWebhook,
-				"application/json",
-				bytes.NewBuffer([]byte(fmt.Sprintf(`{"content": "New GDPR %s request"}`, typeString))))
-		}()
-		go notifications.MustNotifyGroup("admin", NewUlid(), notifications.GdprRequest,
-			map[string]interface{}{
-				"username": user.Username,
-			})
-		c.Status(200)
+		if count > 0 {
+			c.JSON(400, ErrorStr("you already have a pending request of this type"))
+			return
+		}
+		_, err = IssuesCol.InsertOne(ctx, issue)
+		if err != nil {
+			c.JSON(500, Error(err))
+			return
+		}
+		go webhooks.MustPublish(user.Username, webhooks.GdprRequestCreate, issue.Id, issue)
+		// data requests are processed automatically, deletions can be approved before the cooling-off period ends
+		if issue.Type == IssueTypeDeletion {
+			go notifications.MustNotifyGroup("admin", issue.Id, notifications.GdprRequest,
+				map[string]interface{}{
+					"username": user.Username,
+					"issueId":  issue.Id,
+				})
+		}
+		c.JSON(200, issue)
 	})
 }
 
-func createSession(ctx context.Context, username string) (*UserSession, error) {
+func createSession(ctx context.Context, c *gin.Context, username string) (*UserSession, error) {
+	now := time.Now()
 	session := UserSession{
-		Username: username,
-		Token:    GenerateRandomString(42),
+		Id:         NewUlid(),
+		Username:   username,
+		Token:      SessionTokenPrefix + GenerateRandomString(42),
+		CreatedAt:  now,
+		LastUsedAt: now,
+		UserAgent:  c.Request.UserAgent(),
+		Ip:         c.ClientIP(),
 	}
+	session.TokenHash = Config.HashToken(session.Token)
+	session.ExpiresAt = session.ExpiryAfterUse(Config, now)
 	_, err := SessionsCol.InsertOne(ctx, session)
 	if err != nil {
 		return nil, err
@@ -298,9 +403,46 @@ func createSession(ctx context.Context, username string) (*UserSession, error) {
 	return &session, nil
 }
 
+// authenticateSession finds the session for the token and updates its metadata,
+// returns nil if the session does not exist or has expired
+func authenticateSession(ctx context.Context, c *gin.Context, token string) (*UserSession, error) {
+	var session UserSession
+	err := SessionsCol.FindOne(ctx, bson.M{"_id": Config.HashToken(token)}).Decode(&session)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	// expired sessions are only removed by the TTL index periodically
+	if !session.ExpiresAt.IsZero() && session.ExpiresAt.Before(now) {
+		return nil, nil
+	}
+	if now.Sub(session.LastUsedAt) > sessionUpdateInterval ||
+		session.Ip != c.ClientIP() || session.UserAgent != c.Request.UserAgent() {
+		update := bson.M{
+			"lastUsedAt": now,
+			"ip":         c.ClientIP(),
+			"userAgent":  c.Request.UserAgent(),
+		}
+		// sessions created before they had metadata
+		if session.Id == "" {
+			session.CreatedAt = now
+			update["id"] = NewUlid()
+			update["createdAt"] = now
+		}
+		update["expiresAt"] = session.ExpiryAfterUse(Config, now)
+		_, err = SessionsCol.UpdateOne(ctx, bson.M{"_id": session.TokenHash}, bson.M{"$set": update})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &session, nil
+}
+
 // Deletes all sessions except the current one given by the token
 func deleteAllOtherSessions(ctx context.Context, username string, token string) error {
-	_, err := SessionsCol.DeleteMany(ctx, bson.M{"_id": bson.M{"$ne": token}, "username": username})
+	_, err := SessionsCol.DeleteMany(ctx, bson.M{"_id": bson.M{"$ne": Config.HashToken(token)}, "username": username})
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,226 @@
+package routes
+
+import (
+	"context"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	. "kittygifs/util"
+	"kittygifs/util/webhooks"
+	"slices"
+	"strconv"
+	"time"
+)
+
+func MountWebhooks(mounting *Mounting) {
+	mounting.Authed.GET("/webhooks", requirePermission(PermManageWebhooks), func(c *gin.Context) {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		cur, err := WebhooksCol.Find(ctx, bson.M{}, options.Find().SetProjection(bson.M{"secret": 0}))
+		if err != nil {
+			c.JSON(500, Error(err))
+			return
+		}
+		list := []webhooks.Webhook{}
+		err = cur.All(ctx, &list)
+		if err != nil {
+			c.JSON(500, Error(err))
+			return
+		}
+		c.JSON(200, list)
+	})
+	mounting.Authed.POST("/webhooks", requirePermission(PermManageWebhooks), func(c *gin.Context) {
+		type Request struct {
+			Url         string   `json:"url"`
+			Events      []string `json:"events"`
+			Format      string   `json:"format"`
+			Description string   `json:"description"`
+		}
+		var req Request
+		err := c.BindJSON(&req)
+		if err != nil {
+			c.JSON(400, Error(err))
+			return
+		}
+		if req.Format == "" {
+			req.Format = webhooks.FormatJson
+		}
+		webhook := webhooks.Webhook{
+			Id:          NewUlid(),
+			Url:         req.Url,
+			Secret:      GenerateRandomString(32),
+			Events:      req.Events,
+			Format:      req.Format,
+			Description: req.Description,
+			Enabled:     true,
+			CreatedBy:   GetUser(c).Username,
+			CreatedAt:   time.Now(),
+		}
+		err = webhook.Validate()
+		if err != nil {
+			c.JSON(400, Error(err))
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		_, err = WebhooksCol.InsertOne(ctx, webhook)
+		if err != nil {
+			c.JSON(500, Error(err))
+			return
+		}
+		c.JSON(200, webhook)
+	})
+	mounting.Authed.PATCH("/webhooks/:id", requirePermission(PermManageWebhooks), func(c *gin.Context) {
+		type Request struct {
+			Url         *string   `json:"url"`
+			Events      *[]string `json:"events"`
+			Format      *string   `json:"format"`
+			Description *string   `json:"description"`
+			Enabled     *bool     `json:"enabled"`
+			// RotateSecret generates a new secret, which is included in the response
+			RotateSecret bool `json:"rotateSecret"`
+		}
+		var req Request
+		err := c.BindJSON(&req)
+		if err != nil {
+			c.JSON(400, Error(err))
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		var webhook webhooks.Webhook
+		err = WebhooksCol.FindOne(ctx, bson.M{"_id": c.Param("id")}).Decode(&webhook)
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			c.JSON(404, ErrorStr("webhook not found"))
+			return
+		} else if err != nil {
+			c.JSON(500, Error(err))
+			return
+		}
+		if req.Url != nil {
+			webhook.Url = *req.Url
+		}
+		if req.Events != nil {
+			webhook.Events = *req.Events
+		}
+		if req.Format != nil {
+			webhook.Format = *req.Format
+		}
+		if req.Description != nil {
+			webhook.Description = *req.Description
+		}
+		if req.Enabled != nil {
+			webhook.Enabled = *req.Enabled
+		}
+		if req.RotateSecret {
+			webhook.Secret = GenerateRandomString(32)
+		}
+		err = webhook.Validate()
+		if err != nil {
+			c.JSON(400, Error(err))
+			return
+		}
+		_, err = WebhooksCol.ReplaceOne(ctx, bson.M{"_id": webhook.Id}, webhook)
+		if err != nil {
+			c.JSON(500, Error(err))
+			return
+		}
+		if !req.RotateSecret {
+			webhook.Secret = ""
+		}
+		c.JSON(200, webhook)
+	})
+	mounting.Authed.DELETE("/webhooks/:id", requirePermission(PermManageWebhooks), func(c *gin.Context) {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		res, err := WebhooksCol.DeleteOne(ctx, bson.M{"_id": c.Param("id")})
+		if err != nil {
+			c.JSON(500, Error(err))
+			return
+		}
+		if res.DeletedCount == 0 {
+			c.JSON(404, ErrorStr("webhook not found"))
+			return
+		}
+		_, err = WebhookDeliveriesCol.DeleteMany(ctx, bson.M{"webhookId": c.Param("id")})
+		if err != nil {
+			c.JSON(500, Error(err))
+			return
+		}
+		c.Status(204)
+	})
+	mounting.Authed.GET("/webhooks/:id/deliveries", requirePermission(PermManageWebhooks), func(c *gin.Context) {
+		type Request struct {
+			Status string `form:"status"`
+			Before string `form:"before"`
+			Max    string `form:"max"`
+		}
+		var req Request
+		err := c.ShouldBindQuery(&req)
+		if err != nil {
+			c.JSON(400, Error(err))
+			return
+		}
+		filter := bson.M{"webhookId": c.Param("id")}
+		if req.Status != "" {
+			if !slices.Contains([]string{webhooks.DeliveryPending, webhooks.DeliverySucceeded, webhooks.DeliveryFailed}, req.Status) {
+				c.JSON(400, ErrorStr("invalid status"))
+				return
+			}
+			filter["status"] = req.Status
+		}
+		if req.Before != "" {
+			filter["_id"] = bson.M{"$lt": req.Before}
+		}
+		var maxNum int64 = 100
+		if req.Max != "" {
+			maxNum, err = strconv.ParseInt(req.Max, 10, 64)
+			if err != nil || maxNum < 1 || maxNum > 500 {
+				c.JSON(400, ErrorStr("invalid max"))
+				return
+			}
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		cur, err := WebhookDeliveriesCol.Find(ctx, filter, &options.FindOptions{
+			Limit: &maxNum,
+			Sort:  bson.M{"_id": -1},
+		})
+		if err != nil {
+			c.JSON(500, Error(err))
+			return
+		}
+		deliveries := []webhooks.Delivery{}
+		err = cur.All(ctx, &deliveries)
+		if err != nil {
+			c.JSON(500, Error(err))
+			return
+		}
+		c.JSON(200, deliveries)
+	})
+	mounting.Authed.POST("/webhooks/:id/deliveries/:delivery/redeliver", requirePermission(PermManageWebhooks), func(c *gin.Context) {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		// pending deliveries are already being retried
+		res, err := WebhookDeliveriesCol.UpdateOne(ctx, bson.M{
+			"_id":       c.Param("delivery"),
+			"webhookId": c.Param("id"),
+			"status":    bson.M{"$ne": webhooks.DeliveryPending},
+		}, bson.M{"$set": bson.M{
+			"status":        webhooks.DeliveryPending,
+			"attempts":      0,
+			"nextAttemptAt": time.Now(),
+		}})
+		if err != nil {
+			c.JSON(500, Error(err))
+			return
+		}
+		if res.MatchedCount == 0 {
+			c.JSON(404, ErrorStr("delivery not found or still pending"))
+			return
+		}
+		c.Status(204)
+	})
+}
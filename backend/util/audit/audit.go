@@ -0,0 +1,70 @@
+package audit
+
+import (
+	"context"
+	"github.com/gin-gonic/gin"
+	. "kittygifs/util"
+	"log"
+	"time"
+)
+
+// Entry is an append-only record of a change made through the API
+type Entry struct {
+	Id     string      `json:"id" bson:"_id"`
+	Actor  string      `json:"actor" bson:"actor"`
+	Action string      `json:"action" bson:"action"`
+	Target string      `json:"target" bson:"target"`
+	Before interface{} `json:"before,omitempty" bson:"before,omitempty"`
+	After  interface{} `json:"after,omitempty" bson:"after,omitempty"`
+	Ip     string      `json:"ip" bson:"ip"`
+	Time   time.Time   `json:"time" bson:"time"`
+}
+
+const (
+	GifEdit            = "gif.edit"
+	GifBulkEdit        = "gif.bulkEdit"
+	GifDelete          = "gif.delete"
+	UserPasswordReset  = "user.resetPasswordAdmin"
+	TagEdit            = "tag.edit"
+	TagRename          = "tag.rename"
+	TagDelete          = "tag.delete"
+	TagCategoryCreate  = "tagCategory.create"
+	TagCategoryEdit    = "tagCategory.edit"
+	TagCategoryDelete  = "tagCategory.delete"
+	RoleEdit           = "role.edit"
+	RoleDelete         = "role.delete"
+	GdprApprove        = "gdpr.approve"
+	GdprReject         = "gdpr.reject"
+	SignupInviteCreate = "signupInvite.create"
+)
+
+// Actions is a list of all audit log actions
+var Actions = []string{GifEdit, GifBulkEdit, GifDelete, UserPasswordReset, TagEdit, TagRename, TagDelete,
+	TagCategoryCreate, TagCategoryEdit, TagCategoryDelete, RoleEdit, RoleDelete, GdprApprove, GdprReject,
+	SignupInviteCreate}
+
+// MustRecord records the entry and logs the error if it fails, the change it records has already been made
+func MustRecord(c *gin.Context, action, target string, before, after interface{}) {
+	err := Record(c, action, target, before, after)
+	if err != nil {
+		log.Println("failed to record audit log entry", action, target+":", err)
+	}
+}
+
+// Record appends an entry to the audit log, the actor and IP are taken from the request
+func Record(c *gin.Context, action, target string, before, after interface{}) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	entry := Entry{
+		Id:     NewUlid(),
+		Actor:  c.GetString("username"),
+		Action: action,
+		Target: target,
+		Before: before,
+		After:  after,
+		Ip:     c.ClientIP(),
+		Time:   time.Now(),
+	}
+	_, err := AuditCol.InsertOne(ctx, entry)
+	return err
+}
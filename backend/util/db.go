@@ -2,36 +2,94 @@ package util
 
 import (
 	"context"
+	"errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/event"
 	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/gridfs"
 	"go.mongodb.org/mongo-driver/mongo/options"
+	"kittygifs/util/metrics"
 	"log"
 	"time"
 )
 
 var (
-	MongoClient      *mongo.Client
-	GifsCol          *mongo.Collection
-	UsersCol         *mongo.Collection
-	SessionsCol      *mongo.Collection
-	IssuesCol        *mongo.Collection
-	NotificationsCol *mongo.Collection
-	MiscCol          *mongo.Collection
-	SyncSettingsCol  *mongo.Collection
-	TagsCol          *mongo.Collection
-	TagCategoriesCol *mongo.Collection
+	MongoClient           *mongo.Client
+	GifsCol               *mongo.Collection
+	UsersCol              *mongo.Collection
+	SessionsCol           *mongo.Collection
+	IssuesCol             *mongo.Collection
+	NotificationsCol      *mongo.Collection
+	NotificationDigestCol *mongo.Collection
+	MiscCol               *mongo.Collection
+	SyncSettingsCol       *mongo.Collection
+	// SyncHistoryCol stores the previous versions of sync settings
+	SyncHistoryCol        *mongo.Collection
+	TagsCol               *mongo.Collection
+	TagCategoriesCol      *mongo.Collection
+	AuditCol              *mongo.Collection
+	GroupsCol             *mongo.Collection
+	GroupInvitesCol       *mongo.Collection
+	RolesCol              *mongo.Collection
+	ApiTokensCol          *mongo.Collection
+	LoginChallengesCol    *mongo.Collection
+	VerificationTokensCol *mongo.Collection
+	StatesCol             *mongo.Collection
+	SignupInvitesCol      *mongo.Collection
+	NotificationEventsCol *mongo.Collection
+	WebhooksCol           *mongo.Collection
+	WebhookDeliveriesCol  *mongo.Collection
+	TagSubscriptionsCol   *mongo.Collection
+	SavedSearchesCol      *mongo.Collection
+	// SubscriptionBatchesCol collects the gifs matching a user's subscriptions until they are notified of them
+	SubscriptionBatchesCol *mongo.Collection
+	// ExportsBucket stores GDPR data exports
+	ExportsBucket *gridfs.Bucket
 )
 
+// commandMonitor records the duration of MongoDB commands for the metrics
+var commandMonitor = &event.CommandMonitor{
+	Succeeded: func(ctx context.Context, evt *event.CommandSucceededEvent) {
+		metrics.MongoCommandDuration.Observe(evt.Duration.Seconds(), evt.CommandName)
+	},
+	Failed: func(ctx context.Context, evt *event.CommandFailedEvent) {
+		metrics.MongoCommandDuration.Observe(evt.Duration.Seconds(), evt.CommandName)
+		metrics.MongoCommandFailures.Inc(evt.CommandName)
+	},
+}
+
+// mongoRetryDelay is how long to wait after failing to connect to MongoDB for the attempt-th time,
+// doubling from a second up to 30 seconds
+func mongoRetryDelay(attempt int) time.Duration {
+	if attempt > 5 {
+		return 30 * time.Second
+	}
+	return min(time.Second<<(attempt-1), 30*time.Second)
+}
+
 // InitializeMongoDB initializes the MongoDB client and collections
 func InitializeMongoDB(config *Configuration) {
 	{
 		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 		defer cancel()
 		var err error
-		MongoClient, err = mongo.Connect(ctx, options.Client().ApplyURI(config.MongoUrl))
+		MongoClient, err = mongo.Connect(ctx, options.Client().ApplyURI(config.MongoUrl).SetMonitor(commandMonitor))
 		if err != nil {
 			log.Fatal(err)
 		}
 	}
+	// MongoDB may not be reachable yet when the server starts, e.g. when they're started together
+	for attempt := 1; ; attempt++ {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		err := MongoClient.Ping(ctx, nil)
+		cancel()
+		if err == nil {
+			break
+		}
+		delay := mongoRetryDelay(attempt)
+		log.Println("failed to connect to MongoDB, retrying in", delay.String()+":", err)
+		time.Sleep(delay)
+	}
 	// create database if not exists
 	db := MongoClient.Database(config.DatabaseName)
 	{
@@ -46,6 +104,23 @@ func InitializeMongoDB(config *Configuration) {
 		_ = db.CreateCollection(ctx, "sync_settings")
 		_ = db.CreateCollection(ctx, "tags")
 		_ = db.CreateCollection(ctx, "tag_categories")
+		_ = db.CreateCollection(ctx, "audit_log")
+		_ = db.CreateCollection(ctx, "groups")
+		_ = db.CreateCollection(ctx, "group_invites")
+		_ = db.CreateCollection(ctx, "roles")
+		_ = db.CreateCollection(ctx, "api_tokens")
+		_ = db.CreateCollection(ctx, "login_challenges")
+		_ = db.CreateCollection(ctx, "verification_tokens")
+		_ = db.CreateCollection(ctx, "states")
+		_ = db.CreateCollection(ctx, "signup_invites")
+		_ = db.CreateCollection(ctx, "notification_events")
+		_ = db.CreateCollection(ctx, "notification_digest")
+		_ = db.CreateCollection(ctx, "webhooks")
+		_ = db.CreateCollection(ctx, "tag_subscriptions")
+		_ = db.CreateCollection(ctx, "subscription_batches")
+		_ = db.CreateCollection(ctx, "saved_searches")
+		_ = db.CreateCollection(ctx, "webhook_deliveries")
+		_ = db.CreateCollection(ctx, "sync_history")
 	}
 	GifsCol = db.Collection("gifs")
 	UsersCol = db.Collection("users")
@@ -54,6 +129,175 @@ func InitializeMongoDB(config *Configuration) {
 	NotificationsCol = db.Collection("notifications")
 	MiscCol = db.Collection("misc")
 	SyncSettingsCol = db.Collection("sync_settings")
+	SyncHistoryCol = db.Collection("sync_history")
 	TagsCol = db.Collection("tags")
 	TagCategoriesCol = db.Collection("tag_categories")
+	AuditCol = db.Collection("audit_log")
+	GroupsCol = db.Collection("groups")
+	GroupInvitesCol = db.Collection("group_invites")
+	RolesCol = db.Collection("roles")
+	ApiTokensCol = db.Collection("api_tokens")
+	LoginChallengesCol = db.Collection("login_challenges")
+	VerificationTokensCol = db.Collection("verification_tokens")
+	StatesCol = db.Collection("states")
+	SignupInvitesCol = db.Collection("signup_invites")
+	NotificationEventsCol = db.Collection("notification_events")
+	NotificationDigestCol = db.Collection("notification_digest")
+	WebhooksCol = db.Collection("webhooks")
+	TagSubscriptionsCol = db.Collection("tag_subscriptions")
+	SubscriptionBatchesCol = db.Collection("subscription_batches")
+	SavedSearchesCol = db.Collection("saved_searches")
+	WebhookDeliveriesCol = db.Collection("webhook_deliveries")
+	{
+		var err error
+		ExportsBucket, err = gridfs.NewBucket(db, options.GridFSBucket().SetName("exports"))
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	{
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if config.AuditLogRetentionDays > 0 {
+			err := ensureTtlIndex(ctx, AuditCol, "time", time.Duration(config.AuditLogRetentionDays)*24*time.Hour)
+			if err != nil {
+				log.Println("failed to create audit log retention index:", err)
+			}
+		} else {
+			_, _ = AuditCol.Indexes().DropOne(ctx, "time_ttl")
+		}
+		err := ensureTtlIndex(ctx, GroupInvitesCol, "expiresAt", 0)
+		if err != nil {
+			log.Println("failed to create group invite expiry index:", err)
+		}
+		err = ensureTtlIndex(ctx, SessionsCol, "expiresAt", 0)
+		if err != nil {
+			log.Println("failed to create session expiry index:", err)
+		}
+		_, err = SessionsCol.Indexes().CreateOne(ctx, mongo.IndexModel{Keys: bson.D{{Key: "username", Value: 1}}})
+		if err != nil {
+			log.Println("failed to create session username index:", err)
+		}
+		err = ensureTtlIndex(ctx, ApiTokensCol, "expiresAt", 0)
+		if err != nil {
+			log.Println("failed to create API token expiry index:", err)
+		}
+		err = ensureTtlIndex(ctx, LoginChallengesCol, "expiresAt", 0)
+		if err != nil {
+			log.Println("failed to create login challenge expiry index:", err)
+		}
+		err = ensureTtlIndex(ctx, VerificationTokensCol, "expiresAt", 0)
+		if err != nil {
+			log.Println("failed to create verification token expiry index:", err)
+		}
+		err = ensureTtlIndex(ctx, StatesCol, "expiresAt", 0)
+		if err != nil {
+			log.Println("failed to create state expiry index:", err)
+		}
+		err = ensureTtlIndex(ctx, SignupInvitesCol, "expiresAt", 0)
+		if err != nil {
+			log.Println("failed to create signup invite expiry index:", err)
+		}
+		_, err = NotificationsCol.Indexes().CreateOne(ctx, mongo.IndexModel{
+			Keys: bson.D{{Key: "username", Value: 1}, {Key: "_id", Value: -1}},
+		})
+		if err != nil {
+			log.Println("failed to create notification index:", err)
+		}
+		err = ensureTtlIndex(ctx, NotificationEventsCol, "expiresAt", 0)
+		if err != nil {
+			log.Println("failed to create notification event expiry index:", err)
+		}
+		_, err = NotificationEventsCol.Indexes().CreateOne(ctx, mongo.IndexModel{
+			Keys: bson.D{{Key: "username", Value: 1}, {Key: "_id", Value: 1}},
+		})
+		if err != nil {
+			log.Println("failed to create notification event index:", err)
+		}
+		err = ensureTtlIndex(ctx, WebhookDeliveriesCol, "expiresAt", 0)
+		if err != nil {
+			log.Println("failed to create webhook delivery expiry index:", err)
+		}
+		_, err = WebhookDeliveriesCol.Indexes().CreateMany(ctx, []mongo.IndexModel{
+			{Keys: bson.D{{Key: "status", Value: 1}, {Key: "nextAttemptAt", Value: 1}}},
+			{Keys: bson.D{{Key: "webhookId", Value: 1}, {Key: "_id", Value: -1}}},
+		})
+		if err != nil {
+			log.Println("failed to create webhook delivery indexes:", err)
+		}
+		_, err = TagSubscriptionsCol.Indexes().CreateMany(ctx, []mongo.IndexModel{
+			{Keys: bson.D{{Key: "username", Value: 1}}},
+			{Keys: bson.D{{Key: "tag", Value: 1}}},
+		})
+		if err != nil {
+			log.Println("failed to create tag subscription indexes:", err)
+		}
+		_, err = SyncHistoryCol.Indexes().CreateOne(ctx, mongo.IndexModel{
+			Keys: bson.D{{Key: "username", Value: 1}, {Key: "namespace", Value: 1}, {Key: "version", Value: -1}},
+		})
+		if err != nil {
+			log.Println("failed to create sync history index:", err)
+		}
+		TRUE := true
+		// sync settings from before namespaces don't have the fields until they're migrated
+		_, err = SyncSettingsCol.Indexes().CreateOne(ctx, mongo.IndexModel{
+			Keys: bson.D{{Key: "username", Value: 1}, {Key: "namespace", Value: 1}},
+			Options: &options.IndexOptions{
+				Unique:                  &TRUE,
+				PartialFilterExpression: bson.M{"namespace": bson.M{"$exists": true}},
+			},
+		})
+		if err != nil {
+			log.Println("failed to create sync settings index:", err)
+		}
+		_, err = SavedSearchesCol.Indexes().CreateMany(ctx, []mongo.IndexModel{
+			{
+				Keys:    bson.D{{Key: "username", Value: 1}, {Key: "name", Value: 1}},
+				Options: &options.IndexOptions{Unique: &TRUE},
+			},
+			{Keys: bson.D{{Key: "group", Value: 1}, {Key: "name", Value: 1}}},
+		})
+		if err != nil {
+			log.Println("failed to create saved search indexes:", err)
+		}
+		// unverified addresses aren't unique, so someone can't block an address they don't own
+		_, err = UsersCol.Indexes().CreateOne(ctx, mongo.IndexModel{
+			Keys: bson.D{{Key: "email", Value: 1}},
+			Options: &options.IndexOptions{
+				Unique:                  &TRUE,
+				PartialFilterExpression: bson.M{"emailVerified": true},
+			},
+		})
+		if err != nil {
+			log.Println("failed to create user email index:", err)
+		}
+		err = createIdentityIndex(ctx)
+		if err != nil {
+			log.Println("failed to create user identity index:", err)
+		}
+	}
+}
+
+// ensureTtlIndex creates a TTL index named {field}_ttl on the field, or updates the expiry of an existing one
+func ensureTtlIndex(ctx context.Context, col *mongo.Collection, field string, expireAfter time.Duration) error {
+	seconds := int32(expireAfter.Seconds())
+	name := field + "_ttl"
+	_, err := col.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: field, Value: 1}},
+		Options: options.Index().SetName(name).SetExpireAfterSeconds(seconds),
+	})
+	if err == nil {
+		return nil
+	}
+	var cmdErr mongo.CommandError
+	if !errors.As(err, &cmdErr) || (cmdErr.Name != "IndexOptionsConflict" && cmdErr.Name != "IndexKeySpecsConflict") {
+		return err
+	}
+	return col.Database().RunCommand(ctx, bson.D{
+		{Key: "collMod", Value: col.Name()},
+		{Key: "index", Value: bson.D{
+			{Key: "name", Value: name},
+			{Key: "expireAfterSeconds", Value: seconds},
+		}},
+	}).Err()
 }
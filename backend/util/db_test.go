@@ -0,0 +1,15 @@
+package util
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestMongoRetryDelay(t *testing.T) {
+	assert.Equal(t, time.Second, mongoRetryDelay(1))
+	assert.Equal(t, 2*time.Second, mongoRetryDelay(2))
+	assert.Equal(t, 16*time.Second, mongoRetryDelay(5))
+	assert.Equal(t, 30*time.Second, mongoRetryDelay(6))
+	assert.Equal(t, 30*time.Second, mongoRetryDelay(100))
+}
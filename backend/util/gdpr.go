@@ -0,0 +1,42 @@
+package util
+
+import "time"
+
+const (
+	IssueTypeRequest  = "request"
+	IssueTypeDeletion = "deletion"
+)
+
+const (
+	// IssueStatusPending is a data request waiting to be processed, or a deletion waiting for approval or its cooling-off period
+	IssueStatusPending    = "pending"
+	IssueStatusProcessing = "processing"
+	IssueStatusCompleted  = "completed"
+	IssueStatusFailed     = "failed"
+	IssueStatusRejected   = "rejected"
+	IssueStatusCancelled  = "cancelled"
+	// IssueStatusLegacy is for issues created before they were processed automatically, these are handled by hand
+	IssueStatusLegacy = "legacy"
+)
+
+// DeletedUsername is the tombstone user that gifs of deleted users are reassigned to if they choose to keep their posts
+const DeletedUsername = "deleted_user"
+
+// Issue is a GDPR data or deletion request
+type Issue struct {
+	Id        string    `json:"id" bson:"_id"`
+	Type      string    `json:"type" bson:"type"`
+	Username  string    `json:"username" bson:"username"`
+	KeepPosts bool      `json:"keepPosts" bson:"keepPosts"`
+	Note      string    `json:"note" bson:"note"`
+	Status    string    `json:"status" bson:"status"`
+	CreatedAt time.Time `json:"createdAt" bson:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt" bson:"updatedAt"`
+	// ExecuteAfter is when a pending deletion is carried out, unless it is approved sooner
+	ExecuteAfter *time.Time `json:"executeAfter,omitempty" bson:"executeAfter,omitempty"`
+	// ResolvedBy is the admin that approved or rejected the issue
+	ResolvedBy *string `json:"resolvedBy,omitempty" bson:"resolvedBy,omitempty"`
+	// ExportExpiresAt is when the data export is deleted, the export is stored in ExportsBucket with the issue's ID
+	ExportExpiresAt *time.Time `json:"exportExpiresAt,omitempty" bson:"exportExpiresAt,omitempty"`
+	Error           *string    `json:"error,omitempty" bson:"error,omitempty"`
+}
@@ -24,6 +24,11 @@ func GetUser(c *gin.Context) *User {
 // CheckPassword checks if a password is correct, returns true if it is and false if it isn't and also sets the
 // appropriate status code and error message
 func CheckPassword(c *gin.Context, password, hash string) bool {
+	// users that only sign in with identity providers don't have a password
+	if hash == "" {
+		c.JSON(401, ErrorStr("the account has no password"))
+		return false
+	}
 	if match, err := argon2id.ComparePasswordAndHash(password, hash); !match || err != nil {
 		if err != nil {
 			c.JSON(500, Error(err))
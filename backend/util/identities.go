@@ -0,0 +1,51 @@
+package util
+
+import (
+	"context"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// createIdentityIndex creates the unique index on the identities of users.
+// The identities are indexed as whole documents, a compound index on their fields would also pair the provider
+// of one identity with the subject of another.
+// Users without identities must not have the field at all, every empty array has the same index key
+func createIdentityIndex(ctx context.Context) error {
+	TRUE := true
+	_, err := UsersCol.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "identities", Value: 1}},
+		Options: &options.IndexOptions{
+			Unique:                  &TRUE,
+			PartialFilterExpression: bson.M{"identities": bson.M{"$exists": true}},
+		},
+	})
+	return err
+}
+
+// UnlinkIdentity removes the identity of the provider from the user, unless it is their only way to sign in,
+// the user must be left with either a password or another identity.
+// Returns false if the user doesn't have the identity or has no other way to sign in
+func UnlinkIdentity(ctx context.Context, username string, provider string) (bool, error) {
+	res, err := UsersCol.UpdateOne(ctx, bson.M{
+		"_id":                 username,
+		"identities.provider": provider,
+		"$or": bson.A{
+			bson.M{"passwordHash": bson.M{"$nin": bson.A{"", nil}}},
+			bson.M{"identities.1": bson.M{"$exists": true}},
+		},
+	}, bson.A{
+		bson.M{"$set": bson.M{"identities": bson.M{"$filter": bson.M{
+			"input": "$identities",
+			"cond":  bson.M{"$ne": bson.A{"$$this.provider", provider}},
+		}}}},
+		// removing the last identity unsets the field, so it isn't in the unique index
+		bson.M{"$set": bson.M{"identities": bson.M{"$cond": bson.A{
+			bson.M{"$eq": bson.A{bson.M{"$size": "$identities"}, 0}}, "$$REMOVE", "$identities",
+		}}}},
+	})
+	if err != nil {
+		return false, err
+	}
+	return res.MatchedCount != 0, nil
+}
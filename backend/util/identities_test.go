@@ -0,0 +1,57 @@
+package util
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"os"
+	"testing"
+	"time"
+)
+
+// TestUnlinkLastIdentity needs a MongoDB server, set KITTYGIFS_TEST_MONGO_URL to run it
+func TestUnlinkLastIdentity(t *testing.T) {
+	url := os.Getenv("KITTYGIFS_TEST_MONGO_URL")
+	if url == "" {
+		t.Skip("KITTYGIFS_TEST_MONGO_URL not set")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(url))
+	require.NoError(t, err)
+	defer client.Disconnect(ctx)
+	db := client.Database("kittygifs_test_" + NewUlid())
+	defer db.Drop(ctx)
+	previous := UsersCol
+	UsersCol = db.Collection("users")
+	defer func() { UsersCol = previous }()
+	require.NoError(t, createIdentityIndex(ctx))
+
+	for _, username := range []string{"kitty", "cat"} {
+		_, err = UsersCol.InsertOne(ctx, User{
+			Username:     username,
+			PasswordHash: "hash",
+			Identities:   []Identity{{Provider: "logto", Subject: username}},
+		})
+		require.NoError(t, err)
+	}
+	// both users end up without identities, which must not conflict in the unique index
+	for _, username := range []string{"kitty", "cat"} {
+		unlinked, err := UnlinkIdentity(ctx, username, "logto")
+		require.NoError(t, err)
+		assert.True(t, unlinked)
+		count, err := UsersCol.CountDocuments(ctx, bson.M{"_id": username, "identities": bson.M{"$exists": true}})
+		require.NoError(t, err)
+		assert.Zero(t, count)
+	}
+
+	// the only way to sign in can't be unlinked
+	_, err = UsersCol.InsertOne(ctx, User{Username: "sso", Identities: []Identity{{Provider: "logto", Subject: "sso"}}})
+	require.NoError(t, err)
+	unlinked, err := UnlinkIdentity(ctx, "sso", "logto")
+	require.NoError(t, err)
+	assert.False(t, unlinked)
+}
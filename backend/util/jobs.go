@@ -0,0 +1,88 @@
+package util
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	JobPending = "pending"
+	JobOk      = "ok"
+	JobFailing = "failing"
+	// JobStale is a job that hasn't succeeded for more than two of its intervals
+	JobStale = "stale"
+)
+
+// JobStatus is the status of a background job, reported by /readyz
+type JobStatus struct {
+	Name            string     `json:"name"`
+	Status          string     `json:"status"`
+	IntervalSeconds float64    `json:"intervalSeconds"`
+	LastRunAt       *time.Time `json:"lastRunAt,omitempty"`
+	LastSuccessAt   *time.Time `json:"lastSuccessAt,omitempty"`
+	LastError       string     `json:"lastError,omitempty"`
+	registeredAt    time.Time
+}
+
+var (
+	jobsMutex sync.Mutex
+	jobs      = make(map[string]*JobStatus)
+)
+
+// RegisterJob adds a background job that runs every interval to the reported jobs
+func RegisterJob(name string, interval time.Duration) {
+	jobsMutex.Lock()
+	defer jobsMutex.Unlock()
+	jobs[name] = &JobStatus{Name: name, IntervalSeconds: interval.Seconds(), registeredAt: time.Now()}
+}
+
+// RecordJobRun records the result of a run of a registered job
+func RecordJobRun(name string, err error) {
+	jobsMutex.Lock()
+	defer jobsMutex.Unlock()
+	job, ok := jobs[name]
+	if !ok {
+		return
+	}
+	now := time.Now()
+	job.LastRunAt = &now
+	if err != nil {
+		job.LastError = err.Error()
+	} else {
+		job.LastSuccessAt = &now
+		job.LastError = ""
+	}
+}
+
+// JobStatuses gets the status of all registered jobs, sorted by name
+func JobStatuses() []JobStatus {
+	jobsMutex.Lock()
+	defer jobsMutex.Unlock()
+	statuses := make([]JobStatus, 0, len(jobs))
+	now := time.Now()
+	for _, job := range jobs {
+		status := *job
+		status.Status = job.status(now)
+		statuses = append(statuses, status)
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Name < statuses[j].Name })
+	return statuses
+}
+
+func (job *JobStatus) status(now time.Time) string {
+	since := job.registeredAt
+	if job.LastSuccessAt != nil {
+		since = *job.LastSuccessAt
+	}
+	if now.Sub(since).Seconds() > 2*job.IntervalSeconds {
+		return JobStale
+	}
+	if job.LastRunAt == nil {
+		return JobPending
+	}
+	if job.LastError != "" {
+		return JobFailing
+	}
+	return JobOk
+}
@@ -0,0 +1,45 @@
+package util
+
+import (
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestJobStatus(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	job := &JobStatus{IntervalSeconds: time.Hour.Seconds(), registeredAt: start}
+	assert.Equal(t, JobPending, job.status(start.Add(time.Hour)))
+	assert.Equal(t, JobStale, job.status(start.Add(3*time.Hour)))
+
+	ran := start.Add(time.Hour)
+	job.LastRunAt = &ran
+	job.LastError = "timeout"
+	assert.Equal(t, JobFailing, job.status(ran))
+
+	job.LastSuccessAt = &ran
+	job.LastError = ""
+	assert.Equal(t, JobOk, job.status(ran.Add(90*time.Minute)))
+	assert.Equal(t, JobStale, job.status(ran.Add(3*time.Hour)))
+}
+
+func TestRecordJobRun(t *testing.T) {
+	RegisterJob("test", time.Minute)
+	defer func() {
+		jobsMutex.Lock()
+		delete(jobs, "test")
+		jobsMutex.Unlock()
+	}()
+	RecordJobRun("test", errors.New("failed"))
+	RecordJobRun("unregistered", nil)
+	statuses := JobStatuses()
+	assert.Len(t, statuses, 1)
+	assert.Equal(t, JobFailing, statuses[0].Status)
+	assert.Equal(t, "failed", statuses[0].LastError)
+	assert.Nil(t, statuses[0].LastSuccessAt)
+
+	RecordJobRun("test", nil)
+	assert.Equal(t, JobOk, JobStatuses()[0].Status)
+	assert.Empty(t, JobStatuses()[0].LastError)
+}
@@ -0,0 +1,153 @@
+package util
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"slices"
+	"strconv"
+)
+
+// JsonSchema is the subset of JSON Schema used to validate sync namespaces,
+// other keywords are ignored and additionalProperties can only be a boolean
+type JsonSchema struct {
+	// Type is a type name or an array of them
+	Type                 interface{}            `json:"type"`
+	Properties           map[string]*JsonSchema `json:"properties"`
+	Required             []string               `json:"required"`
+	AdditionalProperties *bool                  `json:"additionalProperties"`
+	Items                *JsonSchema            `json:"items"`
+	Enum                 []interface{}          `json:"enum"`
+	Minimum              *float64               `json:"minimum"`
+	Maximum              *float64               `json:"maximum"`
+	MinLength            *int                   `json:"minLength"`
+	MaxLength            *int                   `json:"maxLength"`
+	MaxItems             *int                   `json:"maxItems"`
+}
+
+var jsonSchemaTypes = []string{"object", "array", "string", "number", "integer", "boolean", "null"}
+
+// Check returns an error if the schema uses an unknown type
+func (schema *JsonSchema) Check() error {
+	types, err := schema.types()
+	if err != nil {
+		return err
+	}
+	for _, t := range types {
+		if !slices.Contains(jsonSchemaTypes, t) {
+			return errors.New("unknown type " + t)
+		}
+	}
+	for _, property := range schema.Properties {
+		if err := property.Check(); err != nil {
+			return err
+		}
+	}
+	if schema.Items != nil {
+		return schema.Items.Check()
+	}
+	return nil
+}
+
+// Validate checks a value decoded from JSON against the schema, the error includes the path of the invalid value
+func (schema *JsonSchema) Validate(value interface{}) error {
+	return schema.validate("$", value)
+}
+
+func (schema *JsonSchema) types() ([]string, error) {
+	switch t := schema.Type.(type) {
+	case nil:
+		return nil, nil
+	case string:
+		return []string{t}, nil
+	case []interface{}:
+		types := make([]string, 0, len(t))
+		for _, item := range t {
+			name, ok := item.(string)
+			if !ok {
+				return nil, errors.New("type must be a string or an array of strings")
+			}
+			types = append(types, name)
+		}
+		return types, nil
+	}
+	return nil, errors.New("type must be a string or an array of strings")
+}
+
+func (schema *JsonSchema) validate(path string, value interface{}) error {
+	types, err := schema.types()
+	if err != nil {
+		return err
+	}
+	if len(types) != 0 && !slices.ContainsFunc(types, func(t string) bool { return jsonTypeMatches(t, value) }) {
+		return fmt.Errorf("%s must be of type %v", path, schema.Type)
+	}
+	if len(schema.Enum) != 0 && !slices.ContainsFunc(schema.Enum, func(e interface{}) bool { return reflect.DeepEqual(e, value) }) {
+		return fmt.Errorf("%s must be one of %v", path, schema.Enum)
+	}
+	switch value := value.(type) {
+	case map[string]interface{}:
+		for _, name := range schema.Required {
+			if _, ok := value[name]; !ok {
+				return fmt.Errorf("%s.%s is required", path, name)
+			}
+		}
+		for name, property := range value {
+			propertySchema, ok := schema.Properties[name]
+			if !ok {
+				if schema.AdditionalProperties != nil && !*schema.AdditionalProperties {
+					return fmt.Errorf("%s.%s is not allowed", path, name)
+				}
+				continue
+			}
+			if err := propertySchema.validate(path+"."+name, property); err != nil {
+				return err
+			}
+		}
+	case []interface{}:
+		if schema.MaxItems != nil && len(value) > *schema.MaxItems {
+			return fmt.Errorf("%s must have at most %d items", path, *schema.MaxItems)
+		}
+		if schema.Items != nil {
+			for i, item := range value {
+				if err := schema.Items.validate(path+"["+strconv.Itoa(i)+"]", item); err != nil {
+					return err
+				}
+			}
+		}
+	case string:
+		length := len([]rune(value))
+		if schema.MinLength != nil && length < *schema.MinLength {
+			return fmt.Errorf("%s must be at least %d characters long", path, *schema.MinLength)
+		}
+		if schema.MaxLength != nil && length > *schema.MaxLength {
+			return fmt.Errorf("%s must be at most %d characters long", path, *schema.MaxLength)
+		}
+	case float64:
+		if schema.Minimum != nil && value < *schema.Minimum {
+			return fmt.Errorf("%s must be at least %v", path, *schema.Minimum)
+		}
+		if schema.Maximum != nil && value > *schema.Maximum {
+			return fmt.Errorf("%s must be at most %v", path, *schema.Maximum)
+		}
+	}
+	return nil
+}
+
+func jsonTypeMatches(t string, value interface{}) bool {
+	switch value := value.(type) {
+	case map[string]interface{}:
+		return t == "object"
+	case []interface{}:
+		return t == "array"
+	case string:
+		return t == "string"
+	case float64:
+		return t == "number" || (t == "integer" && value == float64(int64(value)))
+	case bool:
+		return t == "boolean"
+	case nil:
+		return t == "null"
+	}
+	return false
+}
@@ -0,0 +1,52 @@
+package util
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestJsonSchema(t *testing.T) {
+	var schema JsonSchema
+	require.NoError(t, json.Unmarshal([]byte(`{
+		"type": "object",
+		"required": ["limit"],
+		"additionalProperties": false,
+		"properties": {
+			"limit": {"type": "integer", "minimum": 1, "maximum": 100},
+			"theme": {"enum": ["light", "dark"]},
+			"prefix": {"type": ["string", "null"], "maxLength": 3},
+			"tags": {"type": "array", "maxItems": 2, "items": {"type": "string"}}
+		}
+	}`), &schema))
+	require.NoError(t, schema.Check())
+
+	for value, valid := range map[string]bool{
+		`{"limit": 10}`:                          true,
+		`{"limit": 10, "theme": "dark"}`:         true,
+		`{"limit": 10, "prefix": null}`:          true,
+		`{"limit": 10, "tags": ["a", "b"]}`:      true,
+		`{}`:                                     false,
+		`[]`:                                     false,
+		`{"limit": 1.5}`:                         false,
+		`{"limit": 0}`:                           false,
+		`{"limit": 10, "theme": "blue"}`:         false,
+		`{"limit": 10, "prefix": "long"}`:        false,
+		`{"limit": 10, "tags": ["a", "b", "c"]}`: false,
+		`{"limit": 10, "tags": [1]}`:             false,
+		`{"limit": 10, "other": true}`:           false,
+	} {
+		var decoded interface{}
+		require.NoError(t, json.Unmarshal([]byte(value), &decoded))
+		if valid {
+			assert.NoError(t, schema.Validate(decoded), value)
+		} else {
+			assert.Error(t, schema.Validate(decoded), value)
+		}
+	}
+
+	err := schema.Validate(map[string]interface{}{"limit": float64(10), "tags": []interface{}{"a", true}})
+	assert.EqualError(t, err, "$.tags[1] must be of type string")
+	assert.Error(t, (&JsonSchema{Type: "text"}).Check())
+}
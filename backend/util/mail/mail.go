@@ -0,0 +1,114 @@
+package mail
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	. "kittygifs/util"
+	"log"
+	"net"
+	netMail "net/mail"
+	"net/smtp"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer sends emails
+type Mailer interface {
+	Send(ctx context.Context, message Message) error
+}
+
+// New returns an SMTP mailer if SMTP is configured, otherwise nil
+func New(config *Configuration) Mailer {
+	if config.Smtp == nil {
+		return nil
+	}
+	return &SmtpMailer{Config: config.Smtp}
+}
+
+type SmtpMailer struct {
+	Config *SmtpConfiguration
+}
+
+func (mailer *SmtpMailer) Send(ctx context.Context, message Message) error {
+	body, err := buildMessage(mailer.Config.From, message)
+	if err != nil {
+		return err
+	}
+	var auth smtp.Auth
+	if mailer.Config.Username != "" {
+		auth = smtp.PlainAuth("", mailer.Config.Username, mailer.Config.Password, mailer.Config.Host)
+	}
+	from, err := netMail.ParseAddress(mailer.Config.From)
+	if err != nil {
+		return err
+	}
+	// smtp.SendMail doesn't take a context, so it's abandoned instead of cancelled
+	done := make(chan error, 1)
+	go func() {
+		done <- smtp.SendMail(net.JoinHostPort(mailer.Config.Host, fmt.Sprint(mailer.Config.Port)), auth,
+			from.Address, []string{message.To}, body)
+	}()
+	select {
+	case err = <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// LocalMailer keeps sent messages in memory instead of sending them, for tests and development
+type LocalMailer struct {
+	// Log also logs the messages
+	Log      bool
+	mutex    sync.Mutex
+	messages []Message
+}
+
+func (mailer *LocalMailer) Send(ctx context.Context, message Message) error {
+	if _, err := buildMessage("kittygifs <local@localhost>", message); err != nil {
+		return err
+	}
+	mailer.mutex.Lock()
+	defer mailer.mutex.Unlock()
+	mailer.messages = append(mailer.messages, message)
+	if mailer.Log {
+		log.Printf("Mail to %s: %s\n%s\n", message.To, message.Subject, message.Body)
+	}
+	return nil
+}
+
+// Messages returns the messages sent so far
+func (mailer *LocalMailer) Messages() []Message {
+	mailer.mutex.Lock()
+	defer mailer.mutex.Unlock()
+	return append([]Message{}, mailer.messages...)
+}
+
+var ErrInvalidHeader = errors.New("invalid characters in mail header")
+
+// buildMessage builds the message with headers, rejecting header values that would inject other headers
+func buildMessage(from string, message Message) ([]byte, error) {
+	for _, value := range []string{from, message.To, message.Subject} {
+		if strings.ContainsAny(value, "\r\n") {
+			return nil, ErrInvalidHeader
+		}
+	}
+	var builder strings.Builder
+	builder.WriteString("From: " + from + "\r\n")
+	builder.WriteString("To: " + message.To + "\r\n")
+	builder.WriteString("Subject: " + message.Subject + "\r\n")
+	builder.WriteString("Date: " + time.Now().Format(time.RFC1123Z) + "\r\n")
+	builder.WriteString("MIME-Version: 1.0\r\n")
+	builder.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	builder.WriteString("\r\n")
+	builder.WriteString(strings.ReplaceAll(strings.ReplaceAll(message.Body, "\r\n", "\n"), "\n", "\r\n"))
+	return []byte(builder.String()), nil
+}
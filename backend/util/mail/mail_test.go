@@ -0,0 +1,30 @@
+package mail
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+)
+
+func TestBuildMessage(t *testing.T) {
+	body, err := buildMessage("kittygifs <noreply@example.com>", Message{
+		To:      "user@example.com",
+		Subject: "Reset your password",
+		Body:    "line 1\nline 2",
+	})
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(string(body), "From: kittygifs <noreply@example.com>\r\nTo: user@example.com\r\n"))
+	assert.True(t, strings.HasSuffix(string(body), "\r\n\r\nline 1\r\nline 2"))
+
+	_, err = buildMessage("noreply@example.com", Message{To: "user@example.com\r\nBcc: other@example.com"})
+	assert.ErrorIs(t, err, ErrInvalidHeader)
+}
+
+func TestLocalMailer(t *testing.T) {
+	mailer := &LocalMailer{}
+	assert.NoError(t, mailer.Send(context.Background(), Message{To: "user@example.com", Subject: "hi"}))
+	assert.Error(t, mailer.Send(context.Background(), Message{To: "user@example.com", Subject: "hi\nBcc: x"}))
+	assert.Len(t, mailer.Messages(), 1)
+	assert.Equal(t, "user@example.com", mailer.Messages()[0].To)
+}
@@ -0,0 +1,26 @@
+package metrics
+
+var (
+	HttpRequests = NewCounter("kittygifs_http_requests_total",
+		"Number of HTTP requests by route template and status.", "method", "route", "status")
+	HttpRequestDuration = NewHistogram("kittygifs_http_request_duration_seconds",
+		"Duration of HTTP requests by route template, streams are included until they are closed.",
+		DefaultBuckets, "method", "route")
+	MongoCommandDuration = NewHistogram("kittygifs_mongo_command_duration_seconds",
+		"Duration of MongoDB commands.", DefaultBuckets, "command")
+	MongoCommandFailures = NewCounter("kittygifs_mongo_command_failures_total",
+		"Number of MongoDB commands that failed.", "command")
+	TenorFetchFailures = NewCounter("kittygifs_tenor_fetch_failures_total",
+		"Number of failed Tenor page fetches for gif previews, by reason (request or parse).", "reason")
+	TagCountDuration = NewGauge("kittygifs_tag_count_duration_seconds",
+		"Duration of the last tag count update.")
+	TagCountDrift = NewGauge("kittygifs_tag_count_drift",
+		"Number of tags whose stored count was wrong, added or removed by the last tag count update.")
+	TagCountLastSuccess = NewGauge("kittygifs_tag_count_last_success_timestamp_seconds",
+		"Unix time of the last successful tag count update.")
+	NotificationFanout = NewHistogram("kittygifs_notification_fanout_recipients",
+		"Number of users a group notification was sent to.",
+		[]float64{1, 2, 5, 10, 25, 50, 100, 250, 500, 1000}, "type")
+	RateLimitRejections = NewCounter("kittygifs_rate_limit_rejections_total",
+		"Number of requests rejected by rate limits.", "route")
+)
@@ -0,0 +1,253 @@
+package metrics
+
+import (
+	"bufio"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultBuckets are the histogram buckets for durations in seconds
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Metric is written in the Prometheus text format
+type Metric interface {
+	Name() string
+	write(w *bufio.Writer)
+}
+
+// Registry is a set of metrics written together
+type Registry struct {
+	mu      sync.Mutex
+	metrics []Metric
+}
+
+// DefaultRegistry has all the metrics created with the New functions
+var DefaultRegistry = &Registry{}
+
+func (registry *Registry) Register(metric Metric) {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	registry.metrics = append(registry.metrics, metric)
+}
+
+// Write writes all metrics in the Prometheus text exposition format, sorted by name
+func (registry *Registry) Write(w io.Writer) error {
+	registry.mu.Lock()
+	metrics := make([]Metric, len(registry.metrics))
+	copy(metrics, registry.metrics)
+	registry.mu.Unlock()
+	sort.Slice(metrics, func(i, j int) bool { return metrics[i].Name() < metrics[j].Name() })
+	writer := bufio.NewWriter(w)
+	for _, metric := range metrics {
+		metric.write(writer)
+	}
+	return writer.Flush()
+}
+
+// family has the name, help and label names shared by all types of metrics
+type family struct {
+	name   string
+	help   string
+	labels []string
+}
+
+func (f *family) Name() string {
+	return f.name
+}
+
+func (f *family) writeHeader(w *bufio.Writer, metricType string) {
+	w.WriteString("# HELP " + f.name + " " + strings.ReplaceAll(f.help, "\n", " ") + "\n")
+	w.WriteString("# TYPE " + f.name + " " + metricType + "\n")
+}
+
+// key joins label values, it is split again when writing
+func (f *family) key(labelValues []string) string {
+	if len(labelValues) != len(f.labels) {
+		panic("metric " + f.name + " has " + strconv.Itoa(len(f.labels)) + " labels")
+	}
+	return strings.Join(labelValues, "\x00")
+}
+
+// labelString formats the labels of a series, with extra label pairs appended
+func (f *family) labelString(key string, extra ...string) string {
+	var pairs []string
+	if len(f.labels) != 0 {
+		for i, value := range strings.Split(key, "\x00") {
+			pairs = append(pairs, f.labels[i]+`="`+escapeLabel(value)+`"`)
+		}
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, extra[i]+`="`+escapeLabel(extra[i+1])+`"`)
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func escapeLabel(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+func formatFloat(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+func sortedKeys[T any](values map[string]T) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Counter is a value that only goes up, for each combination of label values
+type Counter struct {
+	family
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+func NewCounter(name, help string, labels ...string) *Counter {
+	counter := &Counter{family: family{name, help, labels}, values: make(map[string]float64)}
+	DefaultRegistry.Register(counter)
+	return counter
+}
+
+func (counter *Counter) Inc(labelValues ...string) {
+	counter.Add(1, labelValues...)
+}
+
+func (counter *Counter) Add(value float64, labelValues ...string) {
+	key := counter.key(labelValues)
+	counter.mu.Lock()
+	defer counter.mu.Unlock()
+	counter.values[key] += value
+}
+
+func (counter *Counter) write(w *bufio.Writer) {
+	counter.writeHeader(w, "counter")
+	counter.mu.Lock()
+	defer counter.mu.Unlock()
+	for _, key := range sortedKeys(counter.values) {
+		w.WriteString(counter.name + counter.labelString(key) + " " + formatFloat(counter.values[key]) + "\n")
+	}
+}
+
+// Gauge is a value that can go up and down, for each combination of label values
+type Gauge struct {
+	family
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+func NewGauge(name, help string, labels ...string) *Gauge {
+	gauge := &Gauge{family: family{name, help, labels}, values: make(map[string]float64)}
+	DefaultRegistry.Register(gauge)
+	return gauge
+}
+
+func (gauge *Gauge) Set(value float64, labelValues ...string) {
+	key := gauge.key(labelValues)
+	gauge.mu.Lock()
+	defer gauge.mu.Unlock()
+	gauge.values[key] = value
+}
+
+func (gauge *Gauge) write(w *bufio.Writer) {
+	gauge.writeHeader(w, "gauge")
+	gauge.mu.Lock()
+	defer gauge.mu.Unlock()
+	for _, key := range sortedKeys(gauge.values) {
+		w.WriteString(gauge.name + gauge.labelString(key) + " " + formatFloat(gauge.values[key]) + "\n")
+	}
+}
+
+// GaugeFunc is a gauge without labels whose value is got when the metrics are written,
+// the gauge is left out if the function returns an error
+type GaugeFunc struct {
+	family
+	fn func() (float64, error)
+}
+
+func NewGaugeFunc(name, help string, fn func() (float64, error)) *GaugeFunc {
+	gauge := &GaugeFunc{family: family{name: name, help: help}, fn: fn}
+	DefaultRegistry.Register(gauge)
+	return gauge
+}
+
+func (gauge *GaugeFunc) write(w *bufio.Writer) {
+	value, err := gauge.fn()
+	if err != nil {
+		return
+	}
+	gauge.writeHeader(w, "gauge")
+	w.WriteString(gauge.name + " " + formatFloat(value) + "\n")
+}
+
+// Histogram counts observed values in buckets, for each combination of label values
+type Histogram struct {
+	family
+	buckets []float64
+	mu      sync.Mutex
+	values  map[string]*histogramValue
+}
+
+type histogramValue struct {
+	// counts are not cumulative, they are summed when writing
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+// NewHistogram creates a histogram with the upper bounds of the buckets in increasing order
+func NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	histogram := &Histogram{
+		family:  family{name, help, labels},
+		buckets: buckets,
+		values:  make(map[string]*histogramValue),
+	}
+	DefaultRegistry.Register(histogram)
+	return histogram
+}
+
+func (histogram *Histogram) Observe(value float64, labelValues ...string) {
+	key := histogram.key(labelValues)
+	histogram.mu.Lock()
+	defer histogram.mu.Unlock()
+	series, ok := histogram.values[key]
+	if !ok {
+		series = &histogramValue{counts: make([]uint64, len(histogram.buckets))}
+		histogram.values[key] = series
+	}
+	i := sort.SearchFloat64s(histogram.buckets, value)
+	if i < len(histogram.buckets) {
+		series.counts[i]++
+	}
+	series.sum += value
+	series.count++
+}
+
+func (histogram *Histogram) write(w *bufio.Writer) {
+	histogram.writeHeader(w, "histogram")
+	histogram.mu.Lock()
+	defer histogram.mu.Unlock()
+	for _, key := range sortedKeys(histogram.values) {
+		series := histogram.values[key]
+		var cumulative uint64
+		for i, bound := range histogram.buckets {
+			cumulative += series.counts[i]
+			w.WriteString(histogram.name + "_bucket" + histogram.labelString(key, "le", formatFloat(bound)) + " " +
+				strconv.FormatUint(cumulative, 10) + "\n")
+		}
+		w.WriteString(histogram.name + "_bucket" + histogram.labelString(key, "le", "+Inf") + " " +
+			strconv.FormatUint(series.count, 10) + "\n")
+		w.WriteString(histogram.name + "_sum" + histogram.labelString(key) + " " + formatFloat(series.sum) + "\n")
+		w.WriteString(histogram.name + "_count" + histogram.labelString(key) + " " +
+			strconv.FormatUint(series.count, 10) + "\n")
+	}
+}
@@ -0,0 +1,48 @@
+package metrics
+
+import (
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"strings"
+	"testing"
+)
+
+func TestWriteTo(t *testing.T) {
+	registry := &Registry{}
+	counter := &Counter{family: family{"test_requests_total", "Requests.", []string{"route"}}, values: map[string]float64{}}
+	histogram := &Histogram{
+		family:  family{"test_duration_seconds", "Duration.", nil},
+		buckets: []float64{0.1, 1},
+		values:  map[string]*histogramValue{},
+	}
+	gauge := &GaugeFunc{family: family{name: "test_sessions", help: "Sessions."}, fn: func() (float64, error) { return 3, nil }}
+	failing := &GaugeFunc{family: family{name: "test_failing"}, fn: func() (float64, error) { return 0, errors.New("failed") }}
+	for _, metric := range []Metric{counter, histogram, gauge, failing} {
+		registry.Register(metric)
+	}
+	counter.Inc("/gifs/:id")
+	counter.Add(2, `/"quoted"`)
+	histogram.Observe(0.05)
+	histogram.Observe(0.1)
+	histogram.Observe(5)
+
+	var out strings.Builder
+	require.NoError(t, registry.Write(&out))
+	assert.Equal(t, `# HELP test_duration_seconds Duration.
+# TYPE test_duration_seconds histogram
+test_duration_seconds_bucket{le="0.1"} 2
+test_duration_seconds_bucket{le="1"} 2
+test_duration_seconds_bucket{le="+Inf"} 3
+test_duration_seconds_sum 5.15
+test_duration_seconds_count 3
+# HELP test_requests_total Requests.
+# TYPE test_requests_total counter
+test_requests_total{route="/\"quoted\""} 2
+test_requests_total{route="/gifs/:id"} 1
+# HELP test_sessions Sessions.
+# TYPE test_sessions gauge
+test_sessions 3
+`, out.String())
+	assert.Panics(t, func() { counter.Inc() })
+}
@@ -0,0 +1,253 @@
+package util
+
+import (
+	"context"
+	"errors"
+	"github.com/oklog/ulid/v2"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"log"
+	"time"
+)
+
+type Migration struct {
+	Name string
+	Run  func(ctx context.Context, config *Configuration) error
+}
+
+// Migrations are run in order, the index of the last run migration + 1 is stored as the migration version,
+// so migrations must only ever be appended
+var Migrations = []Migration{
+	{"hash session tokens", migrateHashSessionTokens},
+	{"issue IDs and status", migrateIssues},
+	{"user identities", migrateUserIdentities},
+	{"notification timestamps", migrateNotificationTimestamps},
+	{"issue discord webhook", migrateIssueDiscordWebhook},
+	{"sync settings versions", migrateSyncSettingsVersions},
+	{"sync namespaces", migrateSyncNamespaces},
+	{"empty user identities", migrateEmptyIdentities},
+	{"tombstone user", migrateTombstoneUser},
+}
+
+// GetMigrationVersion gets the number of migrations that have been run on the database
+func GetMigrationVersion(ctx context.Context) (int, error) {
+	var doc struct {
+		Version int `bson:"version"`
+	}
+	err := MiscCol.FindOne(ctx, bson.M{"_id": "migrations"}).Decode(&doc)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return 0, nil
+	}
+	return doc.Version, err
+}
+
+// RunMigrations runs all migrations that haven't been run yet
+func RunMigrations(ctx context.Context, config *Configuration) error {
+	version, err := GetMigrationVersion(ctx)
+	if err != nil {
+		return err
+	}
+	TRUE := true
+	for i := version; i < len(Migrations); i++ {
+		log.Println("Running migration:", Migrations[i].Name)
+		err = Migrations[i].Run(ctx, config)
+		if err != nil {
+			return errors.New("migration " + Migrations[i].Name + " failed: " + err.Error())
+		}
+		_, err = MiscCol.UpdateOne(ctx, bson.M{"_id": "migrations"}, bson.M{"$set": bson.M{"version": i + 1}},
+			&options.UpdateOptions{Upsert: &TRUE})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// migrateHashSessionTokens replaces the raw session tokens used as IDs with their hashes.
+// The IDs are collected before any are replaced, so a cursor can't return the hashed sessions inserted here
+// and hash them again
+func migrateHashSessionTokens(ctx context.Context, config *Configuration) error {
+	ids, err := SessionsCol.Distinct(ctx, "_id", bson.M{})
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		token, ok := id.(string)
+		if !ok {
+			continue
+		}
+		var session bson.M
+		err = SessionsCol.FindOne(ctx, bson.M{"_id": token}).Decode(&session)
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		session["_id"] = config.HashToken(token)
+		_, err = SessionsCol.InsertOne(ctx, session)
+		if err != nil && !mongo.IsDuplicateKeyError(err) {
+			return err
+		}
+		_, err = SessionsCol.DeleteOne(ctx, bson.M{"_id": token})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// migrateIssues gives issues created before they were processed automatically ULIDs and the legacy status
+func migrateIssues(ctx context.Context, config *Configuration) error {
+	cur, err := IssuesCol.Find(ctx, bson.M{"_id": bson.M{"$type": "objectId"}})
+	if err != nil {
+		return err
+	}
+	for cur.Next(ctx) {
+		var issue bson.M
+		err = cur.Decode(&issue)
+		if err != nil {
+			return err
+		}
+		oldId := issue["_id"].(primitive.ObjectID)
+		createdAt := oldId.Timestamp()
+		issue["_id"] = ulid.MustNew(ulid.Timestamp(createdAt), entropy).String()
+		issue["status"] = IssueStatusLegacy
+		issue["createdAt"] = createdAt
+		issue["updatedAt"] = createdAt
+		_, err = IssuesCol.InsertOne(ctx, issue)
+		if err != nil {
+			return err
+		}
+		_, err = IssuesCol.DeleteOne(ctx, bson.M{"_id": oldId})
+		if err != nil {
+			return err
+		}
+	}
+	return cur.Err()
+}
+
+// migrateUserIdentities moves the Logto user IDs of users to their identities, in the field order of Identity
+// so the unique index on identities compares them correctly
+func migrateUserIdentities(ctx context.Context, config *Configuration) error {
+	_, err := UsersCol.UpdateMany(ctx, bson.M{"logtoId": bson.M{"$type": "string"}}, bson.A{
+		bson.M{"$set": bson.M{"identities": bson.A{bson.D{{Key: "provider", Value: "logto"}, {Key: "subject", Value: "$logtoId"}}}}},
+		bson.M{"$unset": "logtoId"},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = UsersCol.UpdateMany(ctx, bson.M{"logtoId": bson.M{"$exists": true}}, bson.M{"$unset": bson.M{"logtoId": ""}})
+	return err
+}
+
+// migrateNotificationTimestamps sets the creation time of notifications created before it was stored from their ULIDs
+func migrateNotificationTimestamps(ctx context.Context, config *Configuration) error {
+	cur, err := NotificationsCol.Find(ctx, bson.M{"createdAt": bson.M{"$exists": false}},
+		options.Find().SetProjection(bson.M{"_id": 1}))
+	if err != nil {
+		return err
+	}
+	for cur.Next(ctx) {
+		var notification struct {
+			Id string `bson:"_id"`
+		}
+		err = cur.Decode(&notification)
+		if err != nil {
+			return err
+		}
+		id, err := ulid.Parse(notification.Id)
+		if err != nil {
+			continue
+		}
+		_, err = NotificationsCol.UpdateOne(ctx, bson.M{"_id": notification.Id},
+			bson.M{"$set": bson.M{"createdAt": ulid.Time(id.Time())}})
+		if err != nil {
+			return err
+		}
+	}
+	return cur.Err()
+}
+
+// migrateIssueDiscordWebhook registers the deprecated issueDiscordWebhook as a webhook for GDPR requests
+// in the Discord format
+func migrateIssueDiscordWebhook(ctx context.Context, config *Configuration) error {
+	if config.IssueDiscordWebhook == nil || *config.IssueDiscordWebhook == "" {
+		return nil
+	}
+	_, err := WebhooksCol.InsertOne(ctx, bson.M{
+		"_id":         NewUlid(),
+		"url":         *config.IssueDiscordWebhook,
+		"secret":      GenerateRandomString(32),
+		"events":      bson.A{"gdprRequest.create"},
+		"format":      "discord",
+		"description": "migrated from issueDiscordWebhook",
+		"enabled":     true,
+		"createdBy":   "",
+		"createdAt":   time.Now(),
+	})
+	return err
+}
+
+// migrateSyncSettingsVersions sets the version of existing sync settings, so they can be updated with If-Match
+func migrateSyncSettingsVersions(ctx context.Context, config *Configuration) error {
+	_, err := SyncSettingsCol.UpdateMany(ctx, bson.M{"version": bson.M{"$exists": false}},
+		bson.M{"$set": bson.M{"version": 1, "updatedAt": time.Now()}})
+	return err
+}
+
+// migrateSyncNamespaces moves sync settings, which used the username as the ID, into the default namespace
+func migrateSyncNamespaces(ctx context.Context, config *Configuration) error {
+	cur, err := SyncSettingsCol.Find(ctx, bson.M{"namespace": bson.M{"$exists": false}})
+	if err != nil {
+		return err
+	}
+	for cur.Next(ctx) {
+		var settings bson.M
+		err = cur.Decode(&settings)
+		if err != nil {
+			return err
+		}
+		username, ok := settings["_id"].(string)
+		if !ok {
+			continue
+		}
+		settings["_id"] = NewUlid()
+		settings["username"] = username
+		settings["namespace"] = DefaultSyncNamespace
+		_, err = SyncSettingsCol.InsertOne(ctx, settings)
+		if err != nil {
+			return err
+		}
+		_, err = SyncSettingsCol.DeleteOne(ctx, bson.M{"_id": username})
+		if err != nil {
+			return err
+		}
+	}
+	if err = cur.Err(); err != nil {
+		return err
+	}
+	_, err = SyncHistoryCol.UpdateMany(ctx, bson.M{"namespace": bson.M{"$exists": false}},
+		bson.M{"$set": bson.M{"namespace": DefaultSyncNamespace}})
+	return err
+}
+
+// migrateEmptyIdentities unsets the identities of users whose last identity was unlinked,
+// so they aren't in the unique index on identities
+func migrateEmptyIdentities(ctx context.Context, config *Configuration) error {
+	_, err := UsersCol.UpdateMany(ctx, bson.M{"identities": bson.M{"$size": 0}}, bson.M{"$unset": bson.M{"identities": ""}})
+	return err
+}
+
+// migrateTombstoneUser marks the DeletedUsername user as the tombstone if it was created by deleting an account,
+// which gives it no way to sign in
+func migrateTombstoneUser(ctx context.Context, config *Configuration) error {
+	_, err := UsersCol.UpdateOne(ctx, bson.M{
+		"_id":          DeletedUsername,
+		"passwordHash": bson.M{"$in": bson.A{"", nil}},
+		"identities":   bson.M{"$exists": false},
+	}, bson.M{"$set": bson.M{"tombstone": true}})
+	return err
+}
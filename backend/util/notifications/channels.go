@@ -0,0 +1,326 @@
+package notifications
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	. "kittygifs/util"
+	"kittygifs/util/mail"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	ChannelInApp = "inApp"
+	// ChannelEmail collects notifications into a digest sent to the user's verified email address
+	ChannelEmail   = "email"
+	ChannelWebhook = "webhook"
+)
+
+// ChannelNames is a list of all channels
+var ChannelNames = []string{ChannelInApp, ChannelEmail, ChannelWebhook}
+
+// DefaultChannels are the channels of notification types the user hasn't set preferences for
+var DefaultChannels = []string{ChannelInApp}
+
+// Channel delivers notifications to users
+type Channel interface {
+	Deliver(ctx context.Context, user *User, notification Notification) error
+}
+
+// Dispatcher delivers notifications through the channels users chose for their types
+type Dispatcher struct {
+	Channels map[string]Channel
+}
+
+// DefaultDispatcher is used by NotifyUser and NotifyGroup
+var DefaultDispatcher = &Dispatcher{Channels: map[string]Channel{
+	ChannelInApp:   InAppChannel{},
+	ChannelEmail:   EmailDigestChannel{},
+	ChannelWebhook: &WebhookChannel{Sender: NewHttpWebhookSender()},
+}}
+
+// ChannelsFor returns the channels the user receives the notification type through
+func ChannelsFor(user *User, notificationType string) []string {
+	if user.NotificationPreferences != nil {
+		if channels, ok := user.NotificationPreferences.Channels[notificationType]; ok {
+			return channels
+		}
+	}
+	return DefaultChannels
+}
+
+// ValidatePreferences returns nil if the preferences only have known notification types and channels,
+// and a webhook URL if the webhook channel is used, otherwise returns an error
+func ValidatePreferences(preferences NotificationPreferences) error {
+	usesWebhook := false
+	for notificationType, channels := range preferences.Channels {
+		if !slices.Contains(NotificationTypes, notificationType) {
+			return errors.New("unknown notification type " + notificationType)
+		}
+		for i, channel := range channels {
+			if !slices.Contains(ChannelNames, channel) {
+				return errors.New("unknown channel " + channel)
+			}
+			if slices.Contains(channels[:i], channel) {
+				return errors.New("duplicate channel " + channel)
+			}
+			usesWebhook = usesWebhook || channel == ChannelWebhook
+		}
+	}
+	if preferences.WebhookUrl != "" {
+		if len(preferences.WebhookUrl) > 512 {
+			return errors.New("webhookUrl is too long(>512)")
+		}
+		webhookUrl, err := url.Parse(preferences.WebhookUrl)
+		if err != nil {
+			return errors.New("failed to parse webhookUrl: " + err.Error())
+		}
+		if (webhookUrl.Scheme != "https" && webhookUrl.Scheme != "http") || webhookUrl.Host == "" {
+			return errors.New("webhookUrl is not an http or https url")
+		}
+		// hostnames are checked when they're resolved by the sender, they can change what they resolve to
+		host := webhookUrl.Hostname()
+		if ip := net.ParseIP(host); (ip != nil && !isPublicIP(ip)) || strings.EqualFold(host, "localhost") {
+			return errors.New("webhookUrl must not be a private, loopback or link-local address")
+		}
+	} else if usesWebhook {
+		return errors.New("webhookUrl is required for the webhook channel")
+	}
+	return nil
+}
+
+// Dispatch delivers the notification through the user's channels for its type
+func (dispatcher *Dispatcher) Dispatch(ctx context.Context, user *User, notification Notification) error {
+	notificationType, _ := notification.Data["type"].(string)
+	for _, name := range ChannelsFor(user, notificationType) {
+		channel, ok := dispatcher.Channels[name]
+		if !ok {
+			continue
+		}
+		err := channel.Deliver(ctx, user, notification)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// InAppChannel stores notifications in NotificationsCol and streams them
+type InAppChannel struct{}
+
+func (InAppChannel) Deliver(ctx context.Context, user *User, notification Notification) error {
+	_, err := NotificationsCol.InsertOne(ctx, notification)
+	if err != nil {
+		return err
+	}
+	return publish(ctx, Event{Id: notification.Id, Username: user.Username, Type: EventCreated, Notification: &notification})
+}
+
+// EmailDigestChannel queues notifications in NotificationDigestCol until SendEmailDigests sends them,
+// users without a verified email address don't get them
+type EmailDigestChannel struct{}
+
+func (EmailDigestChannel) Deliver(ctx context.Context, user *User, notification Notification) error {
+	if user.Email == nil || !user.EmailVerified {
+		return nil
+	}
+	_, err := NotificationDigestCol.InsertOne(ctx, notification)
+	return err
+}
+
+// SendEmailDigests sends every user with queued notifications one email with all of them.
+// Notifications that fail to send stay queued for the next time
+func SendEmailDigests(ctx context.Context, mailer mail.Mailer, frontendUrl string) error {
+	cur, err := NotificationDigestCol.Find(ctx, bson.M{}, options.Find().SetSort(bson.M{"_id": 1}))
+	if err != nil {
+		return err
+	}
+	var queued []Notification
+	err = cur.All(ctx, &queued)
+	if err != nil {
+		return err
+	}
+	byUser := make(map[string][]Notification)
+	for _, notification := range queued {
+		byUser[notification.Username] = append(byUser[notification.Username], notification)
+	}
+	for username, userNotifications := range byUser {
+		ids := make([]string, len(userNotifications))
+		for i, notification := range userNotifications {
+			ids[i] = notification.Id
+		}
+		var user User
+		err = UsersCol.FindOne(ctx, bson.M{"_id": username}).Decode(&user)
+		if err != nil && !errors.Is(err, mongo.ErrNoDocuments) {
+			return err
+		}
+		// the user may have been deleted or removed their email since
+		if err == nil && user.Email != nil && user.EmailVerified {
+			err = mailer.Send(ctx, DigestMessage(*user.Email, userNotifications, frontendUrl))
+			if err != nil {
+				log.Println("failed to send notification digest to", username+":", err)
+				continue
+			}
+		}
+		_, err = NotificationDigestCol.DeleteMany(ctx, bson.M{"_id": bson.M{"$in": ids}})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DigestMessage builds the digest email of the notifications
+func DigestMessage(to string, notifications []Notification, frontendUrl string) mail.Message {
+	var body strings.Builder
+	body.WriteString(fmt.Sprintf("You have %d new notifications on kittygifs:\n\n", len(notifications)))
+	for _, notification := range notifications {
+		body.WriteString("- " + describe(notification) + "\n")
+	}
+	if frontendUrl != "" {
+		body.WriteString("\nSee them at " + strings.TrimSuffix(frontendUrl, "/") + "/notifications\n")
+	}
+	body.WriteString("\nYou can change which notifications you get by email in your notification preferences.")
+	return mail.Message{
+		To:      to,
+		Subject: "Your kittygifs notifications",
+		Body:    body.String(),
+	}
+}
+
+// describe returns a line of text describing the notification
+func describe(notification Notification) string {
+	data := notification.Data
+	switch data["type"] {
+	case GdprRequest:
+		return fmt.Sprint(data["username"], " made a GDPR request ", data["issueId"])
+	case GifEditSuggestion:
+		return fmt.Sprint(data["username"], " suggested an edit to gif ", data["gifId"])
+	case GroupInvitation:
+		return fmt.Sprint(data["username"], " invited you to group ", data["group"])
+	case GdprRequestUpdate:
+		return fmt.Sprint("your ", data["requestType"], " request is now ", data["status"])
+	case TagSubscriptionGifs:
+		return fmt.Sprint(data["count"], " new gifs match your subscriptions")
+	}
+	return fmt.Sprint("notification ", data["type"])
+}
+
+// WebhookChannel posts notifications as JSON to the user's webhook URL, in the background so slow webhooks don't
+// hold up the request that caused the notification
+type WebhookChannel struct {
+	Sender WebhookSender
+}
+
+func (channel *WebhookChannel) Deliver(ctx context.Context, user *User, notification Notification) error {
+	if user.NotificationPreferences == nil || user.NotificationPreferences.WebhookUrl == "" {
+		return nil
+	}
+	body, err := json.Marshal(notification)
+	if err != nil {
+		return err
+	}
+	url := user.NotificationPreferences.WebhookUrl
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		err := channel.Sender.Send(ctx, url, body)
+		if err != nil {
+			log.Println("failed to deliver notification webhook to", user.Username+":", err)
+		}
+	}()
+	return nil
+}
+
+// WebhookSender posts webhook bodies
+type WebhookSender interface {
+	Send(ctx context.Context, url string, body []byte) error
+}
+
+type HttpWebhookSender struct {
+	Client *http.Client
+}
+
+// NewHttpWebhookSender creates a sender that refuses to connect to addresses that aren't public,
+// so users can't make the server send requests to itself or its private network
+func NewHttpWebhookSender() *HttpWebhookSender {
+	dialer := &net.Dialer{Timeout: 10 * time.Second, Control: publicAddressControl}
+	return &HttpWebhookSender{Client: &http.Client{
+		Timeout:   10 * time.Second,
+		Transport: &http.Transport{DialContext: dialer.DialContext},
+	}}
+}
+
+// isPublicIP returns false for private, loopback, link-local, multicast and unspecified addresses
+func isPublicIP(ip net.IP) bool {
+	return !(ip.IsPrivate() || ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified())
+}
+
+// publicAddressControl is a net.Dialer Control that checks the resolved address being connected to is public
+func publicAddressControl(network string, address string, c syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !isPublicIP(ip) {
+		return errors.New("refusing to connect to non-public address " + host)
+	}
+	return nil
+}
+
+func (sender *HttpWebhookSender) Send(ctx context.Context, url string, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	res, err := sender.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("webhook responded with status %d", res.StatusCode)
+	}
+	return nil
+}
+
+type WebhookRequest struct {
+	Url  string
+	Body []byte
+}
+
+// LocalWebhookSender keeps sent webhooks in memory instead of sending them, for tests and development
+type LocalWebhookSender struct {
+	mutex    sync.Mutex
+	requests []WebhookRequest
+}
+
+func (sender *LocalWebhookSender) Send(ctx context.Context, url string, body []byte) error {
+	sender.mutex.Lock()
+	defer sender.mutex.Unlock()
+	sender.requests = append(sender.requests, WebhookRequest{Url: url, Body: body})
+	return nil
+}
+
+// Requests returns the webhooks sent so far
+func (sender *LocalWebhookSender) Requests() []WebhookRequest {
+	sender.mutex.Lock()
+	defer sender.mutex.Unlock()
+	return append([]WebhookRequest{}, sender.requests...)
+}
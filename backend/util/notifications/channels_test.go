@@ -0,0 +1,103 @@
+package notifications
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	. "kittygifs/util"
+	"kittygifs/util/mail"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+type recordingChannel struct {
+	delivered []string
+}
+
+func (channel *recordingChannel) Deliver(ctx context.Context, user *User, notification Notification) error {
+	channel.delivered = append(channel.delivered, user.Username+" "+notification.Id)
+	return nil
+}
+
+func TestDispatch(t *testing.T) {
+	inApp, email := &recordingChannel{}, &recordingChannel{}
+	dispatcher := &Dispatcher{Channels: map[string]Channel{ChannelInApp: inApp, ChannelEmail: email}}
+	user := &User{Username: "kitty", NotificationPreferences: &NotificationPreferences{Channels: map[string][]string{
+		GroupInvitation:   {ChannelEmail},
+		GifEditSuggestion: {},
+	}}}
+	ctx := context.Background()
+	for i, notificationType := range []string{GroupInvitation, GifEditSuggestion, GdprRequestUpdate} {
+		err := dispatcher.Dispatch(ctx, user, Notification{Id: string(rune('a' + i)), Data: map[string]interface{}{"type": notificationType}})
+		require.NoError(t, err)
+	}
+	// types without preferences use the default channels
+	assert.Equal(t, []string{"kitty c"}, inApp.delivered)
+	assert.Equal(t, []string{"kitty a"}, email.delivered)
+}
+
+func TestValidatePreferences(t *testing.T) {
+	assert.NoError(t, ValidatePreferences(NotificationPreferences{Channels: map[string][]string{
+		GroupInvitation: {ChannelInApp, ChannelWebhook},
+	}, WebhookUrl: "https://example.com/hook"}))
+	assert.NoError(t, ValidatePreferences(NotificationPreferences{}))
+	assert.Error(t, ValidatePreferences(NotificationPreferences{Channels: map[string][]string{"unknown": {}}}))
+	assert.Error(t, ValidatePreferences(NotificationPreferences{Channels: map[string][]string{GroupInvitation: {"sms"}}}))
+	assert.Error(t, ValidatePreferences(NotificationPreferences{Channels: map[string][]string{GroupInvitation: {ChannelInApp, ChannelInApp}}}))
+	assert.Error(t, ValidatePreferences(NotificationPreferences{Channels: map[string][]string{GroupInvitation: {ChannelWebhook}}}))
+	assert.Error(t, ValidatePreferences(NotificationPreferences{WebhookUrl: "ftp://example.com"}))
+	for _, webhookUrl := range []string{"http://127.0.0.1/hook", "http://localhost:8080", "http://10.0.0.1",
+		"http://192.168.1.1", "http://169.254.169.254/latest", "http://[::1]/hook", "http://[fe80::1]", "http://0.0.0.0"} {
+		assert.Error(t, ValidatePreferences(NotificationPreferences{WebhookUrl: webhookUrl}), webhookUrl)
+	}
+}
+
+func TestPublicAddressControl(t *testing.T) {
+	assert.NoError(t, publicAddressControl("tcp4", "93.184.216.34:443", nil))
+	assert.NoError(t, publicAddressControl("tcp6", "[2606:2800:220:1::1]:443", nil))
+	assert.Error(t, publicAddressControl("tcp4", "127.0.0.1:80", nil))
+	assert.Error(t, publicAddressControl("tcp4", "172.16.0.5:80", nil))
+	assert.Error(t, publicAddressControl("tcp4", "169.254.169.254:80", nil))
+	assert.Error(t, publicAddressControl("tcp6", "[::ffff:127.0.0.1]:80", nil))
+	assert.Error(t, publicAddressControl("tcp6", "[fd00::1]:80", nil))
+
+	// a server on localhost can't be reached by the sender
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+	err := NewHttpWebhookSender().Send(context.Background(), server.URL, []byte("{}"))
+	assert.ErrorContains(t, err, "refusing to connect")
+}
+
+func TestWebhookChannel(t *testing.T) {
+	sender := &LocalWebhookSender{}
+	channel := &WebhookChannel{Sender: sender}
+	notification := Notification{Id: "a", Username: "kitty", Data: map[string]interface{}{"type": GroupInvitation}}
+	err := channel.Deliver(context.Background(), &User{Username: "kitty"}, notification)
+	require.NoError(t, err)
+	user := &User{Username: "kitty", NotificationPreferences: &NotificationPreferences{WebhookUrl: "https://example.com/hook"}}
+	err = channel.Deliver(context.Background(), user, notification)
+	require.NoError(t, err)
+	assert.Eventually(t, func() bool { return len(sender.Requests()) == 1 }, time.Second, 10*time.Millisecond)
+	request := sender.Requests()[0]
+	assert.Equal(t, "https://example.com/hook", request.Url)
+	var body Notification
+	require.NoError(t, json.Unmarshal(request.Body, &body))
+	assert.Equal(t, "a", body.Id)
+}
+
+func TestDigestMessage(t *testing.T) {
+	mailer := &mail.LocalMailer{}
+	message := DigestMessage("kitty@example.com", []Notification{
+		{Id: "a", Data: map[string]interface{}{"type": GroupInvitation, "username": "someone", "group": "cats"}},
+		{Id: "b", Data: map[string]interface{}{"type": GifEditSuggestion, "username": "someone", "gifId": "123"}},
+	}, "https://gifs.example.com/")
+	require.NoError(t, mailer.Send(context.Background(), message))
+	assert.Equal(t, "kitty@example.com", message.To)
+	assert.Contains(t, message.Body, "You have 2 new notifications")
+	assert.Contains(t, message.Body, "- someone invited you to group cats\n")
+	assert.Contains(t, message.Body, "- someone suggested an edit to gif 123\n")
+	assert.Contains(t, message.Body, "https://gifs.example.com/notifications")
+}
@@ -0,0 +1,215 @@
+package notifications
+
+import (
+	"context"
+	"errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	. "kittygifs/util"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	EventCreated = "created"
+	EventDeleted = "deleted"
+	EventRead    = "read"
+)
+
+// EventRetention is how long events are kept for resuming streams
+const EventRetention = 24 * time.Hour
+
+// Event is a change to a user's notifications, events are stored in NotificationEventsCol so every instance
+// can deliver them and streams can be resumed
+type Event struct {
+	// Id is the ID of the notification for created events, otherwise a new ULID
+	Id       string `json:"id" bson:"_id"`
+	Username string `json:"-" bson:"username"`
+	Type     string `json:"type" bson:"type"`
+	// Notification is the created notification
+	Notification *Notification `json:"notification,omitempty" bson:"notification,omitempty"`
+	// NotificationIds are the IDs of the deleted or read notifications
+	NotificationIds []string  `json:"notificationIds,omitempty" bson:"notificationIds,omitempty"`
+	ExpiresAt       time.Time `json:"-" bson:"expiresAt"`
+}
+
+// Backend delivers the events stored by any instance to this one
+type Backend interface {
+	// Run calls deliver with new events until the context is done
+	Run(ctx context.Context, deliver func(Event)) error
+}
+
+// Hub fans out events from its backend to the subscribers of this instance
+type Hub struct {
+	mutex       sync.Mutex
+	subscribers map[string]map[chan Event]bool
+}
+
+// DefaultHub is the hub that streams subscribe to, started in main
+var DefaultHub = NewHub()
+
+func NewHub() *Hub {
+	return &Hub{subscribers: make(map[string]map[chan Event]bool)}
+}
+
+// Subscribe returns a channel with the user's events, unsubscribe must be called once the channel is no longer read
+func (hub *Hub) Subscribe(username string) (events <-chan Event, unsubscribe func()) {
+	ch := make(chan Event, 16)
+	hub.mutex.Lock()
+	defer hub.mutex.Unlock()
+	if hub.subscribers[username] == nil {
+		hub.subscribers[username] = make(map[chan Event]bool)
+	}
+	hub.subscribers[username][ch] = true
+	return ch, func() {
+		hub.mutex.Lock()
+		defer hub.mutex.Unlock()
+		if hub.subscribers[username][ch] {
+			delete(hub.subscribers[username], ch)
+			if len(hub.subscribers[username]) == 0 {
+				delete(hub.subscribers, username)
+			}
+			close(ch)
+		}
+	}
+}
+
+// Deliver sends the event to the user's subscribers, a subscriber that can't keep up is dropped
+// by closing its channel, so it can reconnect and resume
+func (hub *Hub) Deliver(event Event) {
+	hub.mutex.Lock()
+	defer hub.mutex.Unlock()
+	for ch := range hub.subscribers[event.Username] {
+		select {
+		case ch <- event:
+		default:
+			delete(hub.subscribers[event.Username], ch)
+			close(ch)
+		}
+	}
+	if len(hub.subscribers[event.Username]) == 0 {
+		delete(hub.subscribers, event.Username)
+	}
+}
+
+// Run delivers events from the backend until the context is done, restarting the backend if it fails
+func (hub *Hub) Run(ctx context.Context, backend Backend) {
+	for ctx.Err() == nil {
+		err := backend.Run(ctx, hub.Deliver)
+		if err != nil && ctx.Err() == nil {
+			log.Println("notification backend failed:", err)
+			time.Sleep(5 * time.Second)
+		}
+	}
+}
+
+// NewBackend returns the backend by its name in the config, "changeStream" or "polling" by default
+func NewBackend(name string) (Backend, error) {
+	switch name {
+	case "", "polling":
+		return &PollingBackend{Col: NotificationEventsCol, Interval: time.Second}, nil
+	case "changeStream":
+		return &ChangeStreamBackend{Col: NotificationEventsCol}, nil
+	}
+	return nil, errors.New("unknown notification backend " + name)
+}
+
+// PollingBackend queries the collection for new events, it works with any MongoDB deployment
+type PollingBackend struct {
+	Col      *mongo.Collection
+	Interval time.Duration
+}
+
+// pollingLookback is how far back events are queried, as IDs created on other instances at about the same time
+// may be inserted out of order
+const pollingLookback = 10 * time.Second
+
+func (backend *PollingBackend) Run(ctx context.Context, deliver func(Event)) error {
+	ticker := time.NewTicker(backend.Interval)
+	defer ticker.Stop()
+	// events that existed before starting aren't delivered
+	started := time.Now()
+	seen := make(map[string]time.Time)
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+		now := time.Now()
+		from := now.Add(-pollingLookback)
+		if from.Before(started) {
+			from = started
+		}
+		cur, err := backend.Col.Find(ctx, bson.M{"_id": bson.M{"$gte": MinUlid(from)}},
+			options.Find().SetSort(bson.M{"_id": 1}))
+		if err != nil {
+			return err
+		}
+		var events []Event
+		err = cur.All(ctx, &events)
+		if err != nil {
+			return err
+		}
+		for _, event := range events {
+			if _, ok := seen[event.Id]; ok {
+				continue
+			}
+			seen[event.Id] = now
+			deliver(event)
+		}
+		for id, at := range seen {
+			if now.Sub(at) > 2*pollingLookback {
+				delete(seen, id)
+			}
+		}
+	}
+}
+
+// ChangeStreamBackend watches the collection for inserted events, it needs MongoDB to be a replica set
+type ChangeStreamBackend struct {
+	Col *mongo.Collection
+}
+
+func (backend *ChangeStreamBackend) Run(ctx context.Context, deliver func(Event)) error {
+	stream, err := backend.Col.Watch(ctx, mongo.Pipeline{bson.D{{Key: "$match", Value: bson.M{"operationType": "insert"}}}})
+	if err != nil {
+		return err
+	}
+	defer stream.Close(context.Background())
+	for stream.Next(ctx) {
+		var change struct {
+			FullDocument Event `bson:"fullDocument"`
+		}
+		err = stream.Decode(&change)
+		if err != nil {
+			return err
+		}
+		deliver(change.FullDocument)
+	}
+	if ctx.Err() != nil {
+		return nil
+	}
+	return stream.Err()
+}
+
+// publish stores the event for delivery
+func publish(ctx context.Context, event Event) error {
+	event.ExpiresAt = time.Now().Add(EventRetention)
+	_, err := NotificationEventsCol.InsertOne(ctx, event)
+	return err
+}
+
+// EventsAfter returns the user's events after the event ID, for resuming a stream
+func EventsAfter(ctx context.Context, username, lastEventId string) ([]Event, error) {
+	cur, err := NotificationEventsCol.Find(ctx, bson.M{"username": username, "_id": bson.M{"$gt": lastEventId}},
+		options.Find().SetSort(bson.M{"_id": 1}).SetLimit(1000))
+	if err != nil {
+		return nil, err
+	}
+	events := []Event{}
+	err = cur.All(ctx, &events)
+	return events, err
+}
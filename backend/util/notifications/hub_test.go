@@ -0,0 +1,38 @@
+package notifications
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestHub(t *testing.T) {
+	hub := NewHub()
+	events, unsubscribe := hub.Subscribe("kitty")
+	other, unsubscribeOther := hub.Subscribe("someone")
+	defer unsubscribeOther()
+
+	hub.Deliver(Event{Id: "1", Username: "kitty", Type: EventCreated})
+	assert.Equal(t, "1", (<-events).Id)
+	assert.Empty(t, other)
+
+	unsubscribe()
+	_, ok := <-events
+	assert.False(t, ok)
+	// unsubscribing twice is fine
+	unsubscribe()
+	hub.Deliver(Event{Id: "2", Username: "kitty", Type: EventCreated})
+	assert.NotContains(t, hub.subscribers, "kitty")
+}
+
+func TestHubDropsSlowSubscribers(t *testing.T) {
+	hub := NewHub()
+	events, unsubscribe := hub.Subscribe("kitty")
+	defer unsubscribe()
+	for i := 0; i < cap(events)+1; i++ {
+		hub.Deliver(Event{Id: "event", Username: "kitty", Type: EventCreated})
+	}
+	for range events {
+	}
+	// the channel was closed once it was full
+	assert.NotContains(t, hub.subscribers, "kitty")
+}
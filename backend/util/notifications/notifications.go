@@ -1,9 +1,15 @@
 package notifications
 
 import (
+	"context"
+	"errors"
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
 	. "kittygifs/util"
+	"kittygifs/util/metrics"
 	"slices"
+	"time"
 )
 
 func MustDeleteNotificationsByEventId(eventId string) {
@@ -11,7 +17,45 @@ func MustDeleteNotificationsByEventId(eventId string) {
 }
 
 func MustDeleteNotifications(filter bson.M) {
-	_, _ = NotificationsCol.DeleteMany(nil, filter)
+	_ = DeleteNotifications(context.Background(), filter)
+}
+
+// DeleteNotifications deletes the notifications matching the filter and publishes a deleted event to their users,
+// they are also removed from email digests that haven't been sent yet
+func DeleteNotifications(ctx context.Context, filter bson.M) error {
+	_, err := NotificationDigestCol.DeleteMany(ctx, filter)
+	if err != nil {
+		return err
+	}
+	cur, err := NotificationsCol.Find(ctx, filter)
+	if err != nil {
+		return err
+	}
+	var notifications []Notification
+	err = cur.All(ctx, &notifications)
+	if err != nil {
+		return err
+	}
+	if len(notifications) == 0 {
+		return nil
+	}
+	ids := make([]string, len(notifications))
+	byUser := make(map[string][]string)
+	for i, notification := range notifications {
+		ids[i] = notification.Id
+		byUser[notification.Username] = append(byUser[notification.Username], notification.Id)
+	}
+	_, err = NotificationsCol.DeleteMany(ctx, bson.M{"_id": bson.M{"$in": ids}})
+	if err != nil {
+		return err
+	}
+	for username, deleted := range byUser {
+		err = publish(ctx, Event{Id: NewUlid(), Username: username, Type: EventDeleted, NotificationIds: deleted})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func MustNotifyGroup(groupName, eventId, notificationType string, data map[string]interface{}, otherUsers ...string) {
@@ -28,11 +72,13 @@ func NotifyGroup(groupName, eventId, notificationType string, data map[string]in
 	if err != nil {
 		return err
 	}
+	recipients := len(otherUsers)
 	for _, user := range users {
 		if slices.Contains(otherUsers, user.Username) {
 			continue
 		}
-		err = NotifyUser(user.Username, eventId, notificationType, data)
+		recipients++
+		err = notifyUser(&user, eventId, notificationType, data)
 		if err != nil {
 			return err
 		}
@@ -43,6 +89,7 @@ func NotifyGroup(groupName, eventId, notificationType string, data map[string]in
 			return err
 		}
 	}
+	metrics.NotificationFanout.Observe(float64(recipients), notificationType)
 	return nil
 }
 
@@ -50,25 +97,42 @@ func MustNotifyUser(username, eventId, notificationType string, data map[string]
 	_ = NotifyUser(username, eventId, notificationType, data)
 }
 
+// NotifyUser sends the notification through the channels the user chose for its type
 func NotifyUser(username, eventId, notificationType string, data map[string]interface{}) error {
+	var user User
+	err := UsersCol.FindOne(nil, bson.M{"_id": username}).Decode(&user)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		user = User{Username: username}
+	} else if err != nil {
+		return err
+	}
+	return notifyUser(&user, eventId, notificationType, data)
+}
+
+func notifyUser(user *User, eventId, notificationType string, data map[string]interface{}) error {
 	data["type"] = notificationType
 	notification := Notification{
-		Id:       NewUlid(),
-		EventId:  eventId,
-		Username: username,
-		Data:     data,
+		Id:        NewUlid(),
+		EventId:   eventId,
+		Username:  user.Username,
+		Data:      data,
+		CreatedAt: time.Now(),
 	}
-	_, err := NotificationsCol.InsertOne(nil, notification)
-	return err
+	return DefaultDispatcher.Dispatch(context.Background(), user, notification)
 }
 
 const (
 	GdprRequest       = "gdprRequest"
 	GifEditSuggestion = "gifEditSuggestion"
+	GroupInvitation   = "groupInvite"
+	// GdprRequestUpdate is sent to the requester when their GDPR request is completed, fails or is rejected
+	GdprRequestUpdate = "gdprRequestUpdate"
+	// TagSubscriptionGifs is sent with a batch of new gifs matching the user's tag subscriptions
+	TagSubscriptionGifs = "tagSubscription"
 )
 
 // NotificationTypes is a list of all notification types
-var NotificationTypes = []string{GdprRequest, GifEditSuggestion}
+var NotificationTypes = []string{GdprRequest, GifEditSuggestion, GroupInvitation, GdprRequestUpdate, TagSubscriptionGifs}
 
 // NotificationTypesDeleteByEvent is a list of all notification types, where if the notification is deleted,
 // the notifications with the same event id(that other users may have gotten) will also be deleted
@@ -77,11 +141,47 @@ var NotificationTypesDeleteByEvent = []string{GdprRequest}
 // NotificationTypesDeletable is a list of all notification types, that can be deleted by the user,
 // otherwise the notification is supposed to be deleted automatically by the server when the event is resolved,
 // e.g. tag edit request is resolved
-var NotificationTypesDeletable = []string{GdprRequest}
+var NotificationTypesDeletable = []string{GdprRequest, GroupInvitation, GdprRequestUpdate, TagSubscriptionGifs}
 
 type Notification struct {
-	Id       string                 `json:"id" bson:"_id"`
-	Username string                 `json:"username" bson:"username"`
-	EventId  string                 `json:"eventId" bson:"eventId"`
-	Data     map[string]interface{} `json:"data" bson:"data"`
+	Id        string                 `json:"id" bson:"_id"`
+	Username  string                 `json:"username" bson:"username"`
+	EventId   string                 `json:"eventId" bson:"eventId"`
+	Data      map[string]interface{} `json:"data" bson:"data"`
+	CreatedAt time.Time              `json:"createdAt" bson:"createdAt"`
+	// ReadAt is when the user marked the notification as read, unread notifications don't have it
+	ReadAt *time.Time `json:"readAt,omitempty" bson:"readAt,omitempty"`
+}
+
+// MarkRead marks the user's unread notifications matching the filter as read and publishes a read event
+func MarkRead(ctx context.Context, username string, filter bson.M) ([]string, error) {
+	filter["username"] = username
+	filter["readAt"] = bson.M{"$exists": false}
+	cur, err := NotificationsCol.Find(ctx, filter, options.Find().SetProjection(bson.M{"_id": 1}))
+	if err != nil {
+		return nil, err
+	}
+	var unread []Notification
+	err = cur.All(ctx, &unread)
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]string, len(unread))
+	for i, notification := range unread {
+		ids[i] = notification.Id
+	}
+	if len(ids) == 0 {
+		return ids, nil
+	}
+	_, err = NotificationsCol.UpdateMany(ctx, bson.M{"_id": bson.M{"$in": ids}, "readAt": bson.M{"$exists": false}},
+		bson.M{"$set": bson.M{"readAt": time.Now()}})
+	if err != nil {
+		return nil, err
+	}
+	// the user has already seen them, so they don't need to be emailed
+	_, err = NotificationDigestCol.DeleteMany(ctx, bson.M{"_id": bson.M{"$in": ids}})
+	if err != nil {
+		return nil, err
+	}
+	return ids, publish(ctx, Event{Id: NewUlid(), Username: username, Type: EventRead, NotificationIds: ids})
 }
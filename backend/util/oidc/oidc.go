@@ -0,0 +1,256 @@
+package oidc
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/go-jose/go-jose/v4"
+	"github.com/go-jose/go-jose/v4/jwt"
+	. "kittygifs/util"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// discoveryCacheDuration is how long the discovery document and keys of a provider are cached for
+const discoveryCacheDuration = time.Hour
+
+var DefaultScopes = []string{"openid", "profile", "email"}
+
+// signatureAlgorithms are the ID token signature algorithms that are accepted
+var signatureAlgorithms = []jose.SignatureAlgorithm{jose.RS256, jose.RS384, jose.RS512, jose.ES256, jose.ES384,
+	jose.ES512, jose.PS256, jose.PS384, jose.PS512, jose.EdDSA}
+
+var ErrInvalidIdToken = errors.New("invalid ID token")
+
+type Discovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	UserinfoEndpoint      string `json:"userinfo_endpoint"`
+	JwksUri               string `json:"jwks_uri"`
+}
+
+// Claims are the ID token claims that are used
+type Claims struct {
+	jwt.Claims
+	Nonce             string `json:"nonce"`
+	Email             string `json:"email"`
+	EmailVerified     bool   `json:"email_verified"`
+	Name              string `json:"name"`
+	PreferredUsername string `json:"preferred_username"`
+}
+
+type Tokens struct {
+	AccessToken string `json:"access_token"`
+	IdToken     string `json:"id_token"`
+	TokenType   string `json:"token_type"`
+}
+
+// Provider is an OpenID Connect provider configured through discovery
+type Provider struct {
+	Config     *OidcProviderConfiguration
+	HttpClient *http.Client
+
+	mutex        sync.Mutex
+	discovery    *Discovery
+	jwks         *jose.JSONWebKeySet
+	discoveredAt time.Time
+}
+
+func NewProvider(config *OidcProviderConfiguration) *Provider {
+	return &Provider{Config: config, HttpClient: &http.Client{Timeout: 10 * time.Second}}
+}
+
+// Discover gets the provider's discovery document, it is cached for an hour
+func (provider *Provider) Discover(ctx context.Context) (*Discovery, error) {
+	provider.mutex.Lock()
+	defer provider.mutex.Unlock()
+	if provider.discovery != nil && time.Since(provider.discoveredAt) < discoveryCacheDuration {
+		return provider.discovery, nil
+	}
+	var discovery Discovery
+	err := provider.getJson(ctx, strings.TrimSuffix(provider.Config.Issuer, "/")+"/.well-known/openid-configuration", &discovery)
+	if err != nil {
+		return nil, err
+	}
+	if discovery.Issuer != provider.Config.Issuer {
+		return nil, fmt.Errorf("issuer %s in the discovery document doesn't match the configured one", discovery.Issuer)
+	}
+	provider.discovery = &discovery
+	provider.jwks = nil
+	provider.discoveredAt = time.Now()
+	return &discovery, nil
+}
+
+// AuthCodeUrl returns the URL to redirect the user to for signing in
+func (provider *Provider) AuthCodeUrl(ctx context.Context, redirectUri, state, nonce, codeVerifier string) (string, error) {
+	discovery, err := provider.Discover(ctx)
+	if err != nil {
+		return "", err
+	}
+	scopes := provider.Config.Scopes
+	if len(scopes) == 0 {
+		scopes = DefaultScopes
+	} else if !slices.Contains(scopes, "openid") {
+		scopes = append([]string{"openid"}, scopes...)
+	}
+	query := url.Values{}
+	query.Set("response_type", "code")
+	query.Set("client_id", provider.Config.ClientId)
+	query.Set("redirect_uri", redirectUri)
+	query.Set("scope", strings.Join(scopes, " "))
+	query.Set("state", state)
+	query.Set("nonce", nonce)
+	query.Set("code_challenge", CodeChallenge(codeVerifier))
+	query.Set("code_challenge_method", "S256")
+	separator := "?"
+	if strings.Contains(discovery.AuthorizationEndpoint, "?") {
+		separator = "&"
+	}
+	return discovery.AuthorizationEndpoint + separator + query.Encode(), nil
+}
+
+// Exchange exchanges the authorization code for tokens
+func (provider *Provider) Exchange(ctx context.Context, code, redirectUri, codeVerifier string) (*Tokens, error) {
+	discovery, err := provider.Discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", redirectUri)
+	form.Set("code_verifier", codeVerifier)
+	req, err := http.NewRequestWithContext(ctx, "POST", discovery.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(url.QueryEscape(provider.Config.ClientId), url.QueryEscape(provider.Config.ClientSecret))
+	res, err := provider.HttpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		var body struct {
+			Error            string `json:"error"`
+			ErrorDescription string `json:"error_description"`
+		}
+		_ = json.NewDecoder(res.Body).Decode(&body)
+		return nil, fmt.Errorf("token request failed with status %d: %s %s", res.StatusCode, body.Error, body.ErrorDescription)
+	}
+	var tokens Tokens
+	err = json.NewDecoder(res.Body).Decode(&tokens)
+	if err != nil {
+		return nil, err
+	}
+	if tokens.IdToken == "" {
+		return nil, errors.New("no ID token in the token response")
+	}
+	return &tokens, nil
+}
+
+// VerifyIdToken verifies the ID token's signature and claims, including that it was issued for the nonce
+func (provider *Provider) VerifyIdToken(ctx context.Context, idToken, nonce string) (*Claims, error) {
+	token, err := jwt.ParseSigned(idToken, signatureAlgorithms)
+	if err != nil {
+		return nil, err
+	}
+	discovery, err := provider.Discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+	jwks, err := provider.keys(ctx, discovery, false)
+	if err != nil {
+		return nil, err
+	}
+	var claims Claims
+	err = token.Claims(jwks, &claims)
+	if err != nil {
+		// the provider may have rotated its keys
+		jwks, err = provider.keys(ctx, discovery, true)
+		if err != nil {
+			return nil, err
+		}
+		err = token.Claims(jwks, &claims)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidIdToken, err)
+		}
+	}
+	err = claims.Validate(jwt.Expected{
+		Issuer:      provider.Config.Issuer,
+		AnyAudience: jwt.Audience{provider.Config.ClientId},
+		Time:        time.Now(),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidIdToken, err)
+	}
+	if claims.Expiry == nil || claims.Subject == "" {
+		return nil, fmt.Errorf("%w: missing exp or sub", ErrInvalidIdToken)
+	}
+	if claims.Nonce != nonce {
+		return nil, fmt.Errorf("%w: nonce doesn't match", ErrInvalidIdToken)
+	}
+	return &claims, nil
+}
+
+// keys gets the provider's signing keys, cached until the discovery document expires or refresh is true
+func (provider *Provider) keys(ctx context.Context, discovery *Discovery, refresh bool) (*jose.JSONWebKeySet, error) {
+	provider.mutex.Lock()
+	jwks := provider.jwks
+	provider.mutex.Unlock()
+	if jwks != nil && !refresh {
+		return jwks, nil
+	}
+	jwks = &jose.JSONWebKeySet{}
+	err := provider.getJson(ctx, discovery.JwksUri, jwks)
+	if err != nil {
+		return nil, err
+	}
+	provider.mutex.Lock()
+	provider.jwks = jwks
+	provider.mutex.Unlock()
+	return jwks, nil
+}
+
+func (provider *Provider) getJson(ctx context.Context, url string, result interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	res, err := provider.HttpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		return fmt.Errorf("request to %s failed with status %d", url, res.StatusCode)
+	}
+	return json.NewDecoder(res.Body).Decode(result)
+}
+
+// GenerateCodeVerifier generates a PKCE code verifier
+func GenerateCodeVerifier() string {
+	verifier := make([]byte, 32)
+	if _, err := rand.Read(verifier); err != nil {
+		panic(fmt.Sprintf("Failed to generate code verifier: %v", err))
+	}
+	return base64.RawURLEncoding.EncodeToString(verifier)
+}
+
+// CodeChallenge returns the S256 PKCE code challenge for the verifier
+func CodeChallenge(codeVerifier string) string {
+	sum := sha256.Sum256([]byte(codeVerifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
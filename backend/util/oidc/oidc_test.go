@@ -0,0 +1,169 @@
+package oidc
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"github.com/go-jose/go-jose/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	. "kittygifs/util"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// mockIssuer serves discovery and keys, and issues ID tokens for a code when the code verifier matches
+type mockIssuer struct {
+	server        *httptest.Server
+	key           *rsa.PrivateKey
+	keyId         string
+	codeChallenge string
+	claims        map[string]interface{}
+}
+
+func newMockIssuer(t *testing.T) *mockIssuer {
+	issuer := &mockIssuer{keyId: "first"}
+	issuer.rotateKey(t)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(Discovery{
+			Issuer:                issuer.server.URL,
+			AuthorizationEndpoint: issuer.server.URL + "/authorize",
+			TokenEndpoint:         issuer.server.URL + "/token",
+			JwksUri:               issuer.server.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(jose.JSONWebKeySet{Keys: []jose.JSONWebKey{
+			{Key: &issuer.key.PublicKey, KeyID: issuer.keyId, Algorithm: string(jose.RS256), Use: "sig"},
+		}})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		_ = r.ParseForm()
+		clientId, clientSecret, _ := r.BasicAuth()
+		if r.PostForm.Get("code") != "code" || CodeChallenge(r.PostForm.Get("code_verifier")) != issuer.codeChallenge ||
+			clientId != "client" || clientSecret != "secret" {
+			w.WriteHeader(400)
+			_, _ = w.Write([]byte(`{"error": "invalid_grant"}`))
+			return
+		}
+		_ = json.NewEncoder(w).Encode(Tokens{AccessToken: "access", IdToken: issuer.idToken(t), TokenType: "Bearer"})
+	})
+	issuer.server = httptest.NewServer(mux)
+	t.Cleanup(issuer.server.Close)
+	issuer.claims = map[string]interface{}{
+		"iss":   issuer.server.URL,
+		"sub":   "subject",
+		"aud":   "client",
+		"exp":   time.Now().Add(time.Hour).Unix(),
+		"nonce": "nonce",
+	}
+	return issuer
+}
+
+func (issuer *mockIssuer) rotateKey(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	issuer.key = key
+	issuer.keyId += "+"
+}
+
+func (issuer *mockIssuer) idToken(t *testing.T) string {
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.RS256, Key: issuer.key},
+		(&jose.SignerOptions{}).WithHeader("kid", issuer.keyId))
+	require.NoError(t, err)
+	claims, err := json.Marshal(issuer.claims)
+	require.NoError(t, err)
+	jws, err := signer.Sign(claims)
+	require.NoError(t, err)
+	token, err := jws.CompactSerialize()
+	require.NoError(t, err)
+	return token
+}
+
+func TestProviderSignIn(t *testing.T) {
+	ctx := context.Background()
+	issuer := newMockIssuer(t)
+	provider := NewProvider(&OidcProviderConfiguration{
+		Id:           "mock",
+		Issuer:       issuer.server.URL,
+		ClientId:     "client",
+		ClientSecret: "secret",
+		Scopes:       []string{"email"},
+	})
+
+	verifier := GenerateCodeVerifier()
+	authUrl, err := provider.AuthCodeUrl(ctx, "http://api.test/callback", "state", "nonce", verifier)
+	require.NoError(t, err)
+	parsed, err := url.Parse(authUrl)
+	require.NoError(t, err)
+	assert.Equal(t, issuer.server.URL+"/authorize", parsed.Scheme+"://"+parsed.Host+parsed.Path)
+	assert.Equal(t, "openid email", parsed.Query().Get("scope"))
+	assert.Equal(t, "state", parsed.Query().Get("state"))
+	assert.Equal(t, "S256", parsed.Query().Get("code_challenge_method"))
+	issuer.codeChallenge = parsed.Query().Get("code_challenge")
+
+	_, err = provider.Exchange(ctx, "code", "http://api.test/callback", "wrong verifier")
+	assert.Error(t, err)
+	tokens, err := provider.Exchange(ctx, "code", "http://api.test/callback", verifier)
+	require.NoError(t, err)
+	claims, err := provider.VerifyIdToken(ctx, tokens.IdToken, "nonce")
+	require.NoError(t, err)
+	assert.Equal(t, "subject", claims.Subject)
+
+	_, err = provider.VerifyIdToken(ctx, tokens.IdToken, "other nonce")
+	assert.ErrorIs(t, err, ErrInvalidIdToken)
+}
+
+func TestProviderVerifyIdToken(t *testing.T) {
+	ctx := context.Background()
+	issuer := newMockIssuer(t)
+	provider := NewProvider(&OidcProviderConfiguration{Id: "mock", Issuer: issuer.server.URL, ClientId: "client"})
+
+	_, err := provider.VerifyIdToken(ctx, issuer.idToken(t), "nonce")
+	require.NoError(t, err)
+
+	// keys are fetched again when the token is signed with an unknown one
+	issuer.rotateKey(t)
+	_, err = provider.VerifyIdToken(ctx, issuer.idToken(t), "nonce")
+	assert.NoError(t, err)
+
+	issuer.claims["aud"] = "other client"
+	_, err = provider.VerifyIdToken(ctx, issuer.idToken(t), "nonce")
+	assert.ErrorIs(t, err, ErrInvalidIdToken)
+	issuer.claims["aud"] = "client"
+
+	issuer.claims["exp"] = time.Now().Add(-time.Hour).Unix()
+	_, err = provider.VerifyIdToken(ctx, issuer.idToken(t), "nonce")
+	assert.ErrorIs(t, err, ErrInvalidIdToken)
+	delete(issuer.claims, "exp")
+	_, err = provider.VerifyIdToken(ctx, issuer.idToken(t), "nonce")
+	assert.ErrorIs(t, err, ErrInvalidIdToken)
+	issuer.claims["exp"] = time.Now().Add(time.Hour).Unix()
+
+	issuer.claims["iss"] = "http://evil.test"
+	_, err = provider.VerifyIdToken(ctx, issuer.idToken(t), "nonce")
+	assert.ErrorIs(t, err, ErrInvalidIdToken)
+
+	// a token signed with another key with the same key ID
+	issuer.claims["iss"] = issuer.server.URL
+	key := issuer.key
+	forged, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	issuer.key = forged
+	token := issuer.idToken(t)
+	issuer.key = key
+	_, err = provider.VerifyIdToken(ctx, token, "nonce")
+	assert.ErrorIs(t, err, ErrInvalidIdToken)
+}
+
+func TestProviderDiscoveryIssuerMismatch(t *testing.T) {
+	issuer := newMockIssuer(t)
+	provider := NewProvider(&OidcProviderConfiguration{Id: "mock", Issuer: issuer.server.URL + "/", ClientId: "client"})
+	_, err := provider.Discover(context.Background())
+	assert.Error(t, err)
+}
@@ -12,6 +12,7 @@ import (
 	"math/big"
 	mathRand "math/rand"
 	"net/url"
+	"slices"
 	"strings"
 	"time"
 )
@@ -147,11 +148,88 @@ func ValidateTagCategory(category TagCategory) error {
 	return nil
 }
 
+// ValidateGroup Returns nil if group is valid, otherwise returns an error.
+// Does not check whether a group with the same name exists.
+func ValidateGroup(group Group) error {
+	if !GroupValidation.MatchString(group.Name) {
+		return errors.New("invalid name")
+	}
+	if group.Name == "private" {
+		return errors.New("name is reserved")
+	}
+	if group.Description != nil && len(*group.Description) > 256 {
+		return errors.New("description is too long(>256)")
+	}
+	if len(group.Owners) > 32 {
+		return errors.New("too many owners(>32)")
+	}
+	for _, owner := range group.Owners {
+		if !UsernameValidation.MatchString(owner) {
+			return errors.New("invalid owner: " + owner)
+		}
+	}
+	return nil
+}
+
+// IsPermissionGroupName returns true for group names that always grant permissions
+func IsPermissionGroupName(name string) bool {
+	return name == "admin" || strings.HasPrefix(name, PermissionGroupPrefix) || strings.HasPrefix(name, RoleGroupPrefix)
+}
+
+// ValidateRole Returns nil if role is valid, otherwise returns an error
+func ValidateRole(role Role) error {
+	if !RoleValidation.MatchString(role.Name) {
+		return errors.New("invalid name")
+	}
+	if role.Description != nil && len(*role.Description) > 256 {
+		return errors.New("description is too long(>256)")
+	}
+	for _, permission := range role.Permissions {
+		if !IsPermission(permission) {
+			return errors.New("unknown permission: " + permission)
+		}
+	}
+	return nil
+}
+
+// ValidateGroupsExist Returns nil if all the groups exist, otherwise returns an error.
+// Private groups(@username) are skipped.
+func ValidateGroupsExist(ctx context.Context, groups []string) error {
+	names := make([]string, 0, len(groups))
+	for _, group := range groups {
+		if strings.HasPrefix(group, "@") || slices.Contains(names, group) {
+			continue
+		}
+		names = append(names, group)
+	}
+	if len(names) == 0 {
+		return nil
+	}
+	cur, err := GroupsCol.Find(ctx, bson.M{"_id": bson.M{"$in": names}})
+	if err != nil {
+		return err
+	}
+	var existing []Group
+	err = cur.All(ctx, &existing)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if !slices.ContainsFunc(existing, func(group Group) bool { return group.Name == name }) {
+			return errors.New("group does not exist: " + name)
+		}
+	}
+	return nil
+}
+
 func ValidateUsername(username string, ctx context.Context) error {
 
 	if !UsernameValidation.MatchString(username) {
 		return errors.New("invalid username")
 	}
+	if username == DeletedUsername {
+		return errors.New("username is reserved")
+	}
 	// check if username exists
 	count, err := UsersCol.CountDocuments(ctx, bson.M{"_id": username})
 	if err != nil {
@@ -180,6 +258,9 @@ func ParseBase64Timestamp(timestamp string) (time.Time, error) {
 	return time.Unix(int64(seconds), 0), nil
 }
 
+// SessionTokenPrefix is prepended to session tokens to make them recognisable
+const SessionTokenPrefix = "kgs_"
+
 func GenerateVerificationToken() string {
 	return GetBase64Timestamp() + "." + GenerateRandomString(24)
 }
@@ -209,3 +290,10 @@ var entropy = ulid.Monotonic(mathRand.New(mathRand.NewSource(int64(ulid.Now())))
 func NewUlid() string {
 	return ulid.MustNew(ulid.Now(), entropy).String()
 }
+
+// MinUlid returns the smallest ULID with the time, for querying IDs created after it
+func MinUlid(t time.Time) string {
+	var id ulid.ULID
+	_ = id.SetTime(ulid.Timestamp(t))
+	return id.String()
+}
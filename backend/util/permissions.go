@@ -0,0 +1,126 @@
+package util
+
+import (
+	"context"
+	"go.mongodb.org/mongo-driver/bson"
+	"slices"
+	"strings"
+)
+
+const (
+	PermEditAllGifs    = "edit_all_gifs"
+	PermDeleteAllGifs  = "delete_all_gifs"
+	PermEditTags       = "edit_tags"
+	PermDeleteTags     = "delete_tags"
+	PermManageTags     = "manage_tags"
+	PermResetPasswords = "reset_passwords"
+	PermManageGroups   = "manage_groups"
+	PermManageRoles    = "manage_roles"
+	PermViewAuditLog   = "view_audit_log"
+	PermManageGdpr     = "manage_gdpr_requests"
+	PermSignupInvites  = "create_signup_invites"
+	PermManageWebhooks = "manage_webhooks"
+	// PermManageSignupInvites is needed to see and revoke the signup invites of other users
+	PermManageSignupInvites = "manage_signup_invites"
+)
+
+type PermissionInfo struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+}
+
+// Permissions is the registry of all permissions
+var Permissions = []PermissionInfo{
+	{PermEditAllGifs, "edit gifs uploaded by other users"},
+	{PermDeleteAllGifs, "delete gifs uploaded by other users"},
+	{PermEditTags, "edit and rename tags, and manage tag categories"},
+	{PermDeleteTags, "delete tags"},
+	{PermManageTags, "run tag count updates and apply tag implications to existing gifs"},
+	{PermResetPasswords, "reset the password of other users"},
+	{PermManageGroups, "create and delete groups, and manage the members of any group"},
+	{PermManageRoles, "create, edit and delete roles, and manage permission groups"},
+	{PermViewAuditLog, "view the audit log"},
+	{PermManageGdpr, "view, approve and reject GDPR requests"},
+	{PermSignupInvites, "create invites for signing up when signup is invite-only"},
+	{PermManageWebhooks, "register webhooks for instance events and view their deliveries"},
+	{PermManageSignupInvites, "view and revoke the signup invites created by other users"},
+}
+
+// RoleGroupPrefix is the prefix of the group that grants a role, e.g. role:moderator
+const RoleGroupPrefix = "role:"
+
+// PermissionGroupPrefix is the prefix of legacy groups that grant a single permission, e.g. perm:edit_tags
+const PermissionGroupPrefix = "perm:"
+
+type Role struct {
+	Name        string   `json:"name" bson:"_id"`
+	Description *string  `json:"description,omitempty" bson:"description,omitempty"`
+	Permissions []string `json:"permissions" bson:"permissions"`
+}
+
+// IsPermission returns true if the permission is in the registry
+func IsPermission(name string) bool {
+	return slices.ContainsFunc(Permissions, func(info PermissionInfo) bool { return info.Name == name })
+}
+
+// LoadPermissions resolves the user's roles into User.Permissions, needs to be called before HasPermission
+// for roles to be taken into account
+func (user *User) LoadPermissions(ctx context.Context) error {
+	permissions := []string{}
+	if user.Groups == nil {
+		user.Permissions = permissions
+		return nil
+	}
+	if user.HasGroup("admin") {
+		for _, info := range Permissions {
+			permissions = append(permissions, info.Name)
+		}
+		user.Permissions = permissions
+		return nil
+	}
+	var roles []string
+	for _, group := range *user.Groups {
+		if strings.HasPrefix(group, PermissionGroupPrefix) && IsPermission(group[len(PermissionGroupPrefix):]) {
+			permissions = appendUnique(permissions, group[len(PermissionGroupPrefix):])
+		} else if strings.HasPrefix(group, RoleGroupPrefix) {
+			roles = append(roles, group[len(RoleGroupPrefix):])
+		}
+	}
+	if len(roles) > 0 {
+		cur, err := RolesCol.Find(ctx, bson.M{"_id": bson.M{"$in": roles}})
+		if err != nil {
+			return err
+		}
+		var found []Role
+		err = cur.All(ctx, &found)
+		if err != nil {
+			return err
+		}
+		for _, role := range found {
+			for _, permission := range role.Permissions {
+				permissions = appendUnique(permissions, permission)
+			}
+		}
+	}
+	user.Permissions = permissions
+	return nil
+}
+
+// HasPermission Returns true if user has the permission through a role, a perm: group or is admin,
+// otherwise returns false
+func (user *User) HasPermission(permission string) bool {
+	if user == nil {
+		return false
+	}
+	if user.HasGroup(PermissionGroupPrefix + permission) {
+		return true
+	}
+	return slices.Contains(user.Permissions, permission)
+}
+
+func appendUnique(slice []string, value string) []string {
+	if slices.Contains(slice, value) {
+		return slice
+	}
+	return append(slice, value)
+}
@@ -0,0 +1,36 @@
+package util
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestHasPermission(t *testing.T) {
+	testCases := []struct {
+		groups     []string
+		permission string
+		want       bool
+	}{
+		{[]string{"admin"}, PermEditTags, true},
+		{[]string{"perm:edit_tags"}, PermEditTags, true},
+		{[]string{"perm:edit_tags"}, PermDeleteTags, false},
+		{[]string{"perm:not_a_permission"}, PermDeleteTags, false},
+		{[]string{"some_group"}, PermEditAllGifs, false},
+		{[]string{}, PermEditAllGifs, false},
+	}
+	for _, tc := range testCases {
+		user := &User{Username: "user", Groups: &tc.groups}
+		// roles aren't loaded, so this doesn't touch the database
+		err := user.LoadPermissions(nil)
+		assert.NoError(t, err)
+		assert.Equal(t, tc.want, user.HasPermission(tc.permission), "%v %s", tc.groups, tc.permission)
+	}
+	var user *User
+	assert.False(t, user.HasPermission(PermEditTags))
+}
+
+func TestValidateRole(t *testing.T) {
+	assert.NoError(t, ValidateRole(Role{Name: "moderator", Permissions: []string{PermEditTags, PermDeleteTags}}))
+	assert.Error(t, ValidateRole(Role{Name: "moderator", Permissions: []string{"fly"}}))
+	assert.Error(t, ValidateRole(Role{Name: "Moderator"}))
+}
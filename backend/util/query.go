@@ -1,8 +1,13 @@
 package util
 
 import (
+	"context"
 	"errors"
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"regexp"
+	"slices"
 	"strings"
 )
 
@@ -105,3 +110,116 @@ func ParseQuery(query string, searcherUsername *string) (*ComprehensiveQuery, er
 		Sort:          sort,
 	}, nil
 }
+
+// Matches returns true if the gif is a result of the query, like the search filter built from it would.
+// Whether the searcher can access the groups isn't checked
+func (query *ComprehensiveQuery) Matches(gif *Gif) bool {
+	if query.Group != nil {
+		if gif.Group == nil || *gif.Group != *query.Group {
+			return false
+		}
+	} else if query.IncludeGroups == nil {
+		if gif.Group != nil {
+			return false
+		}
+	} else if len(*query.IncludeGroups) != 0 && gif.Group != nil && !slices.Contains(*query.IncludeGroups, *gif.Group) {
+		return false
+	}
+	if query.Uploader != "" && gif.Uploader != query.Uploader {
+		return false
+	}
+	if query.NoteRegex != "" {
+		noteRegex, err := regexp.Compile("(?i)" + query.NoteRegex)
+		if err != nil || !noteRegex.MatchString(gif.Note) {
+			return false
+		}
+	}
+	// text search matches notes containing any of the words
+	if query.NoteText != "" {
+		note := strings.ToLower(gif.Note)
+		if !slices.ContainsFunc(strings.Fields(strings.ToLower(query.NoteText)), func(word string) bool {
+			return strings.Contains(note, word)
+		}) {
+			return false
+		}
+	}
+	// the last tag is matched as a prefix, as it may still be being typed
+	for i, tag := range query.Tags {
+		if i == len(query.Tags)-1 {
+			if !slices.ContainsFunc(gif.Tags, func(gifTag string) bool { return strings.HasPrefix(gifTag, tag) }) {
+				return false
+			}
+		} else if !slices.Contains(gif.Tags, tag) {
+			return false
+		}
+	}
+	return true
+}
+
+// SavedSearchPrefix is the prefix of query tokens that are replaced with a saved search
+const SavedSearchPrefix = "saved:"
+
+// maxSavedSearchesInQuery is the most saved searches a query can use
+const maxSavedSearchesInQuery = 5
+
+var ErrSavedSearchNotFound = errors.New("saved search not found")
+var ErrTooManySavedSearches = errors.New("too many saved searches(>5)")
+
+// ExpandSavedSearches replaces the saved:<name> and saved:<username>/<name> tokens in the query with the saved
+// searches, the user can use their own searches and ones shared with their groups.
+// saved:<name> is the user's own search if they have one with the name, otherwise one shared with them
+func ExpandSavedSearches(ctx context.Context, query string, user *User) (string, error) {
+	return expandSavedSearches(query, func(owner, name string) (string, error) {
+		if user == nil {
+			return "", errors.New("saved searches can only be used when signed in")
+		}
+		var search SavedSearch
+		var err error
+		if owner == "" || owner == user.Username {
+			err = SavedSearchesCol.FindOne(ctx, bson.M{"username": user.Username, "name": name}).Decode(&search)
+			if err == nil || owner != "" || !errors.Is(err, mongo.ErrNoDocuments) || user.Groups == nil {
+				return search.Query, savedSearchError(err)
+			}
+			err = SavedSearchesCol.FindOne(ctx, bson.M{"name": name, "group": bson.M{"$in": *user.Groups}},
+				options.FindOne().SetSort(bson.M{"_id": 1})).Decode(&search)
+			return search.Query, savedSearchError(err)
+		}
+		err = SavedSearchesCol.FindOne(ctx, bson.M{"username": owner, "name": name}).Decode(&search)
+		if err == nil && (search.Group == nil || !user.HasGroup(*search.Group)) {
+			return "", ErrSavedSearchNotFound
+		}
+		return search.Query, savedSearchError(err)
+	})
+}
+
+func savedSearchError(err error) error {
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return ErrSavedSearchNotFound
+	}
+	return err
+}
+
+// expandSavedSearches replaces the saved search tokens in the query with the queries returned by lookup
+func expandSavedSearches(query string, lookup func(owner, name string) (string, error)) (string, error) {
+	fields := strings.Split(query, " ")
+	expanded := 0
+	for i, field := range fields {
+		if !strings.HasPrefix(field, SavedSearchPrefix) {
+			continue
+		}
+		expanded++
+		if expanded > maxSavedSearchesInQuery {
+			return "", ErrTooManySavedSearches
+		}
+		owner, name, found := strings.Cut(field[len(SavedSearchPrefix):], "/")
+		if !found {
+			owner, name = "", owner
+		}
+		saved, err := lookup(owner, name)
+		if err != nil {
+			return "", err
+		}
+		fields[i] = saved
+	}
+	return strings.Join(fields, " "), nil
+}
@@ -32,3 +32,66 @@ func TestParseQuery(t *testing.T) {
 		assert.Equal(t, tc.want.Sort, parsed.Sort)
 	}
 }
+
+func TestQueryMatches(t *testing.T) {
+	group := "cats"
+	gif := Gif{Tags: []string{"cat", "funny"}, Uploader: "kitty", Note: "A Sleepy cat"}
+	groupGif := Gif{Tags: []string{"cat"}, Uploader: "kitty", Group: &group}
+	user := "user"
+	testCases := []struct {
+		query string
+		gif   Gif
+		want  bool
+	}{
+		{"cat", gif, true},
+		{"cat fun", gif, true},
+		{"funny cat", gif, true},
+		{"fun cat", gif, false},
+		{"dog", gif, false},
+		{"fun dog", gif, false},
+		{"@kitty", gif, true},
+		{"@someone", gif, false},
+		{"\"sleepy\"", gif, true},
+		{"\"^cat\"", gif, false},
+		{"'dog sleepy'", gif, true},
+		{"cat", groupGif, false},
+		{"cat $ig", groupGif, true},
+		{"cat #cats", groupGif, true},
+		{"cat #cats", gif, true},
+		{"cat #!cats", gif, false},
+		{"cat #dogs", groupGif, false},
+	}
+	for _, tc := range testCases {
+		query, err := ParseQuery(tc.query, &user)
+		assert.NoError(t, err)
+		assert.Equal(t, tc.want, query.Matches(&tc.gif), tc.query)
+	}
+}
+
+func TestExpandSavedSearches(t *testing.T) {
+	saved := map[string]string{
+		"/hugs":      "hug sort:new",
+		"jan/team":   "@jan #!team",
+		"jan/quoted": "cat \"sleepy\"",
+	}
+	lookup := func(owner, name string) (string, error) {
+		query, ok := saved[owner+"/"+name]
+		if !ok {
+			return "", ErrSavedSearchNotFound
+		}
+		return query, nil
+	}
+	expanded, err := expandSavedSearches("funny saved:hugs saved:jan/team", lookup)
+	assert.NoError(t, err)
+	assert.Equal(t, "funny hug sort:new @jan #!team", expanded)
+	expanded, err = expandSavedSearches("saved:jan/quoted", lookup)
+	assert.NoError(t, err)
+	assert.Equal(t, "cat \"sleepy\"", expanded)
+	expanded, err = expandSavedSearches("no saved searches", lookup)
+	assert.NoError(t, err)
+	assert.Equal(t, "no saved searches", expanded)
+	_, err = expandSavedSearches("saved:unknown", lookup)
+	assert.ErrorIs(t, err, ErrSavedSearchNotFound)
+	_, err = expandSavedSearches("saved:hugs saved:hugs saved:hugs saved:hugs saved:hugs saved:hugs", lookup)
+	assert.Error(t, err)
+}
@@ -6,6 +6,10 @@ var (
 	UsernameValidation       = regexp.MustCompile("^[a-z0-9_]{3,20}$")
 	TagValidation            = regexp.MustCompile("^[a-z0-9_]{2,20}$")
 	TagCategoryValidation    = regexp.MustCompile("^[a-z0-9_]{2,20}$")
+	GroupValidation          = regexp.MustCompile("^[a-zA-Z0-9_:]{2,32}$")
+	RoleValidation           = regexp.MustCompile("^[a-z0-9_]{2,20}$")
+	SavedSearchValidation    = regexp.MustCompile("^[a-z0-9_-]{1,32}$")
+	SyncNamespaceValidation  = regexp.MustCompile("^[a-z0-9_-]{1,32}$")
 	ColorValidation          = regexp.MustCompile("(?i)^[0-9a-f]{6}$")
 	IsTenorUrl               = regexp.MustCompile("(?i)^https://tenor.com/view/(?:.*-)?(?P<id>\\d+)$")
 	TenorPreviewGifUrl       = regexp.MustCompile("(?i)\"mediumgif\":{\"url\":(\"https:\\\\u002F\\\\u002Fmedia[0-9]?.tenor.com\\\\u002F.+?\\\\u002F.+?\\.gif\")")
@@ -0,0 +1,70 @@
+package util
+
+import (
+	"errors"
+	"slices"
+	"time"
+)
+
+const (
+	ScopeGifsRead           = "gifs:read"
+	ScopeGifsWrite          = "gifs:write"
+	ScopeTagsWrite          = "tags:write"
+	ScopeUsersRead          = "users:read"
+	ScopeGroupsRead         = "groups:read"
+	ScopeGroupsWrite        = "groups:write"
+	ScopeNotificationsRead  = "notifications:read"
+	ScopeNotificationsWrite = "notifications:write"
+	ScopeSyncRead           = "sync:read"
+	ScopeSyncWrite          = "sync:write"
+	ScopeSearchesWrite      = "searches:write"
+)
+
+// Scopes is a list of all scopes an API token can have
+var Scopes = []string{ScopeGifsRead, ScopeGifsWrite, ScopeTagsWrite, ScopeUsersRead, ScopeGroupsRead,
+	ScopeGroupsWrite, ScopeNotificationsRead, ScopeNotificationsWrite, ScopeSyncRead, ScopeSyncWrite,
+	ScopeSearchesWrite}
+
+// ApiTokenPrefix is prepended to API tokens to make them recognisable
+const ApiTokenPrefix = "kgp_"
+
+type ApiToken struct {
+	Id string `json:"id" bson:"id"`
+	// Token is only present when the token is created, only its hash is stored
+	Token      string     `json:"token,omitempty" bson:"-"`
+	TokenHash  string     `json:"-" bson:"_id"`
+	Username   string     `json:"username" bson:"username"`
+	Name       string     `json:"name" bson:"name"`
+	Scopes     []string   `json:"scopes" bson:"scopes"`
+	CreatedAt  time.Time  `json:"createdAt" bson:"createdAt"`
+	LastUsedAt *time.Time `json:"lastUsedAt,omitempty" bson:"lastUsedAt,omitempty"`
+	// ExpiresAt if not present the token never expires
+	ExpiresAt *time.Time `json:"expiresAt,omitempty" bson:"expiresAt,omitempty"`
+}
+
+// HasScope returns true if the token has the scope
+func (token *ApiToken) HasScope(scope string) bool {
+	return slices.Contains(token.Scopes, scope)
+}
+
+// ValidateApiToken Returns nil if the token's name and scopes are valid, otherwise returns an error
+func ValidateApiToken(token ApiToken) error {
+	if token.Name == "" {
+		return errors.New("name is empty")
+	}
+	if len(token.Name) > 64 {
+		return errors.New("name is too long(>64)")
+	}
+	if len(token.Scopes) == 0 {
+		return errors.New("no scopes")
+	}
+	for index, scope := range token.Scopes {
+		if !slices.Contains(Scopes, scope) {
+			return errors.New("unknown scope: " + scope)
+		}
+		if slices.Index(token.Scopes, scope) != index {
+			return errors.New("duplicate scope: " + scope)
+		}
+	}
+	return nil
+}
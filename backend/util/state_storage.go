@@ -0,0 +1,45 @@
+package util
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+)
+
+// StateStorage is the storage of the Logto client for one sign-in flow, kept in a StateStore
+type StateStorage struct {
+	Store StateStore
+	// FlowId identifies the sign-in flow, it is kept in the flow's cookie
+	FlowId string
+	TTL    time.Duration
+}
+
+func (storage *StateStorage) key(key string) string {
+	return "logto:flow:" + storage.FlowId + ":" + key
+}
+
+func (storage *StateStorage) GetItem(key string) string {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	value, err := storage.Store.Get(ctx, storage.key(key))
+	if err != nil && !errors.Is(err, ErrStateNotFound) {
+		log.Println("failed to get sign-in state:", err)
+	}
+	return value
+}
+
+func (storage *StateStorage) SetItem(key, value string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	var err error
+	// the Logto client clears items by setting them to an empty string
+	if value == "" {
+		err = storage.Store.Delete(ctx, storage.key(key))
+	} else {
+		err = storage.Store.Set(ctx, storage.key(key), value, storage.TTL)
+	}
+	if err != nil {
+		log.Println("failed to set sign-in state:", err)
+	}
+}
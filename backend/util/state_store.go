@@ -0,0 +1,128 @@
+package util
+
+import (
+	"context"
+	"errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"sync"
+	"time"
+)
+
+var ErrStateNotFound = errors.New("state not found or expired")
+
+// StateStore stores short-lived values, like the state of sign-in flows, so they survive restarts and expire on their own
+type StateStore interface {
+	// Set stores the value under the key until the TTL passes
+	Set(ctx context.Context, key, value string, ttl time.Duration) error
+	// Get returns the value, or ErrStateNotFound if it doesn't exist or has expired
+	Get(ctx context.Context, key string) (string, error)
+	// Take returns the value and deletes it so it can only be used once
+	Take(ctx context.Context, key string) (string, error)
+	Delete(ctx context.Context, key string) error
+}
+
+// MongoStateStore is a StateStore in a collection with a TTL index on expiresAt
+type MongoStateStore struct {
+	Col *mongo.Collection
+	// HashKey is applied to keys before storing them, so they can't be used by someone with access to the database
+	HashKey func(key string) string
+}
+
+type mongoState struct {
+	Key       string    `bson:"_id"`
+	Value     string    `bson:"value"`
+	ExpiresAt time.Time `bson:"expiresAt"`
+}
+
+func (store *MongoStateStore) Set(ctx context.Context, key, value string, ttl time.Duration) error {
+	TRUE := true
+	_, err := store.Col.ReplaceOne(ctx, bson.M{"_id": store.HashKey(key)}, mongoState{
+		Key:       store.HashKey(key),
+		Value:     value,
+		ExpiresAt: time.Now().Add(ttl),
+	}, &options.ReplaceOptions{Upsert: &TRUE})
+	return err
+}
+
+func (store *MongoStateStore) Get(ctx context.Context, key string) (string, error) {
+	var state mongoState
+	// expired states are only removed by the TTL index periodically
+	err := store.Col.FindOne(ctx, bson.M{"_id": store.HashKey(key), "expiresAt": bson.M{"$gt": time.Now()}}).Decode(&state)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return "", ErrStateNotFound
+	}
+	return state.Value, err
+}
+
+func (store *MongoStateStore) Take(ctx context.Context, key string) (string, error) {
+	var state mongoState
+	err := store.Col.FindOneAndDelete(ctx, bson.M{"_id": store.HashKey(key), "expiresAt": bson.M{"$gt": time.Now()}}).Decode(&state)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return "", ErrStateNotFound
+	}
+	return state.Value, err
+}
+
+func (store *MongoStateStore) Delete(ctx context.Context, key string) error {
+	_, err := store.Col.DeleteOne(ctx, bson.M{"_id": store.HashKey(key)})
+	return err
+}
+
+// MemoryStateStore is a StateStore for a single instance and tests, values are lost on restart
+type MemoryStateStore struct {
+	mutex  sync.Mutex
+	states map[string]memoryState
+}
+
+type memoryState struct {
+	value     string
+	expiresAt time.Time
+}
+
+func NewMemoryStateStore() *MemoryStateStore {
+	return &MemoryStateStore{states: make(map[string]memoryState)}
+}
+
+func (store *MemoryStateStore) Set(ctx context.Context, key, value string, ttl time.Duration) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	now := time.Now()
+	// remove expired states so unused ones don't pile up
+	for k, state := range store.states {
+		if !state.expiresAt.After(now) {
+			delete(store.states, k)
+		}
+	}
+	store.states[key] = memoryState{value: value, expiresAt: now.Add(ttl)}
+	return nil
+}
+
+func (store *MemoryStateStore) Get(ctx context.Context, key string) (string, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	state, ok := store.states[key]
+	if !ok || !state.expiresAt.After(time.Now()) {
+		return "", ErrStateNotFound
+	}
+	return state.value, nil
+}
+
+func (store *MemoryStateStore) Take(ctx context.Context, key string) (string, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	state, ok := store.states[key]
+	delete(store.states, key)
+	if !ok || !state.expiresAt.After(time.Now()) {
+		return "", ErrStateNotFound
+	}
+	return state.value, nil
+}
+
+func (store *MemoryStateStore) Delete(ctx context.Context, key string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	delete(store.states, key)
+	return nil
+}
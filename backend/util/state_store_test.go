@@ -0,0 +1,32 @@
+package util
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestMemoryStateStore(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStateStore()
+
+	assert.NoError(t, store.Set(ctx, "a", "value", time.Minute))
+	value, err := store.Get(ctx, "a")
+	assert.NoError(t, err)
+	assert.Equal(t, "value", value)
+
+	// take only works once
+	value, err = store.Take(ctx, "a")
+	assert.NoError(t, err)
+	assert.Equal(t, "value", value)
+	_, err = store.Take(ctx, "a")
+	assert.ErrorIs(t, err, ErrStateNotFound)
+
+	assert.NoError(t, store.Set(ctx, "expired", "value", -time.Second))
+	_, err = store.Get(ctx, "expired")
+	assert.ErrorIs(t, err, ErrStateNotFound)
+	// expired states are removed when others are set
+	assert.NoError(t, store.Set(ctx, "b", "value", time.Minute))
+	assert.Len(t, store.states, 1)
+}
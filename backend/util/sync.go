@@ -0,0 +1,76 @@
+package util
+
+import (
+	"errors"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// DefaultSyncNamespace is used by the frontend, sync settings from before namespaces were added are migrated into it
+const DefaultSyncNamespace = "settings"
+
+// DefaultSyncMaxSize is the size limit of namespaces without one configured
+const DefaultSyncMaxSize = 4_000
+
+// MaxSyncNamespaces is the most sync namespaces a user can have
+const MaxSyncNamespaces = 20
+
+// SyncNamespace gets the configuration of a sync namespace, with the defaults applied
+func (config *Configuration) SyncNamespace(namespace string) SyncNamespaceConfiguration {
+	namespaceConfig := config.SyncNamespaces[namespace]
+	if namespaceConfig.MaxSize == 0 {
+		namespaceConfig.MaxSize = DefaultSyncMaxSize
+	}
+	return namespaceConfig
+}
+
+// ValidateSyncNamespaces checks the names and schemas of the configured sync namespaces
+func (config *Configuration) ValidateSyncNamespaces() error {
+	for namespace, namespaceConfig := range config.SyncNamespaces {
+		if !SyncNamespaceValidation.MatchString(namespace) {
+			return errors.New("invalid sync namespace " + namespace)
+		}
+		if namespaceConfig.MaxSize < 0 {
+			return errors.New("invalid maxSize of sync namespace " + namespace)
+		}
+		if namespaceConfig.Schema != nil {
+			if err := namespaceConfig.Schema.Check(); err != nil {
+				return errors.New("invalid schema of sync namespace " + namespace + ": " + err.Error())
+			}
+		}
+	}
+	return nil
+}
+
+// MergePatch applies a JSON Merge Patch (RFC 7396) to the target, null values in the patch remove fields
+// and objects are merged recursively, anything else replaces the value in the target
+func MergePatch(target interface{}, patch interface{}) interface{} {
+	patchObject, ok := asObject(patch)
+	if !ok {
+		return patch
+	}
+	result := make(map[string]interface{})
+	if targetObject, ok := asObject(target); ok {
+		for key, value := range targetObject {
+			result[key] = value
+		}
+	}
+	for key, value := range patchObject {
+		if value == nil {
+			delete(result, key)
+		} else {
+			result[key] = MergePatch(result[key], value)
+		}
+	}
+	return result
+}
+
+// asObject also accepts bson.M, which objects decoded from the database can be
+func asObject(value interface{}) (map[string]interface{}, bool) {
+	switch object := value.(type) {
+	case map[string]interface{}:
+		return object, true
+	case bson.M:
+		return object, true
+	}
+	return nil, false
+}
@@ -0,0 +1,36 @@
+package util
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+	"testing"
+)
+
+func TestMergePatch(t *testing.T) {
+	// examples from RFC 7396
+	for _, example := range []struct{ target, patch, result string }{
+		{`{"a":"b"}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":"b"}`, `{"b":"c"}`, `{"a":"b","b":"c"}`},
+		{`{"a":"b"}`, `{"a":null}`, `{}`},
+		{`{"a":"b","b":"c"}`, `{"a":null}`, `{"b":"c"}`},
+		{`{"a":["b"]}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":"c"}`, `{"a":["b"]}`, `{"a":["b"]}`},
+		{`{"a":{"b":"c"}}`, `{"a":{"b":"d","c":null}}`, `{"a":{"b":"d"}}`},
+		{`{"a":[{"b":"c"}]}`, `{"a":[1]}`, `{"a":[1]}`},
+		{`{"e":null}`, `{"a":1}`, `{"e":null,"a":1}`},
+		{`[1,2]`, `{"a":"b","c":null}`, `{"a":"b"}`},
+		{`{}`, `{"a":{"bb":{"ccc":null}}}`, `{"a":{"bb":{}}}`},
+	} {
+		var target, patch interface{}
+		require.NoError(t, json.Unmarshal([]byte(example.target), &target))
+		require.NoError(t, json.Unmarshal([]byte(example.patch), &patch))
+		result, err := json.Marshal(MergePatch(target, patch))
+		require.NoError(t, err)
+		assert.JSONEq(t, example.result, string(result), example.patch)
+	}
+	// objects decoded from the database
+	result := MergePatch(bson.M{"a": bson.M{"b": 1, "c": 2}}, map[string]interface{}{"a": map[string]interface{}{"c": nil}})
+	assert.Equal(t, map[string]interface{}{"a": map[string]interface{}{"b": 1}}, result)
+}
@@ -0,0 +1,176 @@
+package util
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/alexedwards/argon2id"
+	"go.mongodb.org/mongo-driver/bson"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	totpPeriod = 30
+	totpDigits = 6
+	// totpSkew is how many periods before and after the current one are accepted
+	totpSkew = 1
+)
+
+// RecoveryCodeArgon2idParams are lighter than Argon2idParams, as recovery codes are random and
+// several hashes need to be checked for every attempt
+var RecoveryCodeArgon2idParams = &argon2id.Params{
+	Memory:      32 * 1024,
+	Iterations:  2,
+	Parallelism: 2,
+	SaltLength:  16,
+	KeyLength:   32,
+}
+
+type UserTotp struct {
+	// Secret is the base32 encoded shared secret
+	Secret  string `bson:"secret"`
+	Enabled bool   `bson:"enabled"`
+	// RecoveryCodes are argon2id hashes of the unused recovery codes
+	RecoveryCodes []string `bson:"recoveryCodes"`
+	// LastStep is the time step of the last accepted code, so that a code can't be used twice
+	LastStep int64 `bson:"lastStep"`
+}
+
+// GenerateTotpSecret generates a new base32 encoded TOTP secret
+func GenerateTotpSecret() string {
+	secret := make([]byte, 20)
+	if _, err := rand.Read(secret); err != nil {
+		panic(fmt.Sprintf("Failed to generate TOTP secret: %v", err))
+	}
+	return base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(secret)
+}
+
+// TotpUri returns the otpauth URI used to add the secret to an authenticator app
+func TotpUri(issuer, username, secret string) string {
+	query := url.Values{}
+	query.Set("secret", secret)
+	query.Set("issuer", issuer)
+	query.Set("algorithm", "SHA1")
+	query.Set("digits", fmt.Sprint(totpDigits))
+	query.Set("period", fmt.Sprint(totpPeriod))
+	return "otpauth://totp/" + url.PathEscape(issuer+":"+username) + "?" + query.Encode()
+}
+
+// TotpCode computes the code for the secret at the time step as in RFC 6238
+func TotpCode(secret string, step int64) (string, error) {
+	key, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return "", err
+	}
+	counter := make([]byte, 8)
+	binary.BigEndian.PutUint64(counter, uint64(step))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(counter)
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	modulo := uint32(1)
+	for i := 0; i < totpDigits; i++ {
+		modulo *= 10
+	}
+	return fmt.Sprintf("%0*d", totpDigits, value%modulo), nil
+}
+
+// TotpStep returns the time step of the time
+func TotpStep(t time.Time) int64 {
+	return t.Unix() / totpPeriod
+}
+
+// CheckTotpCode returns the time step the code matches, allowing for clock skew,
+// steps at or before lastStep are not accepted so that codes can't be reused
+func CheckTotpCode(secret, code string, t time.Time, lastStep int64) (int64, bool) {
+	current := TotpStep(t)
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if step <= lastStep {
+			continue
+		}
+		expected, err := TotpCode(secret, step)
+		if err != nil {
+			return 0, false
+		}
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// GenerateRecoveryCodes generates recovery codes and their argon2id hashes
+func GenerateRecoveryCodes(count int) (codes []string, hashes []string, err error) {
+	for i := 0; i < count; i++ {
+		code := strings.ToLower(GenerateRandomString(5) + "-" + GenerateRandomString(5))
+		hash, err := argon2id.CreateHash(code, RecoveryCodeArgon2idParams)
+		if err != nil {
+			return nil, nil, err
+		}
+		codes = append(codes, code)
+		hashes = append(hashes, hash)
+	}
+	return codes, hashes, nil
+}
+
+// MatchRecoveryCode returns the index of the hash the code matches, or -1 if none does
+func MatchRecoveryCode(code string, hashes []string) (int, error) {
+	code = strings.ToLower(strings.TrimSpace(code))
+	for i, hash := range hashes {
+		match, err := argon2id.ComparePasswordAndHash(code, hash)
+		if err != nil {
+			return -1, err
+		}
+		if match {
+			return i, nil
+		}
+	}
+	return -1, nil
+}
+
+// TotpEnabled returns true if the user has finished enrolling TOTP
+func (user *User) TotpEnabled() bool {
+	return user.Totp != nil && user.Totp.Enabled
+}
+
+// SuspendTotpGroups removes the groups that require TOTP from the user's groups if the user hasn't enabled it,
+// the removed groups are put in User.SuspendedGroups. This only changes the user in memory.
+func (user *User) SuspendTotpGroups(ctx context.Context) error {
+	if user.Groups == nil || len(*user.Groups) == 0 || user.TotpEnabled() {
+		return nil
+	}
+	cur, err := GroupsCol.Find(ctx, bson.M{"_id": bson.M{"$in": *user.Groups}, "requireTotp": true})
+	if err != nil {
+		return err
+	}
+	var required []Group
+	err = cur.All(ctx, &required)
+	if err != nil {
+		return err
+	}
+	if len(required) == 0 {
+		return nil
+	}
+	groups := make([]string, 0, len(*user.Groups))
+	for _, group := range *user.Groups {
+		if slices.ContainsFunc(required, func(g Group) bool { return g.Name == group }) {
+			user.SuspendedGroups = append(user.SuspendedGroups, group)
+		} else {
+			groups = append(groups, group)
+		}
+	}
+	user.Groups = &groups
+	return nil
+}
+
+var ErrInvalidTotpCode = errors.New("invalid code")
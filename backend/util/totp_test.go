@@ -0,0 +1,40 @@
+package util
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+// the SHA1 test vectors from RFC 6238, truncated to 6 digits
+func TestTotpCode(t *testing.T) {
+	secret := "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+	vectors := map[int64]string{
+		59:         "287082",
+		1111111109: "081804",
+		1234567890: "005924",
+		2000000000: "279037",
+	}
+	for unix, expected := range vectors {
+		code, err := TotpCode(secret, TotpStep(time.Unix(unix, 0)))
+		assert.NoError(t, err)
+		assert.Equal(t, expected, code)
+	}
+}
+
+func TestCheckTotpCode(t *testing.T) {
+	secret := GenerateTotpSecret()
+	now := time.Now()
+	code, err := TotpCode(secret, TotpStep(now)-1)
+	assert.NoError(t, err)
+
+	// codes from the previous step are accepted
+	step, ok := CheckTotpCode(secret, code, now, 0)
+	assert.True(t, ok)
+	assert.Equal(t, TotpStep(now)-1, step)
+	// but not once they have been used
+	_, ok = CheckTotpCode(secret, code, now, step)
+	assert.False(t, ok)
+	_, ok = CheckTotpCode(secret, "000000", now.Add(time.Hour), 0)
+	assert.False(t, ok)
+}
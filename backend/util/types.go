@@ -1,5 +1,14 @@
 package util
 
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"regexp"
+	"time"
+)
+
 type Gif struct {
 	Id               string   `json:"id" bson:"_id"`
 	Url              string   `json:"url" bson:"url"`
@@ -19,10 +28,38 @@ type Size struct {
 }
 
 type User struct {
-	Username     string    `json:"username" bson:"_id"`
-	LogtoId      *string   `json:"logtoId,omitempty" bson:"logtoId,omitempty"`
-	PasswordHash string    `json:"passwordHash" bson:"passwordHash"`
-	Groups       *[]string `json:"groups,omitempty" bson:"groups,omitempty"`
+	Username string `json:"username" bson:"_id"`
+	// Identities are the accounts at identity providers the user can sign in with
+	Identities   []Identity `json:"-" bson:"identities,omitempty"`
+	PasswordHash string     `json:"passwordHash" bson:"passwordHash"`
+	Groups       *[]string  `json:"groups,omitempty" bson:"groups,omitempty"`
+	Totp         *UserTotp  `json:"-" bson:"totp,omitempty"`
+	Email        *string    `json:"-" bson:"email,omitempty"`
+	// EmailVerified is true once the user has confirmed they own Email
+	EmailVerified bool `json:"-" bson:"emailVerified,omitempty"`
+	// Permissions are the user's effective permissions, populated by LoadPermissions
+	Permissions []string `json:"-" bson:"-"`
+	// SuspendedGroups are groups the user is a member of but that require TOTP which the user hasn't enabled,
+	// populated by SuspendTotpGroups
+	SuspendedGroups []string `json:"-" bson:"-"`
+	// NotificationPreferences are how the user receives notifications, the defaults are used if not set
+	NotificationPreferences *NotificationPreferences `json:"-" bson:"notificationPreferences,omitempty"`
+	// Tombstone is set on the DeletedUsername user, to tell it apart from an account created before the name was reserved
+	Tombstone bool `json:"-" bson:"tombstone,omitempty"`
+}
+
+// NotificationPreferences are the channels a user receives each notification type through
+type NotificationPreferences struct {
+	// Channels are the channels of each notification type, types not in it are only delivered in-app
+	Channels map[string][]string `json:"channels" bson:"channels"`
+	// WebhookUrl is where notifications of the webhook channel are posted
+	WebhookUrl string `json:"webhookUrl" bson:"webhookUrl,omitempty"`
+}
+
+// Identity is an account at an identity provider, Provider is "logto" or the ID of an OIDC provider
+type Identity struct {
+	Provider string `json:"provider" bson:"provider"`
+	Subject  string `json:"subject" bson:"subject"`
 }
 
 // HasGroups Returns true if user has all the specified groups or is admin, otherwise returns false
@@ -64,8 +101,31 @@ func (user *User) HasGroup(group string) bool {
 }
 
 type UserSession struct {
+	// Id identifies the session without revealing its token
+	Id       string `json:"id" bson:"id"`
 	Username string `json:"username" bson:"username"`
-	Token    string `json:"token" bson:"_id"`
+	// Token is only present when the session is created, only its hash is stored
+	Token      string    `json:"token,omitempty" bson:"-"`
+	TokenHash  string    `json:"-" bson:"_id"`
+	CreatedAt  time.Time `json:"createdAt" bson:"createdAt"`
+	LastUsedAt time.Time `json:"lastUsedAt" bson:"lastUsedAt"`
+	// ExpiresAt is the earlier of LastUsedAt + Configuration.SessionIdleDays
+	// and CreatedAt + Configuration.SessionMaxAgeDays
+	ExpiresAt time.Time `json:"expiresAt" bson:"expiresAt"`
+	UserAgent string    `json:"userAgent" bson:"userAgent"`
+	Ip        string    `json:"ip" bson:"ip"`
+	// Current is true for the session used to make the request, only set when listing sessions
+	Current bool `json:"current,omitempty" bson:"-"`
+}
+
+// ExpiryAfterUse returns when the session expires if it is used at the given time
+func (session *UserSession) ExpiryAfterUse(config *Configuration, usedAt time.Time) time.Time {
+	idleExpiry := usedAt.Add(time.Duration(config.SessionIdleDays) * 24 * time.Hour)
+	absoluteExpiry := session.CreatedAt.Add(time.Duration(config.SessionMaxAgeDays) * 24 * time.Hour)
+	if idleExpiry.Before(absoluteExpiry) {
+		return idleExpiry
+	}
+	return absoluteExpiry
 }
 
 type Configuration struct {
@@ -78,6 +138,76 @@ type Configuration struct {
 	Captcha                  *CaptchaConfiguration `json:"captcha"`
 	ApiUrl                   string                `json:"apiUrl"`
 	Logto                    *LogtoConfiguration   `json:"logto"`
+	// AuditLogRetentionDays is how long audit log entries are kept, 0 keeps them forever
+	AuditLogRetentionDays int `json:"auditLogRetentionDays"`
+	// SessionIdleDays is how long a session can go unused before it expires
+	SessionIdleDays int `json:"sessionIdleDays"`
+	// SessionMaxAgeDays is how long after being created a session expires, even if it is used
+	SessionMaxAgeDays int `json:"sessionMaxAgeDays"`
+	// Secret is used as the key for hashing tokens stored in the database
+	Secret string `json:"secret"`
+	// Smtp is used for sending emails, email features are disabled if not set
+	Smtp *SmtpConfiguration `json:"smtp"`
+	// FrontendUrl is used for links in emails
+	FrontendUrl string `json:"frontendUrl"`
+	// GdprDeletionDelayDays is how long after being requested an account deletion is carried out if an admin doesn't approve it sooner
+	GdprDeletionDelayDays int `json:"gdprDeletionDelayDays"`
+	// GdprExportRetentionDays is how long data exports can be downloaded for
+	GdprExportRetentionDays int `json:"gdprExportRetentionDays"`
+	// Oidc are the OpenID Connect providers users can sign in with
+	Oidc []OidcProviderConfiguration `json:"oidc"`
+	// InviteOnlySignup requires a signup invite to create an account when AllowSignup is set
+	InviteOnlySignup bool `json:"inviteOnlySignup"`
+	// NotificationBackend is how notification events from all instances are delivered to streams,
+	// "polling" (default) or "changeStream"
+	NotificationBackend string `json:"notificationBackend"`
+	// SyncHistorySize is how many previous versions of a user's sync settings are kept
+	SyncHistorySize int `json:"syncHistorySize"`
+	// SyncNamespaces configures the size limit and schema of sync namespaces, other namespaces use the defaults
+	SyncNamespaces map[string]SyncNamespaceConfiguration `json:"syncNamespaces"`
+	// Metrics enables the Prometheus metrics endpoint if set
+	Metrics *MetricsConfiguration `json:"metrics"`
+}
+
+type SyncNamespaceConfiguration struct {
+	// MaxSize is the most bytes the data can take up as JSON, defaults to DefaultSyncMaxSize
+	MaxSize int `json:"maxSize"`
+	// Schema is validated on every write if set
+	Schema *JsonSchema `json:"schema"`
+}
+
+// HashToken hashes a token for storing in the database, keyed with Configuration.Secret
+func (config *Configuration) HashToken(token string) string {
+	mac := hmac.New(sha256.New, []byte(config.Secret))
+	mac.Write([]byte(token))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// DeriveKey derives a 32 byte key for the purpose from Configuration.Secret
+func (config *Configuration) DeriveKey(purpose string) []byte {
+	mac := hmac.New(sha256.New, []byte(config.Secret))
+	mac.Write([]byte("kittygifs key: " + purpose))
+	return mac.Sum(nil)
+}
+
+var oidcProviderIdValidation = regexp.MustCompile(`^[a-z0-9-]{1,32}$`)
+
+// ValidateOidc checks that the OIDC providers have unique IDs that can be used in routes
+func (config *Configuration) ValidateOidc() error {
+	ids := make(map[string]bool)
+	for _, provider := range config.Oidc {
+		if !oidcProviderIdValidation.MatchString(provider.Id) {
+			return errors.New("invalid OIDC provider ID " + provider.Id + ", it must be lowercase letters, numbers and dashes")
+		}
+		if provider.Id == "logto" || ids[provider.Id] {
+			return errors.New("duplicate OIDC provider ID " + provider.Id)
+		}
+		if provider.Issuer == "" || provider.ClientId == "" {
+			return errors.New("OIDC provider " + provider.Id + " needs an issuer and clientId")
+		}
+		ids[provider.Id] = true
+	}
+	return nil
 }
 
 type CaptchaConfiguration struct {
@@ -85,6 +215,32 @@ type CaptchaConfiguration struct {
 	SecretKey string `json:"secretKey"`
 }
 
+type SmtpConfiguration struct {
+	Host     string `json:"host"`
+	Port     int    `json:"port"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+	// From is the address emails are sent from, e.g. "kittygifs <noreply@example.com>"
+	From string `json:"from"`
+}
+
+type MetricsConfiguration struct {
+	// Token is required as a bearer token to get the metrics
+	Token string `json:"token"`
+}
+
+type OidcProviderConfiguration struct {
+	// Id is used in the routes of the provider and stored on users, it must not change once users have signed in
+	Id string `json:"id"`
+	// Name is shown to users
+	Name string `json:"name"`
+	// Issuer is the issuer URL, the provider is configured through its discovery document
+	Issuer       string   `json:"issuer"`
+	ClientId     string   `json:"clientId"`
+	ClientSecret string   `json:"clientSecret"`
+	Scopes       []string `json:"scopes"`
+}
+
 type LogtoConfiguration struct {
 	Endpoint          string `json:"endpoint"`
 	AppId             string `json:"appId"`
@@ -96,12 +252,57 @@ type UserInfo struct {
 	Username string     `json:"username"`
 	Groups   *[]string  `json:"groups,omitempty"`
 	Stats    *UserStats `json:"stats,omitempty"`
+	// GroupDetails is only present when getting your own info
+	GroupDetails *[]Group `json:"groupDetails,omitempty"`
+	// TotpEnabled is only present when getting your own info
+	TotpEnabled *bool `json:"totpEnabled,omitempty"`
+	// SuspendedGroups are the groups that require TOTP which you haven't enabled, only present when getting your own info
+	SuspendedGroups *[]string `json:"suspendedGroups,omitempty"`
+	// Email and EmailVerified are only present when getting your own info
+	Email         *string `json:"email,omitempty"`
+	EmailVerified *bool   `json:"emailVerified,omitempty"`
 }
 
 type UserStats struct {
 	Uploads int64 `json:"uploads"`
 }
 
+type Group struct {
+	Name        string   `json:"name" bson:"_id"`
+	Description *string  `json:"description,omitempty" bson:"description,omitempty"`
+	Owners      []string `json:"owners" bson:"owners"`
+	// IsPermission is true for groups that grant permissions(admin, perm:*, role:*),
+	// members of these can only be managed by admins
+	IsPermission bool `json:"isPermission" bson:"isPermission"`
+	// RequireTotp makes the group only take effect for members that have enabled TOTP
+	RequireTotp bool `json:"requireTotp" bson:"requireTotp"`
+}
+
+type GroupInvite struct {
+	Code      string    `json:"code" bson:"_id"`
+	Group     string    `json:"group" bson:"group"`
+	CreatedBy string    `json:"createdBy" bson:"createdBy"`
+	ExpiresAt time.Time `json:"expiresAt" bson:"expiresAt"`
+	MaxUses   int32     `json:"maxUses" bson:"maxUses"`
+	Uses      int32     `json:"uses" bson:"uses"`
+	// Username if present is the only user that can use the invite
+	Username *string `json:"username,omitempty" bson:"username,omitempty"`
+}
+
+// SignupInvite lets people create an account when Configuration.InviteOnlySignup is set
+type SignupInvite struct {
+	Code      string    `json:"code" bson:"_id"`
+	CreatedBy string    `json:"createdBy" bson:"createdBy"`
+	CreatedAt time.Time `json:"createdAt" bson:"createdAt"`
+	ExpiresAt time.Time `json:"expiresAt" bson:"expiresAt"`
+	MaxUses   int32     `json:"maxUses" bson:"maxUses"`
+	Uses      int32     `json:"uses" bson:"uses"`
+	// Groups are given to users that sign up with the invite
+	Groups []string `json:"groups" bson:"groups"`
+	// UsedBy are the usernames of the users that signed up with the invite
+	UsedBy []string `json:"usedBy" bson:"usedBy"`
+}
+
 type Tag struct {
 	Name         string    `json:"name" bson:"_id"`
 	Count        int32     `json:"count" bson:"count"`
@@ -110,6 +311,50 @@ type Tag struct {
 	Implications *[]string `json:"implications,omitempty" bson:"implications,omitempty"`
 }
 
+// TagSubscription notifies the user of new gifs with the tag or matching the search query
+type TagSubscription struct {
+	Id       string `json:"id" bson:"_id"`
+	Username string `json:"username" bson:"username"`
+	// Tag is set for subscriptions to a single tag, otherwise Query is a search query
+	Tag       string    `json:"tag,omitempty" bson:"tag,omitempty"`
+	Query     string    `json:"query,omitempty" bson:"query,omitempty"`
+	CreatedAt time.Time `json:"createdAt" bson:"createdAt"`
+}
+
+// SyncSettings are the data a client stores in a sync namespace
+type SyncSettings struct {
+	Id        string                 `json:"-" bson:"_id"`
+	Username  string                 `json:"-" bson:"username"`
+	Namespace string                 `json:"namespace" bson:"namespace"`
+	Data      map[string]interface{} `json:"data,omitempty" bson:"data"`
+	// Version is incremented on every change, it is sent in the ETag with the ID
+	Version   int64     `json:"version" bson:"version"`
+	UpdatedAt time.Time `json:"updatedAt" bson:"updatedAt"`
+}
+
+// SyncSettingsVersion is a previous version of a user's sync settings
+type SyncSettingsVersion struct {
+	Id        string                 `json:"-" bson:"_id"`
+	Username  string                 `json:"-" bson:"username"`
+	Namespace string                 `json:"-" bson:"namespace"`
+	Data      map[string]interface{} `json:"data" bson:"data"`
+	Version   int64                  `json:"version" bson:"version"`
+	// SavedAt is when the version was saved, not when it was replaced
+	SavedAt time.Time `json:"savedAt" bson:"savedAt"`
+}
+
+// SavedSearch is a named search query that can be used in other queries as saved:<name>
+type SavedSearch struct {
+	Id       string `json:"id" bson:"_id"`
+	Username string `json:"username" bson:"username"`
+	Name     string `json:"name" bson:"name"`
+	Query    string `json:"query" bson:"query"`
+	// Group is the group the search is shared with, its members can use it as saved:<username>/<name>
+	Group     *string   `json:"group,omitempty" bson:"group,omitempty"`
+	CreatedAt time.Time `json:"createdAt" bson:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt" bson:"updatedAt"`
+}
+
 type TagCategory struct {
 	Name        string  `json:"name" bson:"_id"`
 	Description *string `json:"description,omitempty" bson:"description,omitempty"`
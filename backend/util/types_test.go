@@ -0,0 +1,47 @@
+package util
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestSessionExpiryAfterUse(t *testing.T) {
+	config := &Configuration{SessionIdleDays: 30, SessionMaxAgeDays: 365}
+	createdAt := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	session := UserSession{CreatedAt: createdAt}
+	day := 24 * time.Hour
+
+	// idle expiry slides with use
+	assert.Equal(t, createdAt.Add(30*day), session.ExpiryAfterUse(config, createdAt))
+	assert.Equal(t, createdAt.Add(130*day), session.ExpiryAfterUse(config, createdAt.Add(100*day)))
+	// but never past the absolute expiry
+	assert.Equal(t, createdAt.Add(365*day), session.ExpiryAfterUse(config, createdAt.Add(350*day)))
+}
+
+func TestHashToken(t *testing.T) {
+	config := &Configuration{Secret: "a secret that is long enough to be used"}
+	otherConfig := &Configuration{Secret: "a different secret that is long enough"}
+	token := SessionTokenPrefix + "abc"
+
+	assert.Equal(t, config.HashToken(token), config.HashToken(token))
+	assert.NotEqual(t, token, config.HashToken(token))
+	assert.NotEqual(t, config.HashToken(token), otherConfig.HashToken(token))
+	assert.Len(t, config.HashToken(token), 64)
+}
+
+func TestValidateOidc(t *testing.T) {
+	provider := OidcProviderConfiguration{Id: "google", Issuer: "https://accounts.google.com", ClientId: "client"}
+	config := &Configuration{Oidc: []OidcProviderConfiguration{provider}}
+	assert.NoError(t, config.ValidateOidc())
+
+	config.Oidc = []OidcProviderConfiguration{provider, provider}
+	assert.Error(t, config.ValidateOidc())
+	for _, id := range []string{"logto", "", "Google", "a/b"} {
+		provider.Id = id
+		config.Oidc = []OidcProviderConfiguration{provider}
+		assert.Error(t, config.ValidateOidc(), id)
+	}
+	config.Oidc = []OidcProviderConfiguration{{Id: "google", ClientId: "client"}}
+	assert.Error(t, config.ValidateOidc())
+}
@@ -0,0 +1,365 @@
+package webhooks
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"io"
+	. "kittygifs/util"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"time"
+)
+
+const (
+	GifCreate         = "gif.create"
+	GifEdit           = "gif.edit"
+	GifDelete         = "gif.delete"
+	TagEdit           = "tag.edit"
+	TagRename         = "tag.rename"
+	TagDelete         = "tag.delete"
+	GdprRequestCreate = "gdprRequest.create"
+	UserSignup        = "user.signup"
+)
+
+const (
+	// FormatJson posts the Payload as is
+	FormatJson = "json"
+	// FormatDiscord and FormatSlack post a summary of the event as a chat message
+	FormatDiscord = "discord"
+	FormatSlack   = "slack"
+)
+
+const (
+	DeliveryPending   = "pending"
+	DeliverySucceeded = "succeeded"
+	DeliveryFailed    = "failed"
+)
+
+const (
+	SignatureHeader = "X-Kittygifs-Signature"
+	TimestampHeader = "X-Kittygifs-Timestamp"
+	EventHeader     = "X-Kittygifs-Event"
+	DeliveryHeader  = "X-Kittygifs-Delivery"
+)
+
+const (
+	deliveryRetention = 7 * 24 * time.Hour
+	// deliveryLease is how long a delivery being sent is hidden from other instances
+	deliveryLease      = time.Minute
+	maxAttempts        = 6
+	firstRetryInterval = 30 * time.Second
+)
+
+// Events is a list of all events webhooks can subscribe to
+var Events = []string{GifCreate, GifEdit, GifDelete, TagEdit, TagRename, TagDelete, GdprRequestCreate, UserSignup}
+
+// Formats is a list of all payload formats
+var Formats = []string{FormatJson, FormatDiscord, FormatSlack}
+
+// Webhook is an URL that events are posted to, registered by admins
+type Webhook struct {
+	Id  string `json:"id" bson:"_id"`
+	Url string `json:"url" bson:"url"`
+	// Secret is the key of the signature of deliveries, only included in the response when the webhook is created
+	Secret      string    `json:"secret,omitempty" bson:"secret"`
+	Events      []string  `json:"events" bson:"events"`
+	Format      string    `json:"format" bson:"format"`
+	Description string    `json:"description" bson:"description"`
+	Enabled     bool      `json:"enabled" bson:"enabled"`
+	CreatedBy   string    `json:"createdBy" bson:"createdBy"`
+	CreatedAt   time.Time `json:"createdAt" bson:"createdAt"`
+}
+
+// Payload is the body of deliveries in the json format
+type Payload struct {
+	// Id is the ID of the delivery
+	Id    string `json:"id"`
+	Event string `json:"event"`
+	// Actor is the user that caused the event
+	Actor  string      `json:"actor"`
+	Target string      `json:"target"`
+	Data   interface{} `json:"data"`
+	Time   time.Time   `json:"time"`
+}
+
+// Delivery is a record of posting an event to a webhook, kept for deliveryRetention
+type Delivery struct {
+	Id        string `json:"id" bson:"_id"`
+	WebhookId string `json:"webhookId" bson:"webhookId"`
+	Event     string `json:"event" bson:"event"`
+	// Body is the formatted payload, so retries send exactly the same body
+	Body     string `json:"body" bson:"body"`
+	Status   string `json:"status" bson:"status"`
+	Attempts int    `json:"attempts" bson:"attempts"`
+	// ResponseStatus is the HTTP status code of the last attempt, 0 if it didn't get a response
+	ResponseStatus int    `json:"responseStatus" bson:"responseStatus"`
+	Error          string `json:"error,omitempty" bson:"error,omitempty"`
+	// NextAttemptAt is when a pending delivery is attempted next
+	NextAttemptAt time.Time `json:"nextAttemptAt" bson:"nextAttemptAt"`
+	CreatedAt     time.Time `json:"createdAt" bson:"createdAt"`
+	UpdatedAt     time.Time `json:"updatedAt" bson:"updatedAt"`
+	ExpiresAt     time.Time `json:"-" bson:"expiresAt"`
+}
+
+// Validate returns nil if the webhook has a valid URL, events and format, otherwise returns an error
+func (webhook *Webhook) Validate() error {
+	if len(webhook.Url) > 512 {
+		return errors.New("url is too long(>512)")
+	}
+	webhookUrl, err := url.Parse(webhook.Url)
+	if err != nil {
+		return errors.New("failed to parse url: " + err.Error())
+	}
+	if (webhookUrl.Scheme != "https" && webhookUrl.Scheme != "http") || webhookUrl.Host == "" {
+		return errors.New("url is not an http or https url")
+	}
+	if len(webhook.Events) == 0 {
+		return errors.New("events is empty")
+	}
+	for _, event := range webhook.Events {
+		if !slices.Contains(Events, event) {
+			return errors.New("unknown event " + event)
+		}
+	}
+	if !slices.Contains(Formats, webhook.Format) {
+		return errors.New("unknown format " + webhook.Format)
+	}
+	if len(webhook.Description) > 256 {
+		return errors.New("description is too long(>256)")
+	}
+	return nil
+}
+
+func MustPublish(actor, event, target string, data interface{}) {
+	err := Publish(context.Background(), actor, event, target, data)
+	if err != nil {
+		log.Println("failed to publish webhook event", event+":", err)
+	}
+}
+
+// Publish queues a delivery of the event to every enabled webhook subscribed to it, they are sent by Run
+func Publish(ctx context.Context, actor, event, target string, data interface{}) error {
+	cur, err := WebhooksCol.Find(ctx, bson.M{"enabled": true, "events": event})
+	if err != nil {
+		return err
+	}
+	var webhooks []Webhook
+	err = cur.All(ctx, &webhooks)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	for _, webhook := range webhooks {
+		payload := Payload{
+			Id:     NewUlid(),
+			Event:  event,
+			Actor:  actor,
+			Target: target,
+			Data:   data,
+			Time:   now,
+		}
+		body, err := FormatPayload(webhook.Format, payload)
+		if err != nil {
+			return err
+		}
+		_, err = WebhookDeliveriesCol.InsertOne(ctx, Delivery{
+			Id:            payload.Id,
+			WebhookId:     webhook.Id,
+			Event:         event,
+			Body:          string(body),
+			Status:        DeliveryPending,
+			NextAttemptAt: now,
+			CreatedAt:     now,
+			UpdatedAt:     now,
+			ExpiresAt:     now.Add(deliveryRetention),
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// FormatPayload returns the body of a delivery in the format
+func FormatPayload(format string, payload Payload) ([]byte, error) {
+	switch format {
+	case FormatDiscord:
+		return json.Marshal(map[string]string{"content": Summary(payload)})
+	case FormatSlack:
+		return json.Marshal(map[string]string{"text": Summary(payload)})
+	}
+	return json.Marshal(payload)
+}
+
+// Summary returns a line of text describing the event, for chat formats
+func Summary(payload Payload) string {
+	switch payload.Event {
+	case GifCreate:
+		return fmt.Sprintf("%s uploaded gif %s", payload.Actor, payload.Target)
+	case GifEdit:
+		return fmt.Sprintf("%s edited gif %s", payload.Actor, payload.Target)
+	case GifDelete:
+		return fmt.Sprintf("%s deleted gif %s", payload.Actor, payload.Target)
+	case TagEdit:
+		return fmt.Sprintf("%s edited tag %s", payload.Actor, payload.Target)
+	case TagRename:
+		return fmt.Sprintf("%s renamed tag %s", payload.Actor, payload.Target)
+	case TagDelete:
+		return fmt.Sprintf("%s deleted tag %s", payload.Actor, payload.Target)
+	case GdprRequestCreate:
+		if issue, ok := payload.Data.(Issue); ok {
+			return fmt.Sprintf("New GDPR %s request by %s", issue.Type, payload.Actor)
+		}
+		return fmt.Sprintf("New GDPR request by %s", payload.Actor)
+	case UserSignup:
+		return fmt.Sprintf("%s signed up", payload.Actor)
+	}
+	return payload.Event
+}
+
+// Sign returns the signature of the body sent at the timestamp, the hex encoded HMAC-SHA256
+// of "<timestamp>.<body>" keyed with the webhook's secret
+func Sign(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10) + "."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Deliverer sends queued deliveries
+type Deliverer struct {
+	Client *http.Client
+}
+
+// DefaultDeliverer is started in main
+var DefaultDeliverer = &Deliverer{Client: &http.Client{Timeout: 10 * time.Second}}
+
+// DeliveriesJob is the name Run reports its status under, see RegisterJob
+const DeliveriesJob = "webhookDeliveries"
+
+// Run sends due deliveries every interval until the context is done
+func (deliverer *Deliverer) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		err := deliverer.SendDue(ctx)
+		if err != nil && ctx.Err() == nil {
+			log.Println("failed to send webhook deliveries:", err)
+		}
+		RecordJobRun(DeliveriesJob, err)
+	}
+}
+
+// SendDue sends the pending deliveries that are due. Each is leased before sending,
+// so instances running at the same time don't send it twice
+func (deliverer *Deliverer) SendDue(ctx context.Context) error {
+	for ctx.Err() == nil {
+		now := time.Now()
+		var delivery Delivery
+		err := WebhookDeliveriesCol.FindOneAndUpdate(ctx,
+			bson.M{"status": DeliveryPending, "nextAttemptAt": bson.M{"$lte": now}},
+			bson.M{"$set": bson.M{"nextAttemptAt": now.Add(deliveryLease)}},
+			options.FindOneAndUpdate().SetSort(bson.M{"nextAttemptAt": 1})).Decode(&delivery)
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		var webhook Webhook
+		err = WebhooksCol.FindOne(ctx, bson.M{"_id": delivery.WebhookId}).Decode(&webhook)
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			_, err = WebhookDeliveriesCol.DeleteOne(ctx, bson.M{"_id": delivery.Id})
+			if err != nil {
+				return err
+			}
+			continue
+		} else if err != nil {
+			return err
+		}
+		// deliveries queued before the webhook was disabled aren't sent or retried
+		if !webhook.Enabled {
+			_, err = WebhookDeliveriesCol.UpdateOne(ctx, bson.M{"_id": delivery.Id}, bson.M{"$set": bson.M{
+				"status":    DeliveryFailed,
+				"error":     "webhook is disabled",
+				"updatedAt": time.Now(),
+			}})
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		responseStatus, sendErr := deliverer.Send(ctx, &webhook, &delivery)
+		set := NextAttempt(delivery.Attempts+1, responseStatus, sendErr, time.Now())
+		_, err = WebhookDeliveriesCol.UpdateOne(ctx, bson.M{"_id": delivery.Id}, bson.M{"$set": set})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// NextAttempt returns the fields of a delivery to set after an attempt, retrying failed attempts with
+// exponential backoff until maxAttempts
+func NextAttempt(attempts, responseStatus int, sendErr error, now time.Time) bson.M {
+	set := bson.M{
+		"attempts":       attempts,
+		"responseStatus": responseStatus,
+		"updatedAt":      now,
+		"error":          "",
+	}
+	if sendErr == nil {
+		set["status"] = DeliverySucceeded
+		return set
+	}
+	set["error"] = sendErr.Error()
+	if attempts >= maxAttempts {
+		set["status"] = DeliveryFailed
+		return set
+	}
+	// 30 seconds, 2 minutes, 8 minutes, 32 minutes, about 2 hours
+	set["nextAttemptAt"] = now.Add(firstRetryInterval << (2 * (attempts - 1)))
+	return set
+}
+
+// Send posts the delivery to the webhook once, returning the response status code
+func (deliverer *Deliverer) Send(ctx context.Context, webhook *Webhook, delivery *Delivery) (int, error) {
+	body := []byte(delivery.Body)
+	timestamp := time.Now().Unix()
+	req, err := http.NewRequestWithContext(ctx, "POST", webhook.Url, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "kittygifs-webhooks")
+	req.Header.Set(EventHeader, delivery.Event)
+	req.Header.Set(DeliveryHeader, delivery.Id)
+	req.Header.Set(TimestampHeader, strconv.FormatInt(timestamp, 10))
+	req.Header.Set(SignatureHeader, Sign(webhook.Secret, timestamp, body))
+	res, err := deliverer.Client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(res.Body, 64*1024))
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return res.StatusCode, fmt.Errorf("webhook responded with status %d", res.StatusCode)
+	}
+	return res.StatusCode, nil
+}
@@ -0,0 +1,90 @@
+package webhooks
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	. "kittygifs/util"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestFormatPayload(t *testing.T) {
+	payload := Payload{Id: "1", Event: GdprRequestCreate, Actor: "kitty", Target: "issue", Data: Issue{Type: IssueTypeDeletion}}
+	body, err := FormatPayload(FormatDiscord, payload)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"content": "New GDPR deletion request by kitty"}`, string(body))
+	body, err = FormatPayload(FormatSlack, Payload{Event: GifCreate, Actor: "kitty", Target: "gif"})
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"text": "kitty uploaded gif gif"}`, string(body))
+	body, err = FormatPayload(FormatJson, payload)
+	require.NoError(t, err)
+	var decoded map[string]interface{}
+	require.NoError(t, json.Unmarshal(body, &decoded))
+	assert.Equal(t, "gdprRequest.create", decoded["event"])
+	assert.Equal(t, "kitty", decoded["actor"])
+}
+
+func TestValidate(t *testing.T) {
+	webhook := Webhook{Url: "https://example.com/hook", Events: []string{GifCreate}, Format: FormatJson}
+	assert.NoError(t, webhook.Validate())
+	for _, invalid := range []Webhook{
+		{Url: "ftp://example.com", Events: []string{GifCreate}, Format: FormatJson},
+		{Url: "https://example.com", Events: []string{}, Format: FormatJson},
+		{Url: "https://example.com", Events: []string{"gif.unknown"}, Format: FormatJson},
+		{Url: "https://example.com", Events: []string{GifCreate}, Format: "xml"},
+	} {
+		assert.Error(t, invalid.Validate(), invalid)
+	}
+}
+
+func TestNextAttempt(t *testing.T) {
+	now := time.Now()
+	set := NextAttempt(1, 200, nil, now)
+	assert.Equal(t, DeliverySucceeded, set["status"])
+	set = NextAttempt(1, 500, errors.New("webhook responded with status 500"), now)
+	assert.NotContains(t, set, "status")
+	assert.Equal(t, now.Add(30*time.Second), set["nextAttemptAt"])
+	set = NextAttempt(3, 0, errors.New("timeout"), now)
+	assert.Equal(t, now.Add(8*time.Minute), set["nextAttemptAt"])
+	set = NextAttempt(maxAttempts, 0, errors.New("timeout"), now)
+	assert.Equal(t, DeliveryFailed, set["status"])
+	assert.Equal(t, "timeout", set["error"])
+}
+
+func TestSend(t *testing.T) {
+	var received *http.Request
+	var receivedBody []byte
+	status := 204
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r
+		receivedBody, _ = io.ReadAll(r.Body)
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	deliverer := &Deliverer{Client: server.Client()}
+	webhook := &Webhook{Url: server.URL, Secret: "secret"}
+	delivery := &Delivery{Id: "delivery", Event: GifCreate, Body: `{"event":"gif.create"}`}
+	responseStatus, err := deliverer.Send(context.Background(), webhook, delivery)
+	require.NoError(t, err)
+	assert.Equal(t, 204, responseStatus)
+	assert.Equal(t, delivery.Body, string(receivedBody))
+	assert.Equal(t, GifCreate, received.Header.Get(EventHeader))
+	assert.Equal(t, "delivery", received.Header.Get(DeliveryHeader))
+	timestamp, err := strconv.ParseInt(received.Header.Get(TimestampHeader), 10, 64)
+	require.NoError(t, err)
+	assert.Equal(t, Sign("secret", timestamp, receivedBody), received.Header.Get(SignatureHeader))
+	assert.NotEqual(t, Sign("other", timestamp, receivedBody), received.Header.Get(SignatureHeader))
+
+	status = 500
+	responseStatus, err = deliverer.Send(context.Background(), webhook, delivery)
+	assert.Error(t, err)
+	assert.Equal(t, 500, responseStatus)
+}
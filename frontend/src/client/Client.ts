@@ -183,7 +183,7 @@ class KittyGifsClientSync {
     }
 
     public async getSettings(): Promise<SettingsSync> {
-        return (await this.client._axios.get("/sync/settings")).data;
+        return { data: (await this.client._axios.get("/sync/settings")).data };
     }
 
     public async setSettings(settings: Settings): Promise<void> {